@@ -0,0 +1,92 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// chatNotifier posts messages about the changes and failures to a chat
+// service through an incoming webhook. Services only differ by the JSON
+// object wrapping the message.
+type chatNotifier struct {
+	service string
+	client  *http.Client
+	url     string
+	payload func(text string) interface{}
+}
+
+func newSlackNotifier(client *http.Client, url string) *chatNotifier {
+	return &chatNotifier{
+		service: "Slack",
+		client:  client,
+		url:     url,
+		payload: func(text string) interface{} {
+			return map[string]string{"text": text}
+		},
+	}
+}
+
+func newDiscordNotifier(client *http.Client, url string) *chatNotifier {
+	return &chatNotifier{
+		service: "Discord",
+		client:  client,
+		url:     url,
+		payload: func(text string) interface{} {
+			return map[string]string{"content": text}
+		},
+	}
+}
+
+// String does not return the URL, which holds the credentials of the webhook.
+func (n *chatNotifier) String() string {
+	return n.service
+}
+
+func (n *chatNotifier) notifyChange(ctx context.Context, c *ipChange) error {
+	text := fmt.Sprintf(":white_check_mark: %s (%s) now points to %s", c.Hostname, c.Type, c.NewIP)
+
+	if c.OldIP != nil {
+		text += fmt.Sprintf(" (was %s)", c.OldIP)
+	}
+
+	return n.send(ctx, text+".")
+}
+
+func (n *chatNotifier) notifyFailure(ctx context.Context, f *updateFailure) error {
+	return n.send(ctx, fmt.Sprintf(":x: Could not update %s (%s) to %s in %d consecutive cycle(s): %v", f.Hostname, f.Type, f.IP, f.Cycles, f.Err))
+}
+
+func (n *chatNotifier) notifyDetectionFailure(ctx context.Context, f *detectionFailure) error {
+	return n.send(ctx, fmt.Sprintf(":warning: Could not detect the public %s address in %d consecutive cycle(s): %v", f.Family, f.Cycles, f.Err))
+}
+
+func (n *chatNotifier) send(ctx context.Context, text string) error {
+	body, err := json.Marshal(n.payload(text))
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, n.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &dynhost.StatusError{Server: n.service, Status: res.Status, Code: res.StatusCode}
+	}
+
+	return nil
+}
@@ -0,0 +1,483 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// hungServer accepts the requests but never replies to them.
+func hungServer(t *testing.T) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestHTTPTimeoutDetection(t *testing.T) {
+	srv := hungServer(t)
+
+	cfg := loadTestConfig(t, `
+http_timeout = 200ms
+provider_timeout = 0
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+	p := dynhost.HTTPProvider{Client: newHTTPClient(cfg), URL: srv.URL}
+
+	start := time.Now()
+
+	_, err := p.PublicIP(context.Background())
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the request returned after %v, expected about 200ms", elapsed)
+	}
+}
+
+func TestHTTPTimeoutUpdate(t *testing.T) {
+	srv := hungServer(t)
+
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+http_timeout = 200ms
+retries = 0
+
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+`, srv.URL))
+
+	s, err := newSyncer(cfg, newHTTPClient(cfg), &fakeReader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	err = s.syncRecord(context.Background(), cfg.Accounts[0], "home.example.com", dynhost.IPv4, net.ParseIP("203.0.113.7"))
+
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the update returned after %v, expected about 200ms", elapsed)
+	}
+}
+
+func TestProxyURL(t *testing.T) {
+	var (
+		target string
+		auth   string
+	)
+
+	// The proxy answers in place of the provider, which does not exist.
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		target = r.URL.String()
+		auth = r.Header.Get("Proxy-Authorization")
+
+		fmt.Fprintln(w, "203.0.113.7")
+	}))
+	defer proxy.Close()
+
+	u, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	u.User = url.UserPassword("proxyuser", "proxypass")
+
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+proxy_url = %s
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`, u))
+
+	p := dynhost.HTTPProvider{Client: newHTTPClient(cfg), URL: "http://provider.invalid/ip"}
+
+	ip, err := p.PublicIP(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip.String() != "203.0.113.7" {
+		t.Fatalf("got %s, expected 203.0.113.7", ip)
+	}
+
+	if target != "http://provider.invalid/ip" {
+		t.Fatalf("the proxy received a request for %q", target)
+	}
+
+	if expected := "Basic " + base64.StdEncoding.EncodeToString([]byte("proxyuser:proxypass")); auth != expected {
+		t.Fatalf("the proxy received the credentials %q, expected %q", auth, expected)
+	}
+}
+
+func TestTLSVerification(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "good 203.0.113.7")
+	}))
+	defer srv.Close()
+
+	fingerprint := sha256.Sum256(srv.Certificate().Raw)
+	other := sha256.Sum256([]byte("another certificate"))
+
+	tests := []struct {
+		name string
+		keys string
+		err  string
+	}{
+		{name: "unknown authority", err: "certificate"},
+		{name: "insecure_skip_verify", keys: "insecure_skip_verify = true"},
+		{name: "pinned", keys: "insecure_skip_verify = true\npinned_cert_sha256 = " + hex.EncodeToString(fingerprint[:])},
+		{name: "pinned with colons", keys: "insecure_skip_verify = true\npinned_cert_sha256 = " + strings.ToUpper(colons(fingerprint[:]))},
+		{name: "pin mismatch", keys: "insecure_skip_verify = true\npinned_cert_sha256 = " + hex.EncodeToString(other[:]), err: "matches no pinned_cert_sha256"},
+		{
+			name: "one of the pins",
+			keys: "insecure_skip_verify = true\npinned_cert_sha256 = " + hex.EncodeToString(other[:]) + ", " + hex.EncodeToString(fingerprint[:]),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			global, section := "", ""
+
+			// insecure_skip_verify is a global key, and
+			// pinned_cert_sha256 a key of the provider sections.
+			for _, line := range strings.Split(tt.keys, "\n") {
+				if strings.HasPrefix(line, "insecure_skip_verify") {
+					global += line + "\n"
+				} else {
+					section += line + "\n"
+				}
+			}
+
+			cfg := loadTestConfig(t, fmt.Sprintf(`
+%s
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+%s`, global, srv.URL, section))
+
+			u := newUpdater(cfg, cfg.Accounts[0], newHTTPClient(cfg))
+
+			_, err := u.Update(context.Background(), "home.example.com", net.ParseIP("203.0.113.7"))
+
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+// colons formats b as hexadecimal bytes separated by colons, as printed by
+// openssl.
+func colons(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		parts[i] = hex.EncodeToString([]byte{c})
+	}
+
+	return strings.Join(parts, ":")
+}
+
+func TestKeepAlive(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    int
+		opened int64
+	}{
+		{name: "reused", max: 4, opened: 1},
+		{name: "disabled", max: 0, opened: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var opened int64
+
+			srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, "good 203.0.113.7")
+			}))
+
+			srv.Config.ConnState = func(conn net.Conn, state http.ConnState) {
+				if state == http.StateNew {
+					atomic.AddInt64(&opened, 1)
+				}
+			}
+
+			srv.Start()
+			defer srv.Close()
+
+			cfg := loadTestConfig(t, fmt.Sprintf(`
+max_idle_conns_per_host = %d
+
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+`, tt.max, srv.URL))
+
+			u := newUpdater(cfg, cfg.Accounts[0], newHTTPClient(cfg))
+
+			reusedBefore := atomic.LoadInt64(&connsReused)
+
+			for i := 0; i < 3; i++ {
+				if _, err := u.Update(context.Background(), "home.example.com", net.ParseIP("203.0.113.7")); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if n := atomic.LoadInt64(&opened); n != tt.opened {
+				t.Fatalf("the server accepted %d connection(s), expected %d", n, tt.opened)
+			}
+
+			if reused := atomic.LoadInt64(&connsReused) - reusedBefore; reused != 3-tt.opened {
+				t.Fatalf("%d connection(s) reused, expected %d", reused, 3-tt.opened)
+			}
+		})
+	}
+}
+
+// localAddrs returns a listener on address and a channel receiving the remote
+// address of each connection it accepts.
+func localAddrs(t *testing.T, address string) (net.Listener, <-chan net.Addr) {
+	t.Helper()
+
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		t.Skipf("cannot listen on %s: %v", address, err)
+	}
+
+	t.Cleanup(func() { l.Close() })
+
+	remotes := make(chan net.Addr, 1)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+
+			remotes <- conn.RemoteAddr()
+			conn.Close()
+		}
+	}()
+
+	return l, remotes
+}
+
+func TestSourceDialer(t *testing.T) {
+	l4, remotes4 := localAddrs(t, "127.0.0.1:0")
+	l6, remotes6 := localAddrs(t, "[::1]:0")
+
+	// The whole 127.0.0.0/8 is routed to the loopback interface, so the
+	// connections from 127.0.0.2 reach the listener on 127.0.0.1.
+	dial := sourceDialer(map[dynhost.Family]net.IP{
+		dynhost.IPv4: net.ParseIP("127.0.0.2"),
+		dynhost.IPv6: net.ParseIP("::1"),
+	})
+
+	tests := []struct {
+		address string
+		remotes <-chan net.Addr
+		source  string
+	}{
+		{address: l4.Addr().String(), remotes: remotes4, source: "127.0.0.2"},
+		{address: l6.Addr().String(), remotes: remotes6, source: "::1"},
+	}
+
+	for _, tt := range tests {
+		conn, err := dial(context.Background(), "tcp", tt.address)
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn.Close()
+
+		if local := conn.LocalAddr().(*net.TCPAddr); !local.IP.Equal(net.ParseIP(tt.source)) {
+			t.Fatalf("%s was dialed from %s, expected %s", tt.address, local.IP, tt.source)
+		}
+
+		if remote := (<-tt.remotes).(*net.TCPAddr); !remote.IP.Equal(net.ParseIP(tt.source)) {
+			t.Fatalf("%s accepted a connection from %s, expected %s", tt.address, remote.IP, tt.source)
+		}
+	}
+
+	// Without an IPv6 source, the IPv6 servers are not dialed.
+	dial = sourceDialer(map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("127.0.0.2")})
+
+	if conn, err := dial(context.Background(), "tcp", l6.Addr().String()); err == nil {
+		conn.Close()
+		t.Fatal("the IPv6 server was dialed without an IPv6 source address")
+	}
+}
+
+func TestHTTPTimeoutHostname(t *testing.T) {
+	srv := hungServer(t)
+
+	// The most specific timeout is shorter than the others, and bounds the
+	// update alone.
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+http_timeout = 10s
+retries = 0
+
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+http_timeout = 5s
+hostname_timeout = home.example.com:200ms
+`, srv.URL))
+
+	s, err := newSyncer(cfg, newHTTPClient(cfg), &fakeReader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+
+	err = s.syncRecord(context.Background(), cfg.Accounts[0], "home.example.com", dynhost.IPv4, net.ParseIP("203.0.113.7"))
+	if err == nil {
+		t.Fatal("the update succeeded")
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the update returned after %v, expected about 200ms", elapsed)
+	}
+}
+
+func TestCABundle(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "good 203.0.113.7")
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+
+	// The certificate of the server is only trusted through the bundle.
+	bundle := filepath.Join(dir, "bundle.pem")
+	if err := ioutil.WriteFile(bundle, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		keys string
+		err  string
+	}{
+		{name: "without bundle", err: "certificate signed by unknown authority"},
+		{name: "appended", keys: "ca_bundle = " + bundle},
+		{name: "replaced", keys: "ca_bundle = " + bundle + "\nca_bundle_mode = replace"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, fmt.Sprintf(`
+%s
+
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+`, tt.keys, srv.URL))
+
+			u := newUpdater(cfg, cfg.Accounts[0], newHTTPClient(cfg))
+
+			_, err := u.Update(context.Background(), "home.example.com", net.ParseIP("203.0.113.7"))
+
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestCABundleInvalid(t *testing.T) {
+	dir := t.TempDir()
+
+	empty := filepath.Join(dir, "empty.pem")
+	if err := ioutil.WriteFile(empty, []byte("not a certificate\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		keys string
+		err  string
+	}{
+		{name: "missing file", keys: "ca_bundle = " + filepath.Join(dir, "missing.pem"), err: "could not read ca_bundle"},
+		{name: "no certificate", keys: "ca_bundle = " + empty, err: "ca_bundle " + empty + " holds no PEM certificate"},
+		{name: "invalid mode", keys: "ca_bundle = " + empty + "\nca_bundle_mode = merge", err: `invalid ca_bundle_mode "merge"`},
+		{name: "mode without bundle", keys: "ca_bundle_mode = replace", err: "ca_bundle_mode requires ca_bundle"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := loadTestConfigError(t, tt.keys+`
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// commandHook runs a local command for every change, with the old and new
+// addresses as its last two arguments. The change is also described by the
+// DYNHOST_HOSTNAME, DYNHOST_OLD_IP and DYNHOST_NEW_IP environment variables.
+type commandHook struct {
+	args    []string
+	timeout time.Duration
+}
+
+func (h *commandHook) String() string {
+	return h.args[0]
+}
+
+func (h *commandHook) notifyChange(ctx context.Context, c *ipChange) error {
+	ctx, cancel := context.WithTimeout(ctx, h.timeout)
+	defer cancel()
+
+	var oldIP string
+	if c.OldIP != nil {
+		oldIP = c.OldIP.String()
+	}
+
+	args := append(append([]string{}, h.args[1:]...), oldIP, c.NewIP.String())
+
+	cmd := exec.CommandContext(ctx, h.args[0], args...)
+	cmd.Env = append(os.Environ(),
+		"DYNHOST_HOSTNAME="+c.Hostname,
+		"DYNHOST_OLD_IP="+oldIP,
+		"DYNHOST_NEW_IP="+c.NewIP.String())
+
+	// The output goes to a file rather than a pipe, which processes left in
+	// the background by the command would keep open past the timeout.
+	out, err := ioutil.TempFile("", "go-dynhost-")
+	if err != nil {
+		return fmt.Errorf("could not create the output file: %v", err)
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	cmd.Stdout = out
+	cmd.Stderr = out
+
+	err = cmd.Run()
+
+	if output, readErr := ioutil.ReadFile(out.Name()); readErr != nil {
+		warnf("Could not read the output of %s: %v", h, readErr)
+	} else if output := strings.TrimSpace(string(output)); output != "" {
+		with(fields{"hostname": c.Hostname, "type": c.Type, "command": h.args[0]}).infof("Output of %s for %s: %s", h, recordName(c.Hostname, c.family), output)
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("timed out after %v", h.timeout)
+	}
+
+	return err
+}
+
+// commandOutput runs args and returns its standard output, which is never
+// written to disk. The standard error is included in the error if the command
+// fails.
+func commandOutput(args []string, timeout time.Duration) (string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+
+	// As for the hooks, the standard error goes to a file rather than a pipe.
+	stderr, err := ioutil.TempFile("", "go-dynhost-")
+	if err != nil {
+		return "", fmt.Errorf("could not create the output file: %v", err)
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		return "", err
+	}
+	defer r.Close()
+
+	cmd.Stdout = w
+	cmd.Stderr = stderr
+
+	err = cmd.Start()
+	w.Close()
+
+	if err != nil {
+		return "", err
+	}
+
+	var out bytes.Buffer
+
+	read := make(chan error, 1)
+	go func() {
+		_, err := out.ReadFrom(r)
+		read <- err
+	}()
+
+	err = cmd.Wait()
+
+	// Processes left in the background by the command may keep the pipe
+	// open: stop reading shortly after the command exits.
+	r.SetReadDeadline(time.Now().Add(time.Second))
+	readErr := <-read
+
+	if err != nil {
+		if ctx.Err() == context.DeadlineExceeded {
+			return "", fmt.Errorf("timed out after %v", timeout)
+		}
+
+		if msg, _ := ioutil.ReadFile(stderr.Name()); len(bytes.TrimSpace(msg)) > 0 {
+			return "", fmt.Errorf("%v: %s", err, bytes.TrimSpace(msg))
+		}
+
+		return "", err
+	}
+
+	if readErr != nil && !errors.Is(readErr, os.ErrDeadlineExceeded) {
+		return "", fmt.Errorf("could not read the output: %v", readErr)
+	}
+
+	return out.String(), nil
+}
@@ -0,0 +1,1442 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+	"gopkg.in/ini.v1"
+)
+
+// defaultInterval is the time between two synchronizations when running as
+// a daemon without an explicit interval.
+const defaultInterval = 5 * time.Minute
+
+// Values of the ca_bundle_mode key.
+const (
+	caBundleAppend  = "append"
+	caBundleReplace = "replace"
+)
+
+// Values of the record_match key.
+const (
+	recordMatchExact  = "exact"
+	recordMatchMember = "member"
+)
+
+var (
+	defaultIPv4Providers = []string{
+		"https://api.ipify.org",
+		"https://ipv4.icanhazip.com",
+		"https://v4.ident.me",
+	}
+
+	defaultIPv6Providers = []string{
+		"https://api6.ipify.org",
+		"https://ipv6.icanhazip.com",
+		"https://v6.ident.me",
+	}
+
+	// defaultRejectedRanges lists the private, loopback, link-local and
+	// carrier-grade NAT ranges, which cannot be a valid public address.
+	defaultRejectedRanges = []string{
+		"10.0.0.0/8",
+		"172.16.0.0/12",
+		"192.168.0.0/16",
+		"127.0.0.0/8",
+		"169.254.0.0/16",
+		"100.64.0.0/10",
+		"::1/128",
+		"fe80::/10",
+		"fc00::/7",
+	}
+)
+
+// Config holds the settings read from the configuration file.
+type Config struct {
+	Families []dynhost.Family
+
+	Interface       string
+	IPv4Providers   []string
+	IPv6Providers   []string
+	ProviderFormat  string
+	ProviderField   string
+	ProviderTimeout time.Duration
+	RejectedRanges  []*net.IPNet
+	ConsensusMin    int
+	HTTPTimeout     time.Duration
+	ProxyURL        *url.URL
+
+	// MaxIdleConnsPerHost and IdleConnTimeout bound the connections kept
+	// open between the requests to the same server.
+	MaxIdleConnsPerHost int
+	IdleConnTimeout     time.Duration
+
+	// InsecureSkipVerify disables the verification of the TLS certificates,
+	// e.g. to test against a self-signed mock server.
+	InsecureSkipVerify bool
+
+	// RootCAs are the roots the TLS certificates are verified against, from
+	// ca_bundle, or nil to use those of the system.
+	RootCAs *x509.CertPool
+
+	// FailOnCGNAT refuses to publish a carrier-grade NAT address, which is
+	// only reported by a warning otherwise.
+	FailOnCGNAT bool
+
+	// AllowedCIDRs are the ranges the detected addresses must belong to, if
+	// any range of their family is listed.
+	AllowedCIDRs []*net.IPNet
+
+	// PreferTemporary selects the temporary IPv6 addresses of the interface
+	// rather than the stable ones.
+	PreferTemporary bool
+
+	// ShuffleProviders queries the providers in a random order.
+	ShuffleProviders bool
+
+	// SourceAddresses are the local addresses of the connections to the
+	// providers and the DynHost API, by family, if not empty.
+	SourceAddresses map[dynhost.Family]net.IP
+
+	Retries        int
+	RetryBaseDelay time.Duration
+
+	// ServerErrorBackoff is the time the updates of a hostname are
+	// suspended in daemon mode after the provider replied 911, doubled on
+	// each consecutive 911.
+	ServerErrorBackoff time.Duration
+
+	StateFile   string
+	Concurrency int
+
+	// MinUpdateInterval is the minimum time between two updates of a
+	// record, or 0.
+	MinUpdateInterval time.Duration
+
+	// Debounce is the time a new public address must remain stable before
+	// it is published in daemon mode, or 0.
+	Debounce time.Duration
+
+	// Interval is the time between two synchronizations in daemon mode, or
+	// 0 to synchronize only once.
+	Interval time.Duration
+
+	// IntervalJitter is the fraction of Interval by which each wait between
+	// two synchronizations may randomly be shortened or lengthened.
+	IntervalJitter float64
+
+	// WatchLinks starts a synchronization in daemon mode as soon as the
+	// addresses or the default routes of the host change, on Linux.
+	WatchLinks bool
+
+	Resolver           string
+	DNSTimeout         time.Duration
+	AuthoritativeCheck bool
+
+	// VerifyTXT is the name of the TXT record holding the current value of
+	// the only hostname, if set in the global section. The provider sections
+	// set it by hostname instead.
+	VerifyTXT string
+
+	// ResolverDoT is the DNS-over-TLS server used instead of Resolver, if
+	// any.
+	ResolverDoT string
+
+	// RespectTTL reuses the value read from a record until its TTL expires.
+	RespectTTL bool
+
+	// RecordMatch is recordMatchExact if a record is only up-to-date when
+	// its only value is the public address, or recordMatchMember if it may
+	// have other values.
+	RecordMatch string
+
+	// PlaceholderIPs are the values of the records never considered
+	// up-to-date, such as the address of a freshly created record.
+	PlaceholderIPs []net.IP
+
+	UserAgent string
+
+	LogLevel logLevel
+
+	// SyslogFacility is the facility of the messages sent to syslog.
+	SyslogFacility string
+
+	// LogFile receives the messages instead of stderr, if not empty. It is
+	// rotated when it reaches LogMaxSize bytes, if not 0, keeping
+	// LogMaxFiles old files.
+	LogFile     string
+	LogMaxSize  int64
+	LogMaxFiles int
+
+	// WebhookURL receives a JSON object for every record changed.
+	WebhookURL string
+
+	// EventSocket is the Unix domain socket or named pipe to which a JSON
+	// line is written for every record changed.
+	EventSocket string
+
+	// SlackWebhookURL and DiscordWebhookURL receive a message for every
+	// record changed or that could not be updated.
+	SlackWebhookURL   string
+	DiscordWebhookURL string
+
+	// SMTP configures the email notifications, which are disabled if its
+	// Host is empty.
+	SMTP SMTPConfig
+
+	// DetectionFailureThreshold is the number of consecutive cycles in which
+	// the public address could not be detected before the notifiers are
+	// told about it.
+	DetectionFailureThreshold int
+
+	// UpdateFailureThreshold is the number of consecutive cycles in which a
+	// record could not be updated before the notifiers are told about it.
+	UpdateFailureThreshold int
+
+	// PostUpdateCommand is the command and arguments run for every record
+	// changed.
+	PostUpdateCommand []string
+	PostUpdateTimeout time.Duration
+
+	Accounts []*Account
+}
+
+// SMTPConfig holds the settings of the email notifications.
+type SMTPConfig struct {
+	Host     string
+	Port     int
+	User     string
+	Password string
+	From     string
+	To       []string
+
+	NotifyChanges  bool
+	NotifyFailures bool
+}
+
+// Account holds the settings of a provider section: the credentials of an
+// account and the hostnames it manages.
+type Account struct {
+	// Name is the name of the section, such as "ovh" or "ovh:home".
+	Name string
+
+	Provider  string
+	Endpoint  string
+	Username  string
+	Password  string
+	Hostnames []string
+
+	// Method is the HTTP method of the updates: GET or POST.
+	Method string
+
+	// AlwaysUpdate updates the records even if they are up-to-date, as
+	// the -force flag does for every account. The debounce, min_update_interval
+	// and the 911 suspension still apply.
+	AlwaysUpdate bool
+
+	// CombinedUpdate updates the A and AAAA records of a hostname in a
+	// single request in dual-stack mode, when both are out of date.
+	CombinedUpdate bool
+
+	// SuccessResponse matches the successful responses of the provider, if
+	// it does not reply with the "good" and "nochg" codes.
+	SuccessResponse *regexp.Regexp
+
+	// ParamNames renames the parameters of the updates, from their names
+	// in the protocol.
+	ParamNames map[string]string
+
+	// HTTPTimeout bounds the updates of the account instead of the global
+	// http_timeout, if not 0, and HostnameTimeouts those of some of its
+	// hostnames.
+	HTTPTimeout      time.Duration
+	HostnameTimeouts map[string]time.Duration
+
+	// PinnedCerts are the SHA-256 fingerprints, one of which the
+	// certificate of the endpoint must match, if any.
+	PinnedCerts [][]byte
+
+	// VerifyTXT holds the names of the TXT records holding the current
+	// value of some of the hostnames, instead of their A/AAAA records.
+	VerifyTXT map[string]string
+}
+
+// configErrors lists the problems found in the configuration.
+type configErrors []error
+
+func (ce configErrors) Error() string {
+	msgs := make([]string, 0, len(ce))
+
+	for _, err := range ce {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// loadConfig reads the configuration file at path, in the given format or in
+// the format matching its extension if empty, merges the files of dir into it
+// if not empty, and applies the overrides of the environment. The file may be
+// missing if the directory or the environment holds the credentials.
+func loadConfig(path, format, dir string) (*Config, error) {
+	return readConfig(path, format, dir, true)
+}
+
+// validateConfig is like loadConfig, but does not resolve the secrets:
+// password_command is not run, and credentials_file and password_file are only
+// checked to exist. The accounts of the result have no password.
+func validateConfig(path, format, dir string) (*Config, error) {
+	return readConfig(path, format, dir, false)
+}
+
+// readConfig implements loadConfig, resolving the secrets if secrets is true,
+// and validateConfig otherwise.
+func readConfig(path, format, dir string, secrets bool) (*Config, error) {
+	file, err := loadFile(path, format)
+	if errors.Is(err, os.ErrNotExist) && (dir != "" || accountEnvSet()) {
+		// The directory or the environment holds the whole configuration.
+		file, err = ini.LoadSources(ini.LoadOptions{AllowShadows: true}, []byte{})
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if dir != "" {
+		if err := mergeConfigDir(file, dir); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applyEnv(file); err != nil {
+		return nil, err
+	}
+
+	global := file.Section("")
+
+	// Every problem is reported at once.
+	var problems configErrors
+
+	families, err := parseProtocol(global.Key("protocol").String())
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	cfg := Config{
+		Families:      families,
+		Interface:     global.Key("interface").String(),
+		IPv4Providers: global.Key("ipv4_providers").Strings(","),
+		IPv6Providers: global.Key("ipv6_providers").Strings(","),
+	}
+
+	if cfg.PreferTemporary, err = boolKey(global, "prefer_temporary", false); err != nil {
+		problems = append(problems, err)
+	}
+
+	// A custom provider replaces the default ones, but is only tried first
+	// when providers are listed explicitly.
+	if custom := global.Key("ip_provider_url").String(); custom != "" {
+		if _, err := url.ParseRequestURI(custom); err != nil {
+			problems = append(problems, fmt.Errorf("invalid ip_provider_url: %v", err))
+		}
+
+		cfg.IPv4Providers = append([]string{custom}, cfg.IPv4Providers...)
+	}
+
+	if len(cfg.IPv4Providers) == 0 {
+		cfg.IPv4Providers = defaultIPv4Providers
+	}
+
+	if len(cfg.IPv6Providers) == 0 {
+		cfg.IPv6Providers = defaultIPv6Providers
+	}
+
+	switch cfg.ProviderFormat = global.Key("ip_provider_format").MustString("text"); cfg.ProviderFormat {
+	case "text", "json":
+	default:
+		problems = append(problems, fmt.Errorf("invalid ip_provider_format %q (expected text or json)", cfg.ProviderFormat))
+	}
+
+	cfg.ProviderField = global.Key("ip_provider_field").MustString("ip")
+
+	if cfg.ProviderTimeout, err = durationKey(global, "provider_timeout", 5*time.Second); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.ConsensusMin, err = intKey(global, "consensus_min", 1); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.ShuffleProviders, err = boolKey(global, "shuffle_providers", false); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.HTTPTimeout, err = durationKey(global, "http_timeout", 10*time.Second); err != nil {
+		problems = append(problems, err)
+	}
+
+	if source := global.Key("source_address").String(); source != "" {
+		if cfg.SourceAddresses, err = parseSourceAddresses(source, families); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	if cfg.MaxIdleConnsPerHost, err = intKey(global, "max_idle_conns_per_host", 4); err != nil {
+		problems = append(problems, err)
+	} else if cfg.MaxIdleConnsPerHost < 0 {
+		problems = append(problems, errors.New("max_idle_conns_per_host cannot be negative"))
+	}
+
+	if cfg.IdleConnTimeout, err = durationKey(global, "idle_conn_timeout", 90*time.Second); err != nil {
+		problems = append(problems, err)
+	}
+
+	if proxy := global.Key("proxy_url").String(); proxy != "" {
+		if cfg.ProxyURL, err = url.Parse(proxy); err != nil {
+			problems = append(problems, fmt.Errorf("invalid proxy_url: %v", err))
+		} else if cfg.ProxyURL.Scheme == "" || cfg.ProxyURL.Host == "" {
+			problems = append(problems, fmt.Errorf("invalid proxy_url %q: expected scheme://[user:password@]host:port", proxy))
+		}
+	}
+
+	if cfg.InsecureSkipVerify, err = boolKey(global, "insecure_skip_verify", false); err != nil {
+		problems = append(problems, err)
+	}
+
+	if bundle := global.Key("ca_bundle").String(); bundle != "" {
+		if cfg.RootCAs, err = loadCABundle(bundle, global.Key("ca_bundle_mode").MustString(caBundleAppend)); err != nil {
+			problems = append(problems, err)
+		}
+	} else if global.HasKey("ca_bundle_mode") {
+		problems = append(problems, errors.New("ca_bundle_mode requires ca_bundle"))
+	}
+
+	if cfg.Retries, err = intKey(global, "retries", 2); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.Retries < 0 {
+		problems = append(problems, errors.New("retries cannot be negative"))
+	}
+
+	if cfg.Retries > maxRetries {
+		problems = append(problems, fmt.Errorf("retries cannot exceed %d", maxRetries))
+	}
+
+	if cfg.RetryBaseDelay, err = durationKey(global, "retry_base_delay", time.Second); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.RetryBaseDelay < 0 {
+		problems = append(problems, errors.New("retry_base_delay cannot be negative"))
+	}
+
+	if cfg.ServerErrorBackoff, err = durationKey(global, "server_error_backoff", 15*time.Minute); err != nil {
+		problems = append(problems, err)
+	}
+
+	cfg.StateFile = global.Key("state_file").String()
+
+	if cfg.MinUpdateInterval, err = durationKey(global, "min_update_interval", 0); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.Debounce, err = durationKey(global, "debounce", 0); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.Interval, err = durationKey(global, "interval", 0); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.IntervalJitter, err = fractionKey(global, "interval_jitter"); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.WatchLinks, err = boolKey(global, "watch_links", false); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.Concurrency, err = intKey(global, "concurrency", 4); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.Concurrency < 1 {
+		problems = append(problems, errors.New("concurrency must be at least 1"))
+	}
+
+	if cfg.Resolver = global.Key("resolver").String(); cfg.Resolver != "" {
+		if _, _, err := net.SplitHostPort(cfg.Resolver); err != nil {
+			cfg.Resolver = net.JoinHostPort(cfg.Resolver, "53")
+		}
+	}
+
+	if cfg.ResolverDoT = global.Key("resolver_dot").String(); cfg.ResolverDoT != "" {
+		if _, _, err := net.SplitHostPort(cfg.ResolverDoT); err != nil {
+			cfg.ResolverDoT = net.JoinHostPort(cfg.ResolverDoT, "853")
+		}
+
+		if cfg.Resolver != "" {
+			problems = append(problems, errors.New("resolver and resolver_dot cannot both be set"))
+		}
+	}
+
+	if cfg.DNSTimeout, err = durationKey(global, "dns_timeout", 5*time.Second); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.AuthoritativeCheck, err = boolKey(global, "authoritative_check", false); err != nil {
+		problems = append(problems, err)
+	}
+
+	// The authoritative nameservers would be queried in clear.
+	if cfg.AuthoritativeCheck && cfg.ResolverDoT != "" {
+		problems = append(problems, errors.New("authoritative_check cannot be enabled with resolver_dot"))
+	}
+
+	cfg.VerifyTXT = global.Key("verify_txt").String()
+
+	if cfg.RespectTTL, err = boolKey(global, "respect_ttl", false); err != nil {
+		problems = append(problems, err)
+	}
+
+	switch cfg.RecordMatch = global.Key("record_match").MustString(recordMatchExact); cfg.RecordMatch {
+	case recordMatchExact, recordMatchMember:
+	default:
+		problems = append(problems, fmt.Errorf("invalid record_match %q: expected %s or %s", cfg.RecordMatch, recordMatchExact, recordMatchMember))
+	}
+
+	for _, value := range global.Key("placeholder_ips").Strings(",") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			problems = append(problems, fmt.Errorf("invalid placeholder_ips address %q", value))
+			continue
+		}
+
+		cfg.PlaceholderIPs = append(cfg.PlaceholderIPs, ip)
+	}
+
+	rejected := defaultRejectedRanges
+
+	// An empty value explicitly allows every address.
+	if global.HasKey("rejected_ranges") {
+		rejected = global.Key("rejected_ranges").Strings(",")
+	}
+
+	if cfg.RejectedRanges, err = parseCIDRs(rejected); err != nil {
+		problems = append(problems, fmt.Errorf("invalid rejected_ranges: %v", err))
+	}
+
+	if cfg.FailOnCGNAT, err = boolKey(global, "fail_on_cgnat", false); err != nil {
+		problems = append(problems, err)
+	}
+
+	if global.HasKey("allowed_cidrs") {
+		if cfg.AllowedCIDRs, err = parseCIDRs(global.Key("allowed_cidrs").Strings(",")); err != nil {
+			problems = append(problems, fmt.Errorf("invalid allowed_cidrs: %v", err))
+		}
+	}
+
+	cfg.UserAgent = global.Key("user_agent").String()
+
+	cfg.LogLevel = levelInfo
+
+	if level := global.Key("log_level").String(); level != "" {
+		if cfg.LogLevel, err = parseLogLevel(level); err != nil {
+			problems = append(problems, err)
+		}
+	}
+
+	cfg.SyslogFacility = global.Key("syslog_facility").MustString("daemon")
+	if _, ok := facilities[cfg.SyslogFacility]; !ok {
+		problems = append(problems, fmt.Errorf("invalid syslog_facility %q (expected e.g. daemon, user or local0)", cfg.SyslogFacility))
+	}
+
+	cfg.LogFile = global.Key("log_file").String()
+
+	if cfg.LogMaxSize, err = sizeKey(global, "log_max_size", 10<<20); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.LogMaxFiles, err = intKey(global, "log_max_files", 3); err != nil {
+		problems = append(problems, err)
+	} else if cfg.LogMaxFiles < 0 {
+		problems = append(problems, errors.New("log_max_files cannot be negative"))
+	}
+
+	if cfg.WebhookURL, err = httpURLKey(global, "webhook_url"); err != nil {
+		problems = append(problems, err)
+	}
+
+	cfg.EventSocket = global.Key("event_socket").String()
+
+	if cfg.SlackWebhookURL, err = httpURLKey(global, "slack_webhook_url"); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.DiscordWebhookURL, err = httpURLKey(global, "discord_webhook_url"); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.SMTP, err = loadSMTP(global); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.DetectionFailureThreshold, err = intKey(global, "detection_failure_threshold", 3); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.DetectionFailureThreshold < 1 {
+		problems = append(problems, errors.New("detection_failure_threshold must be at least 1"))
+	}
+
+	if cfg.UpdateFailureThreshold, err = intKey(global, "update_failure_threshold", 3); err != nil {
+		problems = append(problems, err)
+	}
+
+	if cfg.UpdateFailureThreshold < 1 {
+		problems = append(problems, errors.New("update_failure_threshold must be at least 1"))
+	}
+
+	cfg.PostUpdateCommand = strings.Fields(global.Key("post_update_command").String())
+
+	if cfg.PostUpdateTimeout, err = durationKey(global, "post_update_timeout", 30*time.Second); err != nil {
+		problems = append(problems, err)
+	}
+
+	// The provider key restricts the sections to those of a single provider.
+	onlyProvider := global.Key("provider").String()
+	if _, ok := providerEndpoints[onlyProvider]; onlyProvider != "" && !ok {
+		problems = append(problems, fmt.Errorf("unknown provider %q", onlyProvider))
+	}
+
+	var creds *ini.File
+
+	if path := global.Key("credentials_file").String(); path != "" {
+		if !secrets {
+			if _, err := os.Stat(path); err != nil {
+				problems = append(problems, fmt.Errorf("could not read credentials_file: %v", err))
+			}
+
+			creds = ini.Empty()
+		} else if creds, err = loadFile(path, ""); err != nil {
+			problems = append(problems, fmt.Errorf("could not read credentials_file: %v", err))
+			creds = ini.Empty()
+		}
+	}
+
+	for _, section := range file.Sections() {
+		if section.Name() == ini.DEFAULT_SECTION {
+			continue
+		}
+
+		account, errs := loadAccount(section, creds, secrets)
+		for _, err := range errs {
+			problems = append(problems, fmt.Errorf("[%s]: %v", section.Name(), err))
+		}
+
+		if account != nil && (onlyProvider == "" || account.Provider == onlyProvider) {
+			cfg.Accounts = append(cfg.Accounts, account)
+		}
+	}
+
+	if len(cfg.Accounts) == 0 && len(problems) == 0 {
+		problems = append(problems, errors.New("no provider section"))
+	}
+
+	// A single TXT record cannot hold the values of several hostnames.
+	if hostnames := 0; cfg.VerifyTXT != "" {
+		for _, account := range cfg.Accounts {
+			hostnames += len(account.Hostnames)
+		}
+
+		if hostnames > 1 {
+			problems = append(problems, errors.New("verify_txt cannot be set in the global section with several hostnames: set it in the provider sections as hostname:name pairs"))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	return &cfg, nil
+}
+
+// loadAccount reads a provider section, named after the provider with an
+// optional label such as [ovh] or [ovh:home]. Its credentials may be read from
+// creds, the credentials file, and its password is only resolved if secrets
+// is true. It returns every problem found in the section.
+func loadAccount(section *ini.Section, creds *ini.File, secrets bool) (*Account, configErrors) {
+	account := Account{
+		Name:     section.Name(),
+		Provider: strings.SplitN(section.Name(), ":", 2)[0],
+	}
+
+	defaultEndpoint, ok := providerEndpoints[account.Provider]
+	if !ok {
+		return nil, configErrors{fmt.Errorf("unknown provider %q", account.Provider)}
+	}
+
+	var problems configErrors
+
+	if account.Endpoint = section.Key("api_endpoint").MustString(defaultEndpoint); account.Endpoint == "" {
+		problems = append(problems, fmt.Errorf("api_endpoint cannot be empty for the %s provider", account.Provider))
+	} else if u, err := url.Parse(account.Endpoint); err != nil || !u.IsAbs() || u.Host == "" {
+		problems = append(problems, fmt.Errorf("invalid api_endpoint %q: expected an absolute URL", account.Endpoint))
+	}
+
+	switch account.Method = strings.ToUpper(section.Key("method").MustString("GET")); account.Method {
+	case "GET", "POST":
+	default:
+		problems = append(problems, fmt.Errorf("invalid method %q (expected GET or POST)", account.Method))
+	}
+
+	alwaysUpdate, err := boolKey(section, "always_update", false)
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	account.AlwaysUpdate = alwaysUpdate
+
+	// OVH reads the IPv6 address from the myip6 parameter; other providers
+	// may not.
+	combinedUpdate, err := boolKey(section, "combined_update", account.Provider == "ovh")
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	account.CombinedUpdate = combinedUpdate
+
+	if account.SuccessResponse, err = successResponseKey(section); err != nil {
+		problems = append(problems, err)
+	}
+
+	if account.ParamNames, err = paramNames(section); err != nil {
+		problems = append(problems, err)
+	}
+
+	for _, pin := range section.Key("pinned_cert_sha256").Strings(",") {
+		fingerprint, err := hex.DecodeString(strings.ReplaceAll(pin, ":", ""))
+		if err != nil || len(fingerprint) != sha256.Size {
+			problems = append(problems, fmt.Errorf("invalid pinned_cert_sha256 %q: expected a hexadecimal SHA-256 fingerprint", pin))
+			continue
+		}
+
+		account.PinnedCerts = append(account.PinnedCerts, fingerprint)
+	}
+
+	credsSection, err := credentials(section, creds, secrets)
+	if err != nil {
+		problems = append(problems, err)
+	}
+
+	if credsSection != nil {
+		if account.Username = credsSection.Key("username").String(); account.Username == "" {
+			problems = append(problems, errors.New("username cannot be empty: set it in the provider section or in DYNHOST_USERNAME"))
+		}
+
+		password, err := loadPassword(credsSection, secrets)
+		if err != nil {
+			problems = append(problems, err)
+		}
+
+		account.Password = password
+	}
+
+	// Hostnames may be listed in a single key, separated by commas, or in
+	// repeated keys.
+	invalid := false
+
+	for _, value := range section.Key("hostname").ValueWithShadows() {
+		for _, hostname := range strings.Split(value, ",") {
+			if hostname = strings.TrimSpace(hostname); hostname == "" {
+				continue
+			}
+
+			if err := checkHostname(hostname); err != nil {
+				problems = append(problems, err)
+				invalid = true
+				continue
+			}
+
+			account.Hostnames = append(account.Hostnames, hostname)
+		}
+	}
+
+	if len(account.Hostnames) == 0 && !invalid {
+		problems = append(problems, errors.New("hostname cannot be empty: set it in the provider section or in DYNHOST_HOSTNAME"))
+	}
+
+	if account.HTTPTimeout, err = durationKey(section, "http_timeout", 0); err != nil {
+		problems = append(problems, err)
+	}
+
+	if account.HostnameTimeouts, err = hostnameTimeouts(section, account.Hostnames); err != nil {
+		problems = append(problems, err)
+	}
+
+	if account.VerifyTXT, err = verifyTXTNames(section, account.Hostnames); err != nil {
+		problems = append(problems, err)
+	}
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	return &account, nil
+}
+
+// checkHostname returns an error if hostname is not a valid DNS name.
+func checkHostname(hostname string) error {
+	name := strings.TrimSuffix(hostname, ".")
+
+	if len(name) > 253 {
+		return fmt.Errorf("invalid hostname %q: longer than 253 characters", hostname)
+	}
+
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return fmt.Errorf("invalid hostname %q: bad label %q", hostname, label)
+		}
+
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return fmt.Errorf("invalid hostname %q: unexpected character %q", hostname, c)
+			}
+		}
+	}
+
+	return nil
+}
+
+// credentials returns the section holding the username and password of a
+// provider section: the section of creds named by its credentials_ref key, or
+// the provider section itself. The section of creds is only looked up, and
+// nil returned for it otherwise, if secrets is true.
+func credentials(section *ini.Section, creds *ini.File, secrets bool) (*ini.Section, error) {
+	if !section.HasKey("credentials_ref") {
+		return section, nil
+	}
+
+	ref := section.Key("credentials_ref").String()
+
+	for _, key := range []string{"username", "password", "password_file", "password_command"} {
+		if section.HasKey(key) && section.Key(key).String() != "" {
+			return nil, fmt.Errorf("credentials_ref cannot be combined with %s", key)
+		}
+	}
+
+	switch {
+	case ref == "":
+		return nil, errors.New("credentials_ref cannot be empty")
+	case creds == nil:
+		return nil, errors.New("credentials_ref requires credentials_file")
+	case !secrets:
+		return nil, nil
+	}
+
+	credsSection, err := creds.GetSection(ref)
+	if err != nil || ref == ini.DEFAULT_SECTION {
+		return nil, fmt.Errorf("credentials_ref %q: no such section in credentials_file", ref)
+	}
+
+	return credsSection, nil
+}
+
+// loadPassword returns the password of a provider section: the value of the
+// password key, the content of the file named by the password_file key, or
+// the output of the password_command key. Unless secrets is true, the file is
+// only checked to exist and the command to be found, and no password is
+// returned for them.
+func loadPassword(section *ini.Section, secrets bool) (string, error) {
+	var sources []string
+
+	for _, key := range []string{"password", "password_file", "password_command"} {
+		if section.HasKey(key) && section.Key(key).String() != "" {
+			sources = append(sources, key)
+		}
+	}
+
+	switch {
+	case len(sources) == 0:
+		return "", errors.New("password cannot be empty: set password, password_file or password_command in the provider section, or DYNHOST_PASSWORD")
+	case len(sources) > 1:
+		return "", fmt.Errorf("only one of %s can be set", strings.Join(sources, " and "))
+	}
+
+	var password string
+
+	switch sources[0] {
+	case "password":
+		return section.Key("password").String(), nil
+	case "password_file":
+		path := section.Key("password_file").String()
+
+		if !secrets {
+			if _, err := os.Stat(path); err != nil {
+				return "", fmt.Errorf("could not read password_file: %v", err)
+			}
+
+			return "", nil
+		}
+
+		b, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", fmt.Errorf("could not read password_file: %v", err)
+		}
+
+		if password = strings.TrimSpace(string(b)); password == "" {
+			return "", fmt.Errorf("password_file %s is empty", path)
+		}
+	case "password_command":
+		timeout, err := durationKey(section, "password_command_timeout", 10*time.Second)
+		if err != nil {
+			return "", err
+		}
+
+		args := strings.Fields(section.Key("password_command").String())
+
+		if !secrets {
+			if _, err := exec.LookPath(args[0]); err != nil {
+				return "", fmt.Errorf("password_command: %v", err)
+			}
+
+			return "", nil
+		}
+
+		if password, err = commandOutput(args, timeout); err != nil {
+			return "", fmt.Errorf("password_command: %v", err)
+		}
+
+		if password = strings.TrimSpace(password); password == "" {
+			return "", errors.New("password_command printed nothing")
+		}
+	}
+
+	return password, nil
+}
+
+// selectAccount drops all the accounts but the one read from the section
+// called name.
+func (c *Config) selectAccount(name string) error {
+	for _, account := range c.Accounts {
+		if account.Name == name {
+			c.Accounts = []*Account{account}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("no [%s] section", name)
+}
+
+// dedupHostnames drops the hostnames that an earlier section, or an earlier
+// key of the same section, already updates through the same endpoint with
+// the same credentials: updating them twice per cycle would only risk being
+// blocked for abuse.
+func (c *Config) dedupHostnames() {
+	type target struct {
+		endpoint, username, password, hostname string
+	}
+
+	seen := make(map[target]*Account)
+
+	for _, account := range c.Accounts {
+		hostnames := account.Hostnames[:0]
+
+		for _, hostname := range account.Hostnames {
+			t := target{
+				endpoint: account.Endpoint,
+				username: account.Username,
+				password: account.Password,
+				hostname: strings.ToLower(strings.TrimSuffix(hostname, ".")),
+			}
+
+			if first, ok := seen[t]; ok {
+				warnf("Merging the duplicate %s of [%s]: [%s] already updates it with the same endpoint and credentials", hostname, account.Name, first.Name)
+				continue
+			}
+
+			seen[t] = account
+			hostnames = append(hostnames, hostname)
+		}
+
+		account.Hostnames = hostnames
+	}
+}
+
+// hostnameTimeouts reads the hostname_timeout key of section, a
+// comma-separated list of hostname:duration pairs overriding the timeout of
+// the updates of some of the hostnames of the section.
+func hostnameTimeouts(section *ini.Section, hostnames []string) (map[string]time.Duration, error) {
+	if !section.HasKey("hostname_timeout") {
+		return nil, nil
+	}
+
+	timeouts := make(map[string]time.Duration)
+
+	for _, pair := range section.Key("hostname_timeout").Strings(",") {
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid hostname_timeout %q: expected hostname:duration", pair)
+		}
+
+		hostname := pair[:i]
+
+		d, err := time.ParseDuration(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid hostname_timeout %q: %v", pair, err)
+		}
+
+		known := false
+		for _, h := range hostnames {
+			known = known || h == hostname
+		}
+
+		if !known {
+			return nil, fmt.Errorf("invalid hostname_timeout %q: %s is not a hostname of the section", pair, hostname)
+		}
+
+		timeouts[hostname] = d
+	}
+
+	return timeouts, nil
+}
+
+// updateTimeout returns the timeout of the updates of hostname: the one set
+// for the hostname, else for the account, else def.
+func (a *Account) updateTimeout(hostname string, def time.Duration) time.Duration {
+	if d, ok := a.HostnameTimeouts[hostname]; ok {
+		return d
+	}
+
+	if a.HTTPTimeout > 0 {
+		return a.HTTPTimeout
+	}
+
+	return def
+}
+
+// verifyTXTNames reads the verify_txt key of section: a comma-separated list
+// of hostname:name pairs naming the TXT record holding the current value of
+// some of the hostnames of the section, or a single name if the section has a
+// single hostname.
+func verifyTXTNames(section *ini.Section, hostnames []string) (map[string]string, error) {
+	if !section.HasKey("verify_txt") {
+		return nil, nil
+	}
+
+	value := section.Key("verify_txt").String()
+	if value == "" {
+		return nil, errors.New("verify_txt cannot be empty")
+	}
+
+	if !strings.Contains(value, ":") {
+		if len(hostnames) != 1 {
+			return nil, fmt.Errorf("invalid verify_txt %q: expected hostname:name pairs, as the section has several hostnames", value)
+		}
+
+		return map[string]string{hostnames[0]: value}, nil
+	}
+
+	names := make(map[string]string)
+
+	for _, pair := range section.Key("verify_txt").Strings(",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 || parts[1] == "" {
+			return nil, fmt.Errorf("invalid verify_txt %q: expected hostname:name", pair)
+		}
+
+		known := false
+		for _, h := range hostnames {
+			known = known || h == parts[0]
+		}
+
+		if !known {
+			return nil, fmt.Errorf("invalid verify_txt %q: %s is not a hostname of the section", pair, parts[0])
+		}
+
+		names[parts[0]] = parts[1]
+	}
+
+	return names, nil
+}
+
+// txtName returns the name of the TXT record holding the current value of
+// hostname, or an empty string if its A/AAAA records hold it.
+func (c *Config) txtName(hostname string) string {
+	for _, account := range c.Accounts {
+		if name, ok := account.VerifyTXT[hostname]; ok {
+			return name
+		}
+	}
+
+	return c.VerifyTXT
+}
+
+// paramNames reads the param_names key of section, a comma-separated list of
+// protocol:name pairs renaming the parameters of the updates. An empty name
+// drops the parameter.
+func paramNames(section *ini.Section) (map[string]string, error) {
+	if !section.HasKey("param_names") {
+		return nil, nil
+	}
+
+	names := make(map[string]string)
+
+	for _, pair := range section.Key("param_names").Strings(",") {
+		parts := strings.SplitN(pair, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid param_names %q: expected protocol:name", pair)
+		}
+
+		known := false
+		for _, p := range dynhost.Parameters {
+			known = known || p == parts[0]
+		}
+
+		if !known {
+			return nil, fmt.Errorf("invalid param_names %q: unknown parameter %q (expected one of %s)", pair, parts[0], strings.Join(dynhost.Parameters, ", "))
+		}
+
+		names[parts[0]] = strings.TrimSpace(parts[1])
+	}
+
+	return names, nil
+}
+
+// successResponseKey reads the success_response key of section: a regular
+// expression between slashes, such as /^OK$/, or a prefix of the successful
+// responses otherwise. It returns nil if the key is not set.
+func successResponseKey(section *ini.Section) (*regexp.Regexp, error) {
+	if !section.HasKey("success_response") {
+		return nil, nil
+	}
+
+	value := section.Key("success_response").String()
+	if value == "" {
+		return nil, errors.New("success_response cannot be empty")
+	}
+
+	if len(value) < 2 || !strings.HasPrefix(value, "/") || !strings.HasSuffix(value, "/") {
+		return regexp.MustCompile("^" + regexp.QuoteMeta(value)), nil
+	}
+
+	re, err := regexp.Compile(value[1 : len(value)-1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid success_response %s: %v", value, err)
+	}
+
+	return re, nil
+}
+
+// loadSMTP reads the settings of the email notifications from section.
+func loadSMTP(section *ini.Section) (SMTPConfig, error) {
+	smtp := SMTPConfig{
+		Host:     section.Key("smtp_host").String(),
+		User:     section.Key("smtp_user").String(),
+		Password: section.Key("smtp_pass").String(),
+		From:     section.Key("smtp_from").String(),
+		To:       section.Key("notify_email").Strings(","),
+	}
+
+	if smtp.Host == "" {
+		return smtp, nil
+	}
+
+	var err error
+
+	if smtp.Port, err = intKey(section, "smtp_port", 587); err != nil {
+		return smtp, err
+	}
+
+	if len(smtp.To) == 0 {
+		return smtp, errors.New("notify_email is required to send emails")
+	}
+
+	if smtp.From == "" {
+		smtp.From = smtp.User
+	}
+
+	if smtp.From == "" {
+		return smtp, errors.New("smtp_from is required when smtp_user is not set")
+	}
+
+	switch notifyOn := section.Key("notify_on").String(); notifyOn {
+	case "", "failure":
+		smtp.NotifyFailures = true
+	case "change":
+		smtp.NotifyChanges = true
+	case "both":
+		smtp.NotifyChanges = true
+		smtp.NotifyFailures = true
+	default:
+		return smtp, fmt.Errorf("invalid notify_on %q (expected failure, change or both)", notifyOn)
+	}
+
+	return smtp, nil
+}
+
+// parseProtocol maps the protocol configuration value to the list of address
+// families to keep up-to-date.
+func parseProtocol(protocol string) ([]dynhost.Family, error) {
+	switch protocol {
+	case "", "ipv4":
+		return []dynhost.Family{dynhost.IPv4}, nil
+	case "ipv6":
+		return []dynhost.Family{dynhost.IPv6}, nil
+	case "dual":
+		return []dynhost.Family{dynhost.IPv4, dynhost.IPv6}, nil
+	}
+
+	return nil, fmt.Errorf("invalid protocol %q (expected ipv4, ipv6 or dual)", protocol)
+}
+
+// durationKey parses the duration stored under name in section, or returns
+// def if the key is absent.
+func durationKey(section *ini.Section, name string, def time.Duration) (time.Duration, error) {
+	if !section.HasKey(name) {
+		return def, nil
+	}
+
+	d, err := section.Key(name).Duration()
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+
+	return d, nil
+}
+
+// httpURLKey returns the http or https URL stored under name in section, or
+// an empty string if the key is absent or empty.
+func httpURLKey(section *ini.Section, name string) (string, error) {
+	if !section.HasKey(name) {
+		return "", nil
+	}
+
+	s := section.Key(name).String()
+	if s == "" {
+		return "", nil
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %v", name, err)
+	}
+
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid %s %q: expected an http or https URL", name, s)
+	}
+
+	return s, nil
+}
+
+// intKey parses the integer stored under name in section, or returns def if
+// the key is absent.
+func intKey(section *ini.Section, name string, def int) (int, error) {
+	if !section.HasKey(name) {
+		return def, nil
+	}
+
+	i, err := section.Key(name).Int()
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+
+	return i, nil
+}
+
+// parseSourceAddresses parses the source_address key: one address of each
+// family of families, all assigned to a local interface.
+func parseSourceAddresses(value string, families []dynhost.Family) (map[dynhost.Family]net.IP, error) {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the local addresses to check source_address: %v", err)
+	}
+
+	sources := make(map[dynhost.Family]net.IP)
+
+	for _, source := range strings.Split(value, ",") {
+		source = strings.TrimSpace(source)
+
+		ip := net.ParseIP(source)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid source_address %q: expected an IP address", source)
+		}
+
+		family := dynhost.IPv6
+		if dynhost.IPv4.Matches(ip) {
+			family = dynhost.IPv4
+		}
+
+		detected := false
+		for _, f := range families {
+			detected = detected || f == family
+		}
+
+		if !detected {
+			return nil, fmt.Errorf("source_address %s cannot be used: the public %s address is not detected", ip, family)
+		}
+
+		if other, ok := sources[family]; ok {
+			return nil, fmt.Errorf("source_address has two %s addresses, %s and %s: expected one per family", family, other, ip)
+		}
+
+		if !assigned(addrs, ip) {
+			return nil, fmt.Errorf("source_address %s is not assigned to any local interface", ip)
+		}
+
+		sources[family] = ip
+	}
+
+	for _, family := range families {
+		if sources[family] == nil {
+			return nil, fmt.Errorf("source_address has no %s address: expected one for each detected family", family)
+		}
+	}
+
+	return sources, nil
+}
+
+// assigned returns whether ip is one of addrs.
+func assigned(addrs []net.Addr, ip net.IP) bool {
+	for _, a := range addrs {
+		if n, ok := a.(*net.IPNet); ok && n.IP.Equal(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// sizeKey returns the size in bytes set by the key called name, or def if it
+// is missing. The value may have a K, M or G suffix, for powers of 1024.
+func sizeKey(section *ini.Section, name string, def int64) (int64, error) {
+	if !section.HasKey(name) {
+		return def, nil
+	}
+
+	value := strings.ToUpper(strings.TrimSpace(section.Key(name).String()))
+	value = strings.TrimSuffix(value, "B")
+
+	unit := int64(1)
+
+	switch {
+	case strings.HasSuffix(value, "K"):
+		unit = 1 << 10
+	case strings.HasSuffix(value, "M"):
+		unit = 1 << 20
+	case strings.HasSuffix(value, "G"):
+		unit = 1 << 30
+	}
+
+	if unit > 1 {
+		value = value[:len(value)-1]
+	}
+
+	n, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q: expected a size such as 10M", name, section.Key(name).String())
+	}
+
+	return n * unit, nil
+}
+
+// boolKey parses the boolean stored under name in section, or returns def if
+// the key is absent.
+func boolKey(section *ini.Section, name string, def bool) (bool, error) {
+	if !section.HasKey(name) {
+		return def, nil
+	}
+
+	b, err := section.Key(name).Bool()
+	if err != nil {
+		return false, fmt.Errorf("invalid %s: %v", name, err)
+	}
+
+	return b, nil
+}
+
+// fractionKey parses the fraction stored under name in section, either as a
+// percentage such as "20%" or as a number such as "0.2". The fraction must be
+// within [0, 1), and defaults to 0 if the key is absent.
+func fractionKey(section *ini.Section, name string) (float64, error) {
+	if !section.HasKey(name) {
+		return 0, nil
+	}
+
+	value := section.Key(name).String()
+	percent := strings.HasSuffix(value, "%")
+
+	f, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(value, "%")), 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %v", name, err)
+	}
+
+	if percent {
+		f /= 100
+	}
+
+	if f < 0 || f >= 1 {
+		return 0, fmt.Errorf("invalid %s %q: must be within [0%%, 100%%)", name, value)
+	}
+
+	return f, nil
+}
+
+// loadCABundle returns the roots of the PEM file at path, added to those of
+// the system in the append mode, or replacing them in the replace mode.
+func loadCABundle(path, mode string) (*x509.CertPool, error) {
+	var pool *x509.CertPool
+
+	switch mode {
+	case caBundleAppend:
+		var err error
+
+		if pool, err = x509.SystemCertPool(); err != nil {
+			return nil, fmt.Errorf("could not load the system roots to append ca_bundle to: %v", err)
+		}
+	case caBundleReplace:
+		pool = x509.NewCertPool()
+	default:
+		return nil, fmt.Errorf("invalid ca_bundle_mode %q: expected %s or %s", mode, caBundleAppend, caBundleReplace)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not read ca_bundle: %v", err)
+	}
+
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("ca_bundle %s holds no PEM certificate", path)
+	}
+
+	return pool, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(cidrs))
+
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, n)
+	}
+
+	return nets, nil
+}
@@ -0,0 +1,405 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// loadTestConfigError returns the error of loading the configuration body,
+// which must be invalid.
+func loadTestConfigError(t *testing.T, body string) error {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "dynhost.cfg")
+
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := loadConfig(path, "", ""); err != nil {
+		return err
+	}
+
+	t.Fatal("the configuration was loaded")
+
+	return nil
+}
+
+func TestVerifyTXT(t *testing.T) {
+	cfg := loadTestConfig(t, `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com, nas.example.com, www.example.com
+verify_txt = home.example.com:_dynhost.home.example.com, nas.example.com:_dynhost.nas.example.com
+
+[ovh:office]
+username = user2
+password = secret
+hostname = office.example.com
+verify_txt = _dynhost.office.example.com
+`)
+
+	expected := map[string]string{
+		"home.example.com":   "_dynhost.home.example.com",
+		"nas.example.com":    "_dynhost.nas.example.com",
+		"www.example.com":    "",
+		"office.example.com": "_dynhost.office.example.com",
+	}
+
+	for hostname, name := range expected {
+		if got := cfg.txtName(hostname); got != name {
+			t.Errorf("the TXT record of %s is %q, expected %q", hostname, got, name)
+		}
+	}
+}
+
+func TestVerifyTXTGlobal(t *testing.T) {
+	cfg := loadTestConfig(t, `
+verify_txt = _dynhost.example.com
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+	if got := cfg.txtName("home.example.com"); got != "_dynhost.example.com" {
+		t.Fatalf("the TXT record of home.example.com is %q, expected _dynhost.example.com", got)
+	}
+}
+
+func TestVerifyTXTErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{
+			name: "global with several hostnames",
+			body: `
+verify_txt = _dynhost.example.com
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com, nas.example.com
+`,
+			err: "verify_txt cannot be set in the global section with several hostnames",
+		},
+		{
+			name: "single name with several hostnames",
+			body: `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com, nas.example.com
+verify_txt = _dynhost.example.com
+`,
+			err: "expected hostname:name pairs",
+		},
+		{
+			name: "unknown hostname",
+			body: `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+verify_txt = nas.example.com:_dynhost.nas.example.com
+`,
+			err: "nas.example.com is not a hostname of the section",
+		},
+		{
+			name: "empty name",
+			body: `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+verify_txt = home.example.com:
+`,
+			err: "expected hostname:name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := loadTestConfigError(t, tt.body); !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestPasswordFile(t *testing.T) {
+	dir := t.TempDir()
+
+	present := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(present, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	empty := filepath.Join(dir, "empty")
+	if err := ioutil.WriteFile(empty, []byte(" \n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		keys     string
+		password string
+		err      string
+	}{
+		{name: "present", keys: "password_file = " + present, password: "secret"},
+		{name: "missing", keys: "password_file = " + filepath.Join(dir, "missing"), err: "could not read password_file"},
+		{name: "empty", keys: "password_file = " + empty, err: "password_file " + empty + " is empty"},
+		{name: "with password", keys: "password = secret\npassword_file = " + present, err: "only one of password and password_file can be set"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := `
+[ovh]
+username = user
+hostname = home.example.com
+` + tt.keys + "\n"
+
+			if tt.err != "" {
+				if err := loadTestConfigError(t, body); !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+				}
+
+				return
+			}
+
+			cfg := loadTestConfig(t, body)
+
+			if got := cfg.Accounts[0].Password; got != tt.password {
+				t.Fatalf("got the password %q, expected %q", got, tt.password)
+			}
+		})
+	}
+}
+
+func TestSourceAddresses(t *testing.T) {
+	tests := []struct {
+		name     string
+		protocol string
+		value    string
+		ipv4     string
+		ipv6     string
+		err      string
+	}{
+		{name: "IPv4", protocol: "ipv4", value: "127.0.0.1", ipv4: "127.0.0.1"},
+		{name: "IPv6", protocol: "ipv6", value: "::1", ipv6: "::1"},
+		{name: "dual", protocol: "dual", value: "127.0.0.1, ::1", ipv4: "127.0.0.1", ipv6: "::1"},
+		{name: "dual, IPv6 first", protocol: "dual", value: "::1,127.0.0.1", ipv4: "127.0.0.1", ipv6: "::1"},
+		{name: "dual without IPv6", protocol: "dual", value: "127.0.0.1", err: "source_address has no IPv6 address"},
+		{name: "two IPv4", protocol: "dual", value: "127.0.0.1, 127.0.0.1", err: "source_address has two IPv4 addresses"},
+		{name: "undetected family", protocol: "ipv4", value: "::1", err: "the public IPv6 address is not detected"},
+		{name: "not local", protocol: "ipv4", value: "192.0.2.10", err: "192.0.2.10 is not assigned to any local interface"},
+		{name: "invalid", protocol: "ipv4", value: "localhost", err: `invalid source_address "localhost"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sources, err := parseSourceAddresses(tt.value, mustParseProtocol(t, tt.protocol))
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for family, expected := range map[dynhost.Family]string{dynhost.IPv4: tt.ipv4, dynhost.IPv6: tt.ipv6} {
+				if got := sources[family]; (got == nil) != (expected == "") || (got != nil && !got.Equal(net.ParseIP(expected))) {
+					t.Errorf("the %s source address is %v, expected %q", family, got, expected)
+				}
+			}
+		})
+	}
+}
+
+func mustParseProtocol(t *testing.T, protocol string) []dynhost.Family {
+	t.Helper()
+
+	families, err := parseProtocol(protocol)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return families
+}
+
+func TestUpdateTimeout(t *testing.T) {
+	cfg := loadTestConfig(t, `
+http_timeout = 10s
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com, nas.example.com
+http_timeout = 30s
+hostname_timeout = home.example.com:1m
+
+[ovh:office]
+username = user2
+password = secret
+hostname = office.example.com
+hostname_timeout = office.example.com:5s
+
+[ovh:plain]
+username = user3
+password = secret
+hostname = www.example.com
+`)
+
+	expected := map[string]time.Duration{
+		"home.example.com":   time.Minute,
+		"nas.example.com":    30 * time.Second,
+		"office.example.com": 5 * time.Second,
+		"www.example.com":    10 * time.Second,
+	}
+
+	for _, account := range cfg.Accounts {
+		for _, hostname := range account.Hostnames {
+			if got := account.updateTimeout(hostname, cfg.HTTPTimeout); got != expected[hostname] {
+				t.Errorf("the updates of %s time out after %v, expected %v", hostname, got, expected[hostname])
+			}
+		}
+	}
+}
+
+func TestHostnameTimeoutErrors(t *testing.T) {
+	tests := []struct {
+		value string
+		err   string
+	}{
+		{value: "home.example.com", err: "expected hostname:duration"},
+		{value: "home.example.com:soon", err: `invalid hostname_timeout "home.example.com:soon"`},
+		{value: "nas.example.com:1m", err: "nas.example.com is not a hostname of the section"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			err := loadTestConfigError(t, `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+hostname_timeout = `+tt.value+"\n")
+
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestCredentialsFile(t *testing.T) {
+	dir := t.TempDir()
+
+	password := filepath.Join(dir, "password")
+	if err := ioutil.WriteFile(password, []byte("secret2\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	files := map[string]string{
+		"credentials.cfg": `
+[home]
+username = user
+password = secret
+
+[office]
+username = user2
+password_file = ` + password + "\n",
+		"credentials.json": `{"home": {"username": "user", "password": "secret"}, "office": {"username": "user2", "password_file": "` + password + `"}}`,
+	}
+
+	for name, body := range files {
+		t.Run(name, func(t *testing.T) {
+			creds := filepath.Join(dir, name)
+			if err := ioutil.WriteFile(creds, []byte(body), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			cfg := loadTestConfig(t, `
+credentials_file = `+creds+`
+
+[ovh:home]
+credentials_ref = home
+hostname = home.example.com
+
+[ovh:office]
+credentials_ref = office
+hostname = office.example.com
+
+[ovh:inline]
+username = user3
+password = secret3
+hostname = www.example.com
+`)
+
+			expected := map[string][2]string{
+				"ovh:home":   {"user", "secret"},
+				"ovh:office": {"user2", "secret2"},
+				"ovh:inline": {"user3", "secret3"},
+			}
+
+			for _, account := range cfg.Accounts {
+				if got := [2]string{account.Username, account.Password}; got != expected[account.Name] {
+					t.Errorf("[%s] has the credentials %q, expected %q", account.Name, got, expected[account.Name])
+				}
+			}
+		})
+	}
+}
+
+func TestCredentialsFileErrors(t *testing.T) {
+	dir := t.TempDir()
+
+	creds := filepath.Join(dir, "credentials.cfg")
+	if err := ioutil.WriteFile(creds, []byte("[home]\nusername = user\npassword = secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		global string
+		keys   string
+		err    string
+	}{
+		{name: "missing ref", global: "credentials_file = " + creds, keys: "credentials_ref = office", err: `credentials_ref "office": no such section in credentials_file`},
+		{name: "default section", global: "credentials_file = " + creds, keys: "credentials_ref = DEFAULT", err: `credentials_ref "DEFAULT": no such section in credentials_file`},
+		{name: "empty ref", global: "credentials_file = " + creds, keys: "credentials_ref =", err: "credentials_ref cannot be empty"},
+		{name: "without file", keys: "credentials_ref = home", err: "credentials_ref requires credentials_file"},
+		{name: "with a username", global: "credentials_file = " + creds, keys: "credentials_ref = home\nusername = user", err: "credentials_ref cannot be combined with username"},
+		{name: "missing file", global: "credentials_file = " + filepath.Join(dir, "missing"), keys: "credentials_ref = home", err: "could not read credentials_file"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := loadTestConfigError(t, tt.global+`
+
+[ovh]
+hostname = home.example.com
+`+tt.keys+"\n")
+
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
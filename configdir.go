@@ -0,0 +1,120 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+
+	"gopkg.in/ini.v1"
+)
+
+// fileError is the failure to read one of the files of the configuration
+// directory.
+type fileError struct {
+	path string
+	err  error
+}
+
+func (e *fileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.path, e.err)
+}
+
+func (e *fileError) Unwrap() error {
+	return e.err
+}
+
+// mergeConfigDir adds the sections and global keys of every *.cfg file of dir
+// to file, in the order of their names. A section or a global key defined by
+// several files is an error, rather than being silently overridden.
+func mergeConfigDir(file *ini.File, dir string) error {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.cfg"))
+	if err != nil {
+		return err
+	}
+
+	if len(paths) == 0 {
+		return fmt.Errorf("no *.cfg file in %s", dir)
+	}
+
+	sort.Strings(paths)
+
+	// Where each section and global key comes from, for the errors.
+	var (
+		sections = make(map[string]string)
+		keys     = make(map[string]string)
+	)
+
+	for _, section := range file.Sections() {
+		if section.Name() != ini.DEFAULT_SECTION {
+			sections[section.Name()] = "the configuration file"
+		}
+	}
+
+	for _, key := range file.Section("").Keys() {
+		keys[key.Name()] = "the configuration file"
+	}
+
+	for _, path := range paths {
+		fragment, err := loadFile(path, formatINI)
+		if err != nil {
+			return &fileError{path, err}
+		}
+
+		for _, section := range fragment.Sections() {
+			name := section.Name()
+
+			if name == ini.DEFAULT_SECTION {
+				for _, key := range section.Keys() {
+					if origin, ok := keys[key.Name()]; ok {
+						return &fileError{path, fmt.Errorf("the global key %s is already set in %s", key.Name(), origin)}
+					}
+
+					keys[key.Name()] = path
+
+					if err := copyKey(file.Section(""), key); err != nil {
+						return &fileError{path, err}
+					}
+				}
+
+				continue
+			}
+
+			if origin, ok := sections[name]; ok {
+				return &fileError{path, fmt.Errorf("the [%s] section is already defined in %s", name, origin)}
+			}
+
+			sections[name] = path
+
+			dst, err := file.NewSection(name)
+			if err != nil {
+				return &fileError{path, err}
+			}
+
+			for _, key := range section.Keys() {
+				if err := copyKey(dst, key); err != nil {
+					return &fileError{path, err}
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// copyKey adds key to section, along with its repeated values.
+func copyKey(section *ini.Section, key *ini.Key) error {
+	values := key.ValueWithShadows()
+
+	dst, err := section.NewKey(key.Name(), values[0])
+	if err != nil {
+		return err
+	}
+
+	for _, v := range values[1:] {
+		if err := dst.AddShadow(v); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
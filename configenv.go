@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/ini.v1"
+)
+
+// envProvider selects the provider, as the provider key does.
+const envProvider = "DYNHOST_PROVIDER"
+
+// accountEnv maps the environment variables overriding the keys of the
+// provider section to these keys.
+var accountEnv = []struct {
+	name string
+	key  string
+}{
+	{"DYNHOST_API_ENDPOINT", "api_endpoint"},
+	{"DYNHOST_USERNAME", "username"},
+	{"DYNHOST_PASSWORD", "password"},
+	{"DYNHOST_HOSTNAME", "hostname"},
+}
+
+// accountEnvSet reports whether any of the variables of accountEnv is set.
+func accountEnvSet() bool {
+	for _, e := range accountEnv {
+		if os.Getenv(e.name) != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// applyEnv overrides the keys of file with the environment variables.
+// DYNHOST_PROVIDER replaces the provider key, and the variables of accountEnv
+// replace the keys of the provider section. The section is created, named
+// after the provider (ovh by default), if the file has none; it must be the
+// only one otherwise.
+func applyEnv(file *ini.File) error {
+	global := file.Section("")
+
+	if provider := os.Getenv(envProvider); provider != "" {
+		global.Key("provider").SetValue(provider)
+	}
+
+	var names []string
+
+	for _, e := range accountEnv {
+		if os.Getenv(e.name) != "" {
+			names = append(names, e.name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil
+	}
+
+	provider := ""
+	if global.HasKey("provider") {
+		provider = global.Key("provider").String()
+	}
+
+	var sections []*ini.Section
+
+	for _, section := range file.Sections() {
+		name := section.Name()
+
+		if name == ini.DEFAULT_SECTION {
+			continue
+		}
+
+		if provider == "" || strings.SplitN(name, ":", 2)[0] == provider {
+			sections = append(sections, section)
+		}
+	}
+
+	switch len(sections) {
+	case 0:
+		if provider == "" {
+			provider = "ovh"
+		}
+
+		section, err := file.NewSection(provider)
+		if err != nil {
+			return err
+		}
+
+		sections = append(sections, section)
+	case 1:
+	default:
+		return fmt.Errorf("%s cannot be applied to several provider sections", strings.Join(names, ", "))
+	}
+
+	section := sections[0]
+
+	for _, e := range accountEnv {
+		if value := os.Getenv(e.name); value != "" {
+			section.DeleteKey(e.key)
+
+			// The password also replaces the other sources of the
+			// password.
+			if e.key == "password" {
+				section.DeleteKey("password_file")
+				section.DeleteKey("password_command")
+			}
+
+			if _, err := section.NewKey(e.key, value); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvOverridesFile(t *testing.T) {
+	t.Setenv("DYNHOST_PROVIDER", "dyndns")
+	t.Setenv("DYNHOST_USERNAME", "env-user")
+	t.Setenv("DYNHOST_PASSWORD", "env-secret")
+	t.Setenv("DYNHOST_HOSTNAME", "env.example.com")
+
+	cfg := loadTestConfig(t, `
+provider = ovh
+
+[dyndns]
+username = file-user
+password_file = /nonexistent/password
+hostname = file.example.com
+`)
+
+	if len(cfg.Accounts) != 1 {
+		t.Fatalf("%d account(s), expected 1", len(cfg.Accounts))
+	}
+
+	a := cfg.Accounts[0]
+
+	if a.Provider != "dyndns" || a.Username != "env-user" || a.Password != "env-secret" {
+		t.Fatalf("got the provider %q, username %q and password %q from the environment", a.Provider, a.Username, a.Password)
+	}
+
+	if len(a.Hostnames) != 1 || a.Hostnames[0] != "env.example.com" {
+		t.Fatalf("got the hostnames %v, expected env.example.com", a.Hostnames)
+	}
+}
+
+func TestEnvWithoutFile(t *testing.T) {
+	t.Setenv("DYNHOST_USERNAME", "env-user")
+	t.Setenv("DYNHOST_PASSWORD", "env-secret")
+	t.Setenv("DYNHOST_HOSTNAME", "env.example.com")
+
+	cfg, err := loadConfig(filepath.Join(t.TempDir(), "missing.cfg"), "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(cfg.Accounts) != 1 || cfg.Accounts[0].Provider != "ovh" || cfg.Accounts[0].Username != "env-user" {
+		t.Fatalf("unexpected accounts %+v", cfg.Accounts)
+	}
+}
+
+func TestEnvMissingEverywhere(t *testing.T) {
+	tests := []struct {
+		name string
+		env  map[string]string
+		err  string
+	}{
+		{
+			name: "username",
+			env:  map[string]string{"DYNHOST_PASSWORD": "secret", "DYNHOST_HOSTNAME": "home.example.com"},
+			err:  "username cannot be empty: set it in the provider section or in DYNHOST_USERNAME",
+		},
+		{
+			name: "password",
+			env:  map[string]string{"DYNHOST_USERNAME": "user", "DYNHOST_HOSTNAME": "home.example.com"},
+			err:  "password cannot be empty: set password, password_file or password_command in the provider section, or DYNHOST_PASSWORD",
+		},
+		{
+			name: "hostname",
+			env:  map[string]string{"DYNHOST_USERNAME": "user", "DYNHOST_PASSWORD": "secret"},
+			err:  "hostname cannot be empty: set it in the provider section or in DYNHOST_HOSTNAME",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for name, value := range tt.env {
+				t.Setenv(name, value)
+			}
+
+			_, err := loadConfig(filepath.Join(t.TempDir(), "missing.cfg"), "", "")
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/ini.v1"
+	"gopkg.in/yaml.v3"
+)
+
+// Formats of the configuration file.
+const (
+	formatINI  = "ini"
+	formatTOML = "toml"
+	formatYAML = "yaml"
+)
+
+// spaceSeparatedKeys are the keys whose lists are joined with spaces rather
+// than commas when read from a TOML or YAML file.
+var spaceSeparatedKeys = map[string]bool{
+	"post_update_command": true,
+}
+
+// configFormat returns the format of the configuration file at path, from its
+// extension. Files with an unknown extension, such as .cfg, and the standard
+// input are INI files.
+func configFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return formatTOML
+	case ".yaml", ".yml", ".json":
+		// JSON documents are YAML documents.
+		return formatYAML
+	}
+
+	return formatINI
+}
+
+// stdinConfig caches the configuration read from the standard input, which
+// can only be read once but is loaded again on SIGHUP.
+var stdinConfig []byte
+
+// readConfigSource returns the content of the configuration file at path, or
+// of the standard input if path is "-".
+func readConfigSource(path string) ([]byte, error) {
+	if path != "-" {
+		return ioutil.ReadFile(path)
+	}
+
+	if stdinConfig == nil {
+		b, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return nil, fmt.Errorf("could not read the standard input: %v", err)
+		}
+
+		stdinConfig = b
+	}
+
+	return stdinConfig, nil
+}
+
+// loadFile reads the configuration file at path, or the standard input if
+// path is "-", in the given format, or in the format matching its extension if
+// empty. TOML and YAML files are
+// translated to the sections and keys of an INI file, so that they are all
+// validated the same way:
+//
+//   - top-level keys are global keys;
+//   - tables are provider sections, and tables of tables are labelled
+//     provider sections, so that ovh.home is the [ovh:home] section;
+//   - lists are joined with commas.
+func loadFile(path, format string) (*ini.File, error) {
+	if format == "" {
+		format = configFormat(path)
+	}
+
+	b, err := readConfigSource(path)
+	if err != nil {
+		return nil, err
+	}
+
+	if format == formatINI {
+		return ini.LoadSources(ini.LoadOptions{AllowShadows: true}, b)
+	}
+
+	var doc map[string]interface{}
+
+	switch format {
+	case formatTOML:
+		err = toml.Unmarshal(b, &doc)
+	case formatYAML:
+		err = yaml.Unmarshal(b, &doc)
+	default:
+		return nil, fmt.Errorf("unsupported configuration format %q (expected ini, toml or yaml)", format)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("could not decode the %s file: %v", format, err)
+	}
+
+	return iniFromMap(doc)
+}
+
+// iniFromMap translates a decoded TOML or YAML document to an INI file.
+// Sections are created in the order of their names.
+func iniFromMap(doc map[string]interface{}) (*ini.File, error) {
+	file, err := ini.LoadSources(ini.LoadOptions{AllowShadows: true}, []byte{})
+	if err != nil {
+		return nil, err
+	}
+
+	if err := setKeys(file.Section(""), doc, true); err != nil {
+		return nil, err
+	}
+
+	for _, name := range sortedKeys(doc) {
+		table, ok := toTable(doc[name])
+		if !ok {
+			continue
+		}
+
+		if !allTables(table) {
+			if err := addSection(file, name, table); err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		for _, label := range sortedKeys(table) {
+			sub, _ := toTable(table[label])
+
+			if err := addSection(file, name+":"+label, sub); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return file, nil
+}
+
+// addSection adds the section called name holding the keys of table.
+func addSection(file *ini.File, name string, table map[string]interface{}) error {
+	section, err := file.NewSection(name)
+	if err != nil {
+		return err
+	}
+
+	if err := setKeys(section, table, false); err != nil {
+		return fmt.Errorf("[%s]: %v", name, err)
+	}
+
+	return nil
+}
+
+// setKeys sets the keys of section from the values of table. Tables are
+// skipped if allowTables is true, and rejected otherwise.
+func setKeys(section *ini.Section, table map[string]interface{}, allowTables bool) error {
+	for _, name := range sortedKeys(table) {
+		if _, ok := toTable(table[name]); ok {
+			if allowTables {
+				continue
+			}
+
+			return fmt.Errorf("%s: unexpected table", name)
+		}
+
+		value, err := iniValue(name, table[name])
+		if err != nil {
+			return err
+		}
+
+		if _, err := section.NewKey(name, value); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// iniValue returns the INI representation of the value of the key name.
+func iniValue(name string, v interface{}) (string, error) {
+	list, ok := v.([]interface{})
+	if !ok {
+		if v == nil {
+			return "", nil
+		}
+
+		return fmt.Sprint(v), nil
+	}
+
+	sep := ","
+	if spaceSeparatedKeys[name] {
+		sep = " "
+	}
+
+	items := make([]string, 0, len(list))
+
+	for _, item := range list {
+		switch item.(type) {
+		case []interface{}, map[string]interface{}, map[interface{}]interface{}:
+			return "", fmt.Errorf("%s: unexpected nested list or table", name)
+		}
+
+		items = append(items, fmt.Sprint(item))
+	}
+
+	return strings.Join(items, sep), nil
+}
+
+// toTable returns v as a table, if it is one.
+func toTable(v interface{}) (map[string]interface{}, bool) {
+	switch t := v.(type) {
+	case map[string]interface{}:
+		return t, true
+	case map[interface{}]interface{}:
+		table := make(map[string]interface{}, len(t))
+		for k, v := range t {
+			table[fmt.Sprint(k)] = v
+		}
+
+		return table, true
+	}
+
+	return nil, false
+}
+
+// allTables reports whether table is not empty and only holds tables, as the
+// table of a provider holding labelled accounts does.
+func allTables(table map[string]interface{}) bool {
+	if len(table) == 0 {
+		return false
+	}
+
+	for _, v := range table {
+		if _, ok := toTable(v); !ok {
+			return false
+		}
+	}
+
+	return true
+}
+
+func sortedKeys(table map[string]interface{}) []string {
+	keys := make([]string, 0, len(table))
+	for k := range table {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	return keys
+}
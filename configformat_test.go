@@ -0,0 +1,90 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+// withStdin makes body the standard input until the end of the test.
+func withStdin(t *testing.T, body string) {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := w.WriteString(body); err != nil {
+		t.Fatal(err)
+	}
+
+	w.Close()
+
+	stdin := os.Stdin
+	os.Stdin = r
+	stdinConfig = nil
+
+	t.Cleanup(func() {
+		os.Stdin = stdin
+		stdinConfig = nil
+		r.Close()
+	})
+}
+
+func TestConfigStdin(t *testing.T) {
+	tests := []struct {
+		name   string
+		format string
+		body   string
+	}{
+		{
+			name: "ini",
+			body: "[ovh]\nusername = user\npassword = secret\nhostname = home.example.com\n",
+		},
+		{
+			name:   "yaml",
+			format: "yaml",
+			body:   "ovh:\n  username: user\n  password: secret\n  hostname: home.example.com\n",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withStdin(t, tt.body)
+
+			// The configuration is loaded again on SIGHUP, once the
+			// standard input was read.
+			for i := 0; i < 2; i++ {
+				cfg, err := loadConfig("-", tt.format, "")
+				if err != nil {
+					t.Fatalf("load %d: %v", i+1, err)
+				}
+
+				if len(cfg.Accounts) != 1 || cfg.Accounts[0].Username != "user" || cfg.Accounts[0].Hostnames[0] != "home.example.com" {
+					t.Fatalf("load %d: unexpected accounts %+v", i+1, cfg.Accounts)
+				}
+			}
+		})
+	}
+}
+
+func TestConfigStdinFlag(t *testing.T) {
+	tests := []struct {
+		name   string
+		body   string
+		status int
+	}{
+		{name: "valid", body: "[ovh]\nusername = user\npassword = secret\nhostname = home.example.com\n", status: exitOK},
+		{name: "invalid", body: "protocol = ipx\n\n[ovh]\nusername = user\npassword = secret\nhostname = home.example.com\n", status: exitConfig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withStdin(t, tt.body)
+
+			if status := runArgs(t, "-config", "-", "-check-config"); status != tt.status {
+				t.Fatalf("exit status %d, expected %d", status, tt.status)
+			}
+		})
+	}
+}
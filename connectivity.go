@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// checkConnectivity checks, without updating any record or sending any
+// credentials, that the address providers answer, that the update endpoints
+// respond and that the records can be read, and writes the outcome and the
+// duration of each check to w. It returns whether they all passed.
+func (s *syncer) checkConnectivity(ctx context.Context, w io.Writer) bool {
+	passed := true
+
+	check := func(what string, timeout time.Duration, f func(ctx context.Context) (string, error)) {
+		checkCtx := ctx
+
+		if timeout > 0 {
+			var cancel context.CancelFunc
+
+			checkCtx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+
+		start := time.Now()
+		detail, err := f(checkCtx)
+		elapsed := time.Since(start).Round(10 * time.Microsecond)
+
+		if err != nil {
+			passed = false
+			fmt.Fprintf(w, "FAIL  %9v  %s: %v\n", elapsed, what, err)
+			return
+		}
+
+		fmt.Fprintf(w, "PASS  %9v  %s: %s\n", elapsed, what, detail)
+	}
+
+	if d, ok := s.detector.(interface {
+		Providers(family dynhost.Family) []dynhost.Provider
+	}); ok {
+		for _, family := range s.cfg.Families {
+			for _, p := range d.Providers(family) {
+				check(fmt.Sprintf("%s provider %v", family, p), s.cfg.ProviderTimeout, func(ctx context.Context) (string, error) {
+					ip, err := p.PublicIP(ctx)
+					if err != nil {
+						return "", err
+					}
+
+					return ip.String(), nil
+				})
+			}
+		}
+	}
+
+	probed := make(map[string]bool)
+
+	for _, account := range s.cfg.Accounts {
+		if probed[account.Endpoint] {
+			continue
+		}
+
+		probed[account.Endpoint] = true
+
+		check(fmt.Sprintf("%s endpoint %s", account.Provider, account.Endpoint), s.cfg.HTTPTimeout, func(ctx context.Context) (string, error) {
+			return s.probe(ctx, account.Endpoint)
+		})
+	}
+
+	for _, account := range s.cfg.Accounts {
+		for _, hostname := range account.Hostnames {
+			for _, family := range s.cfg.Families {
+				check("DNS lookup of "+recordName(hostname, family), s.cfg.DNSTimeout, func(ctx context.Context) (string, error) {
+					values, _, err := s.reader.currentValues(ctx, hostname, family)
+					if err != nil {
+						return "", err
+					}
+
+					return describeIPs(values), nil
+				})
+			}
+		}
+	}
+
+	return passed
+}
+
+// probe sends a request without credentials nor parameters to the update
+// endpoint, and returns the status of its response: any response shows that
+// it can be reached, even if it rejects the request.
+func (s *syncer) probe(ctx context.Context, endpoint string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+
+	req.Header.Set("User-Agent", userAgent(s.cfg.UserAgent))
+
+	res, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+
+	return "replied " + res.Status, nil
+}
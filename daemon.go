@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"math/rand"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+// jitter randomizes durations by up to a fraction of their value, in either
+// direction, so that instances started together do not stay in lockstep.
+type jitter struct {
+	fraction float64
+	rand     *rand.Rand
+}
+
+// newJitter returns a jitter of the given fraction, whose sequence of random
+// values is fully determined by seed.
+func newJitter(fraction float64, seed int64) *jitter {
+	return &jitter{
+		fraction: fraction,
+		rand:     rand.New(rand.NewSource(seed)),
+	}
+}
+
+// apply returns a random duration within d ± d*fraction.
+func (j *jitter) apply(d time.Duration) time.Duration {
+	if j.fraction == 0 {
+		return d
+	}
+
+	return d + time.Duration(float64(d)*j.fraction*(2*j.rand.Float64()-1))
+}
+
+// shutdownGrace is how long a cycle cancelled by SIGINT or SIGTERM is given to
+// unwind before the daemon exits regardless.
+const shutdownGrace = 5 * time.Second
+
+// linkSettleDelay is how long the network must remain unchanged, with
+// watch_links, before a synchronization starts, so that a burst of changes
+// triggers a single one.
+const linkSettleDelay = 2 * time.Second
+
+// startupDelay waits for a random duration up to max, seeded by seed. It
+// returns false if the process receives SIGINT or SIGTERM meanwhile.
+func startupDelay(max time.Duration, seed int64) bool {
+	if max <= 0 {
+		return true
+	}
+
+	d := time.Duration(rand.New(rand.NewSource(seed)).Int63n(int64(max)))
+
+	infof("Waiting %v before the first synchronization", d.Round(time.Millisecond))
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case sig := <-stop:
+		infof("Received %v; exiting.", sig)
+		return false
+	}
+}
+
+// runDaemon runs a synchronization cycle at the configured interval,
+// randomized by the jitter, until the process receives SIGINT or SIGTERM. A
+// cycle in progress when the signal arrives is cancelled, and given up to
+// shutdownGrace to return. Cycle failures are logged, and do not stop the
+// daemon.
+//
+// On SIGHUP, the syncer is replaced by a new one from reload, which takes
+// effect from the next cycle. If reload fails, the current syncer is kept.
+//
+// With watch_links, a synchronization also starts once the network changes,
+// without waiting for the interval.
+//
+// Under systemd, READY=1 is sent once the first cycle succeeds, and WATCHDOG=1
+// keepalives are sent if the watchdog is enabled.
+func runDaemon(s *syncer, reload func() (*syncer, error), j *jitter) {
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var keepalive <-chan time.Time
+
+	if wd := watchdogInterval(); wd > 0 {
+		ticker := time.NewTicker(wd / 2)
+		defer ticker.Stop()
+		keepalive = ticker.C
+	}
+
+	var (
+		linkEvents <-chan struct{}
+		stopWatch  = func() {}
+	)
+
+	watch := func(enabled bool) {
+		stopWatch()
+		linkEvents, stopWatch = nil, func() {}
+
+		if !enabled {
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+
+		events, err := watchLinks(ctx)
+		if err != nil {
+			cancel()
+			warnf("Not watching the network changes: %v", err)
+			return
+		}
+
+		linkEvents, stopWatch = events, cancel
+		infof("Watching the network changes")
+	}
+
+	watch(s.cfg.WatchLinks)
+	defer func() { stopWatch() }()
+
+	infof("Running as a daemon; synchronizing every %v", s.cfg.Interval)
+
+	ready := false
+
+	for {
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error, 1)
+
+		go func(s *syncer) {
+			done <- s.syncAll(ctx)
+		}(s)
+
+		var err error
+
+		select {
+		case err = <-done:
+			cancel()
+		case sig := <-stop:
+			infof("Received %v; cancelling the current cycle.", sig)
+			cancel()
+
+			select {
+			case <-done:
+			case <-time.After(shutdownGrace):
+				warnf("The current cycle did not return within %v; exiting anyway.", shutdownGrace)
+			}
+
+			return
+		}
+
+		s.metrics.cycle(err)
+
+		if err != nil {
+			errorf("Cycle failed: %v", err)
+		} else {
+			infof("Cycle succeeded")
+
+			if !ready {
+				notify("READY=1")
+				ready = true
+			}
+		}
+
+		if keepalive != nil {
+			notify("WATCHDOG=1")
+		}
+
+		j.fraction = s.cfg.IntervalJitter
+		next := time.After(j.apply(s.cfg.Interval))
+
+		var settled <-chan time.Time
+
+	wait:
+		for {
+			select {
+			case sig := <-stop:
+				infof("Received %v; exiting.", sig)
+				return
+			case <-hup:
+				newS, err := reload()
+				if err != nil {
+					warnf("Could not reload the configuration: %v; keeping the current one", err)
+					continue
+				}
+
+				if newS.cfg.Interval == 0 {
+					newS.cfg.Interval = s.cfg.Interval
+				}
+
+				newS.metrics = s.metrics
+				newS.debounce = s.debounce
+				newS.serverErrors = s.serverErrors
+
+				if newS.cfg.WatchLinks != s.cfg.WatchLinks {
+					watch(newS.cfg.WatchLinks)
+				}
+
+				s = newS
+				infof("Configuration reloaded")
+			case <-keepalive:
+				notify("WATCHDOG=1")
+			case <-linkEvents:
+				settled = time.After(linkSettleDelay)
+			case <-settled:
+				infof("The network changed; synchronizing now")
+				break wait
+			case <-next:
+				break wait
+			}
+		}
+	}
+}
+
+// notify sends a state to systemd, logging failures.
+func notify(state string) {
+	if err := sdNotify(state); err != nil {
+		warnf("Could not notify systemd: %v", err)
+	}
+}
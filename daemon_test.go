@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestJitterBounds(t *testing.T) {
+	const interval = time.Minute
+
+	for _, fraction := range []float64{0.1, 0.5, 1} {
+		j := newJitter(fraction, 42)
+		again := newJitter(fraction, 42)
+
+		min := interval - time.Duration(float64(interval)*fraction)
+		max := interval + time.Duration(float64(interval)*fraction)
+
+		var shorter, longer bool
+
+		for i := 0; i < 1000; i++ {
+			d := j.apply(interval)
+
+			if d < min || d > max {
+				t.Fatalf("fraction %v: interval of %v, expected between %v and %v", fraction, d, min, max)
+			}
+
+			// The sequence only depends on the seed.
+			if d2 := again.apply(interval); d2 != d {
+				t.Fatalf("fraction %v: intervals %v and %v from the same seed", fraction, d, d2)
+			}
+
+			shorter = shorter || d < interval
+			longer = longer || d > interval
+		}
+
+		if !shorter || !longer {
+			t.Fatalf("fraction %v: the intervals are not spread on both sides of %v", fraction, interval)
+		}
+	}
+}
+
+func TestJitterDisabled(t *testing.T) {
+	j := newJitter(0, 42)
+
+	for i := 0; i < 10; i++ {
+		if d := j.apply(time.Minute); d != time.Minute {
+			t.Fatalf("interval of %v without jitter", d)
+		}
+	}
+}
@@ -0,0 +1,93 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+func TestDaemonReload(t *testing.T) {
+	d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+
+	before := &fakeUpdater{sent: make(chan updateCall, 100)}
+	after := &fakeUpdater{sent: make(chan updateCall, 100)}
+
+	s := newTestSyncer(t, loadTestConfig(t, `
+interval = 50ms
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`), d, &fakeReader{}, before)
+
+	reloaded := make(chan struct{})
+
+	reload := func() (*syncer, error) {
+		defer close(reloaded)
+
+		return newTestSyncer(t, loadTestConfig(t, `
+interval = 50ms
+
+[ovh]
+username = user
+password = secret
+hostname = nas.example.com
+`), d, &fakeReader{}, after), nil
+	}
+
+	done := make(chan struct{})
+
+	go func() {
+		runDaemon(s, reload, newJitter(0, 1))
+		close(done)
+	}()
+
+	defer func() {
+		syscall.Kill(syscall.Getpid(), syscall.SIGTERM)
+		<-done
+	}()
+
+	expect := func(u *fakeUpdater, hostname string) {
+		t.Helper()
+
+		timeout := time.After(5 * time.Second)
+
+		for {
+			select {
+			case call := <-u.sent:
+				if call.hostname == hostname {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("%s was not updated", hostname)
+			}
+		}
+	}
+
+	// The first cycle runs with the initial configuration.
+	expect(before, "home.example.com")
+
+	syscall.Kill(syscall.Getpid(), syscall.SIGHUP)
+
+	select {
+	case <-reloaded:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the configuration was not reloaded")
+	}
+
+	// The next cycles run with the new one.
+	expect(after, "nas.example.com")
+
+	for _, call := range after.updates() {
+		if call.hostname != "nas.example.com" {
+			t.Fatalf("%s was updated after the reload", call.hostname)
+		}
+	}
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// debouncer tracks, by record, the public address waiting to remain stable
+// for the debounce window before it is published, so that an address
+// flapping during a reconnection does not trigger an update at each change.
+type debouncer struct {
+	mu      sync.Mutex
+	pending map[string]*pendingIP
+}
+
+// pendingIP is a public address and the time it was first seen.
+type pendingIP struct {
+	ip    net.IP
+	since time.Time
+}
+
+// wait returns how much longer ip must remain the public address before it is
+// published to the record called name, or 0 if it has been for window.
+func (d *debouncer) wait(name string, ip net.IP, window time.Duration) time.Duration {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.pending == nil {
+		d.pending = make(map[string]*pendingIP)
+	}
+
+	p := d.pending[name]
+	if p == nil || !dynhost.SameIP(p.ip, ip) {
+		p = &pendingIP{ip: ip, since: time.Now()}
+		d.pending[name] = p
+	}
+
+	if left := window - time.Since(p.since); left > 0 {
+		return left
+	}
+
+	return 0
+}
+
+// reset forgets the address pending for the record called name, which holds
+// the public address.
+func (d *debouncer) reset(name string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.pending, name)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// age moves the addresses pending in d back in time by elapsed, as if they
+// had been seen that much earlier.
+func age(d *debouncer, elapsed time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, p := range d.pending {
+		p.since = p.since.Add(-elapsed)
+	}
+}
+
+func TestDebounce(t *testing.T) {
+	published := net.ParseIP("198.51.100.1")
+
+	// cycle is a public address detected during a cycle, and the time
+	// elapsed since the previous one.
+	type cycle struct {
+		ip      string
+		elapsed time.Duration
+	}
+
+	tests := []struct {
+		name    string
+		cycles  []cycle
+		updated string
+	}{
+		{
+			name: "flap",
+			cycles: []cycle{
+				{ip: "203.0.113.7"},
+				{ip: "198.51.100.1", elapsed: time.Minute},
+				{ip: "203.0.113.7", elapsed: time.Minute},
+				{ip: "203.0.113.8", elapsed: time.Minute},
+				{ip: "203.0.113.7", elapsed: time.Minute},
+			},
+		},
+		{
+			name: "stable change",
+			cycles: []cycle{
+				{ip: "203.0.113.7"},
+				{ip: "203.0.113.7", elapsed: time.Minute},
+				{ip: "203.0.113.7", elapsed: time.Minute},
+			},
+			updated: "[203.0.113.7]",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, `
+interval = 1m
+debounce = 2m
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+			d := &fakeDetector{ips: make(map[dynhost.Family]net.IP)}
+			r := &fakeReader{values: map[string][]net.IP{"home.example.com/A": {published}}}
+			u := &fakeUpdater{}
+
+			s := newTestSyncer(t, cfg, d, r, u)
+
+			for i, c := range tt.cycles {
+				age(s.debounce, c.elapsed)
+				d.ips[dynhost.IPv4] = net.ParseIP(c.ip)
+
+				if err := s.syncAll(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+
+				if calls := u.updates(); len(calls) != 0 && i < len(tt.cycles)-1 {
+					t.Fatalf("updated at cycle %d: %v", i+1, calls)
+				}
+			}
+
+			calls := u.updates()
+
+			if tt.updated == "" {
+				if len(calls) != 0 {
+					t.Fatalf("the flapping address was published: %v", calls)
+				}
+
+				return
+			}
+
+			if len(calls) != 1 || fmt.Sprint(calls[0].addresses) != tt.updated {
+				t.Fatalf("unexpected updates %v, expected one to %s", calls, tt.updated)
+			}
+		})
+	}
+}
+
+func TestDebounceOnce(t *testing.T) {
+	// A single run cannot wait for the address to be stable.
+	cfg := loadTestConfig(t, `
+debounce = 2m
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+	d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+	r := &fakeReader{values: map[string][]net.IP{"home.example.com/A": {net.ParseIP("198.51.100.1")}}}
+	u := &fakeUpdater{}
+
+	s := newTestSyncer(t, cfg, d, r, u)
+
+	if err := s.syncAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(u.updates()); n != 1 {
+		t.Fatalf("%d update(s), expected 1", n)
+	}
+}
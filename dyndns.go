@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// providerEndpoints holds the default update endpoints of the supported
+// providers. The generic dyndns2 provider has none, and must be given one.
+var providerEndpoints = map[string]string{
+	"ovh":     dynhost.OVHAPIEndpoint,
+	"dyndns":  "https://members.dyndns.org/nic/update",
+	"noip":    "https://dynupdate.no-ip.com/nic/update",
+	"dyndns2": "",
+}
+
+// updater publishes addresses to DynHost records. An IPv4 and an IPv6
+// address update both records of the hostname in a single request.
+type updater interface {
+	Update(ctx context.Context, hostname string, addresses ...net.IP) (dynhost.Result, error)
+
+	// Request returns the request Update would send, e.g. to show it in dry
+	// runs.
+	Request(ctx context.Context, hostname string, addresses ...net.IP) (*http.Request, error)
+}
+
+func newUpdater(cfg *Config, account *Account, client *http.Client) updater {
+	// The timeout of the updates depends on the account and the hostname:
+	// it is set on the context of each request instead.
+	c := *client
+	c.Timeout = 0
+
+	return &dynhost.Updater{
+		Client:   &c,
+		Provider: account.Provider,
+		Endpoint: account.Endpoint,
+		Username: account.Username,
+		Password: account.Password,
+
+		UserAgent: userAgent(cfg.UserAgent),
+		Method:    account.Method,
+		Params:    account.ParamNames,
+		Success:   account.SuccessResponse,
+	}
+}
+
+// userAgent returns the User-Agent header sent to the providers, as required
+// by the DynDNS v2 protocol. comment is a free-form description of the
+// client, such as a contact address.
+func userAgent(comment string) string {
+	if comment == "" {
+		comment = "+https://git.quba.fr/qbarrand/go-dynhost"
+	}
+
+	return fmt.Sprintf("go-dynhost/%s (%s)", version, comment)
+}
+
+// describeRequest describes an update request, including its URL, its form
+// and its headers, with the password redacted.
+func describeRequest(req *http.Request) string {
+	desc := fmt.Sprintf("%s %s", req.Method, req.URL.Redacted())
+
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			form, _ := ioutil.ReadAll(body)
+			desc += fmt.Sprintf(" with the form %s", form)
+		}
+	}
+
+	if user, _, ok := req.BasicAuth(); ok {
+		desc += fmt.Sprintf(" as %s (password redacted)", user)
+	}
+
+	return desc + fmt.Sprintf(", User-Agent %q", req.UserAgent())
+}
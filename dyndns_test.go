@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestUpdaterUserAgent(t *testing.T) {
+	tests := []struct {
+		name      string
+		userAgent string
+		expected  string
+	}{
+		{name: "default", expected: "go-dynhost/" + version + " (+https://git.quba.fr/qbarrand/go-dynhost)"},
+		{name: "configured", userAgent: "admin@example.com", expected: "go-dynhost/" + version + " (admin@example.com)"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				received = r.Header.Get("User-Agent")
+				fmt.Fprint(w, "good 203.0.113.7")
+			}))
+			defer srv.Close()
+
+			cfg := loadTestConfig(t, fmt.Sprintf(`
+user_agent = %s
+
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+`, tt.userAgent, srv.URL))
+
+			u := newUpdater(cfg, cfg.Accounts[0], newHTTPClient(cfg))
+
+			if _, err := u.Update(context.Background(), "home.example.com", net.ParseIP("203.0.113.7")); err != nil {
+				t.Fatal(err)
+			}
+
+			if received != tt.expected {
+				t.Fatalf("the request was sent with the User-Agent %q, expected %q", received, tt.expected)
+			}
+		})
+	}
+}
+
+func TestSuccessResponse(t *testing.T) {
+	tests := []struct {
+		name    string
+		success string
+		body    string
+		ok      bool
+	}{
+		{name: "prefix", success: "OK", body: "OK 203.0.113.7", ok: true},
+		{name: "prefix mismatch", success: "OK", body: "NOT OK"},
+		{name: "literal prefix", success: "1.0", body: "100"},
+		{name: "regular expression", success: "/^(OK|SUCCESS)$/", body: "SUCCESS", ok: true},
+		{name: "regular expression mismatch", success: "/^(OK|SUCCESS)$/", body: "FAILURE"},
+		{name: "protocol code", success: "OK", body: "good 203.0.113.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+
+			cfg := loadTestConfig(t, fmt.Sprintf(`
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+success_response = %s
+`, srv.URL, tt.success))
+
+			u := newUpdater(cfg, cfg.Accounts[0], newHTTPClient(cfg))
+
+			_, err := u.Update(context.Background(), "home.example.com", net.ParseIP("203.0.113.7"))
+
+			if ok := err == nil; ok != tt.ok {
+				t.Fatalf("the response %q to success_response %s: %v", tt.body, tt.success, err)
+			}
+		})
+	}
+}
+
+func TestSuccessResponseInvalid(t *testing.T) {
+	for value, expected := range map[string]string{
+		"":    "success_response cannot be empty",
+		"/(/": "invalid success_response /(/",
+	} {
+		err := loadTestConfigError(t, `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+success_response = `+value+"\n")
+
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected an error containing %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestParamNames(t *testing.T) {
+	tests := []struct {
+		name      string
+		names     string
+		addresses []string
+		expected  string
+	}{
+		{
+			name:      "default",
+			addresses: []string{"203.0.113.7"},
+			expected:  "hostname=home.example.com&myip=203.0.113.7&system=dyndns",
+		},
+		{
+			name:      "renamed and dropped",
+			names:     "param_names = hostname:host, myip:ip, system:",
+			addresses: []string{"203.0.113.7"},
+			expected:  "host=home.example.com&ip=203.0.113.7",
+		},
+		{
+			name:      "both families",
+			names:     "param_names = myip:ipv4, myip6:ipv6",
+			addresses: []string{"203.0.113.7", "2001:db8::7"},
+			expected:  "hostname=home.example.com&ipv4=203.0.113.7&ipv6=2001%3Adb8%3A%3A7&system=dyndns",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var query string
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				query = r.URL.RawQuery
+				fmt.Fprint(w, "good")
+			}))
+			defer srv.Close()
+
+			cfg := loadTestConfig(t, fmt.Sprintf(`
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+%s
+`, srv.URL, tt.names))
+
+			u := newUpdater(cfg, cfg.Accounts[0], newHTTPClient(cfg))
+
+			var addresses []net.IP
+			for _, a := range tt.addresses {
+				addresses = append(addresses, net.ParseIP(a))
+			}
+
+			if _, err := u.Update(context.Background(), "home.example.com", addresses...); err != nil {
+				t.Fatal(err)
+			}
+
+			if query != tt.expected {
+				t.Fatalf("unexpected query string %s, expected %s", query, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParamNamesInvalid(t *testing.T) {
+	for value, expected := range map[string]string{
+		"hostname":        `invalid param_names "hostname": expected protocol:name`,
+		"username:user":   `unknown parameter "username"`,
+		"myip:ip, host:h": `unknown parameter "host"`,
+	} {
+		err := loadTestConfigError(t, `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+param_names = `+value+"\n")
+
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected an error containing %q, got %v", expected, err)
+		}
+	}
+}
@@ -0,0 +1,675 @@
+package dynhost
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider is a third party able to tell the public address of the host.
+type Provider interface {
+	fmt.Stringer
+
+	// PublicIP returns the public address of the host, as seen by the
+	// provider.
+	PublicIP(ctx context.Context) (net.IP, error)
+}
+
+// HTTPProvider returns the address served at URL, either as the plain-text
+// body or as a field of a JSON object.
+type HTTPProvider struct {
+	// Client sends the requests to URL.
+	Client *http.Client
+
+	// URL is the address of the service, such as https://api.ipify.org.
+	URL string
+
+	// JSONField is the name of the field holding the address when the body
+	// is a JSON object, or empty if it is plain text.
+	JSONField string
+}
+
+// String returns the URL of the provider.
+func (p *HTTPProvider) String() string {
+	return p.URL
+}
+
+// PublicIP returns the address served at URL, which must reply 200 OK.
+func (p *HTTPProvider) PublicIP(ctx context.Context) (net.IP, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	debugf("GET %s: %s", p.URL, res.Status)
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &StatusError{Server: "the provider", Status: res.Status, Code: res.StatusCode}
+	}
+
+	ipStrBytes, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the response: %v", err)
+	}
+
+	if p.JSONField == "" {
+		return parseIP(string(ipStrBytes))
+	}
+
+	var fields map[string]interface{}
+
+	if err := json.Unmarshal(ipStrBytes, &fields); err != nil {
+		return nil, fmt.Errorf("could not decode the JSON response: %v", err)
+	}
+
+	ipStr, ok := fields[p.JSONField].(string)
+	if !ok {
+		return nil, fmt.Errorf("no %q string field in the JSON response", p.JSONField)
+	}
+
+	return parseIP(ipStr)
+}
+
+// parseIP parses the address returned by a provider, ignoring surrounding
+// whitespace such as a trailing newline.
+func parseIP(s string) (net.IP, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return nil, errors.New("empty response")
+	}
+
+	ip := net.ParseIP(s)
+	if ip == nil {
+		if len(s) > 64 {
+			s = s[:64] + "..."
+		}
+
+		return nil, fmt.Errorf("could not parse %q as an IP address", s)
+	}
+
+	return ip, nil
+}
+
+// DNSProvider asks a resolver for a special name resolving to the address the
+// query comes from, such as myip.opendns.com on the OpenDNS resolvers, or the
+// TXT record o-o.myaddr.l.google.com on the Google nameservers.
+type DNSProvider struct {
+	// Resolver is the host:port address of the DNS server to query.
+	Resolver string
+
+	// Name is the special name to look up, such as myip.opendns.com.
+	Name string
+
+	// TXT queries the TXT record of Name, holding the address as text,
+	// rather than its A or AAAA record.
+	TXT bool
+
+	// Family is the family of the address to look up, and of the
+	// connection to the resolver.
+	Family Family
+
+	// Source is the local address of the queries, if not nil.
+	Source net.IP
+}
+
+// String returns the name queried and the resolver, as name@resolver.
+func (p *DNSProvider) String() string {
+	return fmt.Sprintf("%s@%s", p.Name, p.Resolver)
+}
+
+// PublicIP returns the address Name resolves to on the resolver.
+func (p *DNSProvider) PublicIP(ctx context.Context) (net.IP, error) {
+	r := net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+			var d net.Dialer
+
+			// The query must reach the resolver over the family of the
+			// address we are looking for.
+			if p.Family == IPv6 {
+				network += "6"
+			} else {
+				network += "4"
+			}
+
+			if p.Source != nil {
+				if strings.HasPrefix(network, "tcp") {
+					d.LocalAddr = &net.TCPAddr{IP: p.Source}
+				} else {
+					d.LocalAddr = &net.UDPAddr{IP: p.Source}
+				}
+			}
+
+			return d.DialContext(ctx, network, p.Resolver)
+		},
+	}
+
+	if !p.TXT {
+		ips, err := r.LookupIP(ctx, p.Family.Network(), p.Name)
+		if err != nil {
+			return nil, err
+		}
+
+		return ips[0], nil
+	}
+
+	records, err := r.LookupTXT(ctx, p.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	// Resolvers may return several records, some of them unrelated to the
+	// address (e.g. the EDNS client subnet).
+	return ipFromTXT(records, p.Family)
+}
+
+// ParseProviders builds the providers of the given family from their URLs:
+//
+//   - http:// and https:// URLs are fetched with client and their body parsed
+//     as an address, or decoded as a JSON object holding the address in
+//     jsonField if it is not empty;
+//   - dns://resolver[:port]/name URLs look up name against resolver; a
+//     ?type=TXT suffix reads the address from a TXT record rather than an
+//     A or AAAA record;
+//   - upnp:// asks the Internet gateway device found on the local network
+//     over UPnP, and natpmp://[gateway] asks the given gateway, or the default
+//     one, over NAT-PMP. Both only tell IPv4 addresses.
+func ParseProviders(client *http.Client, urls []string, family Family, jsonField string) ([]Provider, error) {
+	providers := make([]Provider, 0, len(urls))
+
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			return nil, err
+		}
+
+		switch u.Scheme {
+		case "http", "https":
+			providers = append(providers, &HTTPProvider{Client: client, URL: rawURL, JSONField: jsonField})
+		case "dns":
+			p := DNSProvider{
+				Resolver: u.Host,
+				Name:     strings.TrimPrefix(u.Path, "/"),
+				Family:   family,
+			}
+
+			if u.Port() == "" {
+				p.Resolver = net.JoinHostPort(u.Hostname(), "53")
+			}
+
+			switch strings.ToUpper(u.Query().Get("type")) {
+			case "TXT":
+				p.TXT = true
+			case "", "A", "AAAA":
+			default:
+				return nil, fmt.Errorf("%s: unsupported record type %q", rawURL, u.Query().Get("type"))
+			}
+
+			if u.Hostname() == "" || p.Name == "" {
+				return nil, fmt.Errorf("%s: expected dns://resolver/name", rawURL)
+			}
+
+			providers = append(providers, &p)
+		case "upnp", "natpmp":
+			if family != IPv4 {
+				return nil, fmt.Errorf("%s: %s only tells IPv4 addresses", rawURL, u.Scheme)
+			}
+
+			if u.Scheme == "upnp" {
+				providers = append(providers, &UPnPProvider{})
+			} else {
+				providers = append(providers, &NATPMPProvider{Gateway: u.Hostname()})
+			}
+		default:
+			return nil, fmt.Errorf("%s: unsupported provider scheme %q", rawURL, u.Scheme)
+		}
+	}
+
+	return providers, nil
+}
+
+// InterfaceProvider returns an address assigned to a local network interface.
+// Only global unicast addresses of the requested family are considered; the
+// first one that is not in a rejected range is selected. Among IPv6
+// addresses, stable ones are preferred to the temporary addresses of the
+// privacy extensions, which change every few hours, and deprecated ones are
+// only selected as a last resort.
+type InterfaceProvider struct {
+	// Name is the name of the interface, such as eth0.
+	Name string
+
+	// Family is the family of the address to select.
+	Family Family
+
+	// Rejected lists the ranges the selected address cannot belong to.
+	Rejected []*net.IPNet
+
+	// PreferTemporary prefers the temporary IPv6 addresses instead.
+	PreferTemporary bool
+}
+
+// String returns the name of the interface.
+func (p *InterfaceProvider) String() string {
+	return "interface " + p.Name
+}
+
+// PublicIP returns the selected address of the interface.
+func (p *InterfaceProvider) PublicIP(ctx context.Context) (net.IP, error) {
+	iface, err := net.InterfaceByName(p.Name)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, fmt.Errorf("could not list the addresses: %v", err)
+	}
+
+	var flags map[string]uint64
+	if p.Family == IPv6 {
+		flags = ipv6Flags(p.Name)
+	}
+
+	return p.selectAddress(addrs, flags)
+}
+
+// selectAddress returns the preferred address of addrs, the addresses of the
+// interface, whose IPv6 flags are given by address in flags.
+func (p *InterfaceProvider) selectAddress(addrs []net.Addr, flags map[string]uint64) (net.IP, error) {
+	var (
+		best     net.IP
+		bestRank int
+		cgnat    net.IP
+	)
+
+	for _, a := range addrs {
+		ipNet, ok := a.(*net.IPNet)
+		if !ok {
+			continue
+		}
+
+		ip := ipNet.IP
+
+		if !ip.IsGlobalUnicast() || !p.Family.Matches(ip) {
+			continue
+		}
+
+		if rejectedRange(ip, p.Rejected) != nil {
+			if IsCGNAT(ip) {
+				cgnat = ip
+			}
+
+			continue
+		}
+
+		rank := 0
+		if p.Family == IPv6 {
+			if rank = ipv6Rank(flags[ip.String()], p.PreferTemporary); rank < 0 {
+				continue
+			}
+		}
+
+		if best == nil || rank < bestRank {
+			best, bestRank = ip, rank
+		}
+	}
+
+	if best != nil {
+		return best, nil
+	}
+
+	if cgnat != nil {
+		return nil, fmt.Errorf("no global unicast %s address but %v, which is behind a carrier-grade NAT", p.Family, cgnat)
+	}
+
+	return nil, fmt.Errorf("no global unicast %s address", p.Family)
+}
+
+// Flags of the IPv6 addresses, as listed in /proc/net/if_inet6.
+const (
+	ifaTemporary  = 0x01
+	ifaDADFailed  = 0x08
+	ifaDeprecated = 0x20
+	ifaTentative  = 0x40
+)
+
+// ipv6Flags returns the flags of the IPv6 addresses of the interface called
+// name, by address, as listed by Linux in /proc/net/if_inet6. It returns nil
+// on other systems, where all the addresses are considered stable.
+func ipv6Flags(name string) map[string]uint64 {
+	b, err := ioutil.ReadFile("/proc/net/if_inet6")
+	if err != nil {
+		return nil
+	}
+
+	return parseIPv6Flags(string(b), name)
+}
+
+// parseIPv6Flags parses the flags of the IPv6 addresses of the interface
+// called name in ifInet6, the content of /proc/net/if_inet6.
+func parseIPv6Flags(ifInet6, name string) map[string]uint64 {
+	flags := make(map[string]uint64)
+
+	// Each line holds the address, the index of the interface, the length
+	// of the prefix, the scope, the flags and the name of the interface.
+	for _, line := range strings.Split(ifInet6, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 6 || fields[5] != name {
+			continue
+		}
+
+		raw, err := hex.DecodeString(fields[0])
+		if err != nil || len(raw) != net.IPv6len {
+			continue
+		}
+
+		f, err := strconv.ParseUint(fields[4], 16, 8)
+		if err != nil {
+			continue
+		}
+
+		flags[net.IP(raw).String()] = f
+	}
+
+	return flags
+}
+
+// ipv6Rank orders the IPv6 addresses by preference, from 0: stable addresses
+// come before temporary ones, unless preferTemporary, and deprecated addresses
+// come last. It returns -1 for the addresses that cannot be used, as their
+// duplicate address detection is in progress or failed.
+func ipv6Rank(flags uint64, preferTemporary bool) int {
+	if flags&(ifaTentative|ifaDADFailed) != 0 {
+		return -1
+	}
+
+	rank := 0
+
+	if (flags&ifaTemporary != 0) != preferTemporary {
+		rank++
+	}
+
+	if flags&ifaDeprecated != 0 {
+		rank += 2
+	}
+
+	return rank
+}
+
+// ProviderErrors aggregates the failures of every provider that was tried.
+type ProviderErrors []error
+
+// Error lists the failures of the providers.
+func (pe ProviderErrors) Error() string {
+	return fmt.Sprintf("all providers failed: %s", pe.list())
+}
+
+func (pe ProviderErrors) list() string {
+	msgs := make([]string, 0, len(pe))
+
+	for _, err := range pe {
+		msgs = append(msgs, err.Error())
+	}
+
+	return strings.Join(msgs, "; ")
+}
+
+// Detector finds the public addresses of the host by querying its providers
+// in order, until one of them returns a valid address. In consensus mode, all
+// the providers are queried concurrently instead, and the address returned by
+// most of them is selected.
+type Detector struct {
+	// IPv4Providers and IPv6Providers are the providers of each family, in
+	// order of preference.
+	IPv4Providers []Provider
+	IPv6Providers []Provider
+
+	// Timeout bounds each provider attempt, if not 0.
+	Timeout time.Duration
+
+	// Rejected lists the ranges a public address cannot belong to.
+	Rejected []*net.IPNet
+
+	// ConsensusMin is the number of providers that must agree on an address
+	// for it to be selected; consensus mode is enabled when it is above 1.
+	ConsensusMin int
+
+	// Rand, if not nil, shuffles the providers before each detection, so
+	// that the load is spread over them.
+	Rand   *rand.Rand
+	randMu sync.Mutex
+}
+
+// DetectPublicIP returns the public address of the family returned by the
+// first of the providers that succeeds. It is a shorthand for a Detector
+// with the same providers for both families.
+func DetectPublicIP(ctx context.Context, family Family, providers ...Provider) (net.IP, error) {
+	d := Detector{IPv4Providers: providers, IPv6Providers: providers}
+
+	return d.PublicIP(ctx, family)
+}
+
+// Providers returns the providers of the family.
+func (d *Detector) Providers(family Family) []Provider {
+	if family == IPv6 {
+		return d.IPv6Providers
+	}
+
+	return d.IPv4Providers
+}
+
+// PublicIP returns the public address of the family. IPv4 addresses are
+// returned in their 4-byte form.
+func (d *Detector) PublicIP(ctx context.Context, family Family) (net.IP, error) {
+	providers := d.Providers(family)
+
+	if len(providers) == 0 {
+		return nil, fmt.Errorf("no %s provider configured", family)
+	}
+
+	if d.Rand != nil {
+		providers = d.shuffle(providers)
+	}
+
+	var (
+		ip  net.IP
+		err error
+	)
+
+	if d.ConsensusMin > 1 {
+		ip, err = d.consensus(ctx, family, providers)
+	} else {
+		ip, err = d.first(ctx, family, providers)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	if family == IPv4 {
+		return ip.To4(), nil
+	}
+
+	return ip, nil
+}
+
+// shuffle returns a copy of providers in a random order.
+func (d *Detector) shuffle(providers []Provider) []Provider {
+	shuffled := append([]Provider{}, providers...)
+
+	d.randMu.Lock()
+	d.Rand.Shuffle(len(shuffled), func(i, j int) {
+		shuffled[i], shuffled[j] = shuffled[j], shuffled[i]
+	})
+	d.randMu.Unlock()
+
+	return shuffled
+}
+
+// first queries the providers in order, and returns the first valid address.
+// It stops as soon as ctx is done, without trying the remaining providers.
+func (d *Detector) first(ctx context.Context, family Family, providers []Provider) (net.IP, error) {
+	var errs ProviderErrors
+
+	for _, p := range providers {
+		if ctx.Err() != nil {
+			break
+		}
+
+		ip, err := d.ask(ctx, p, family)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", p, err))
+			continue
+		}
+
+		return ip, nil
+	}
+
+	if err := ctx.Err(); err != nil {
+		if len(errs) == 0 {
+			return nil, err
+		}
+
+		return nil, fmt.Errorf("%w after trying %d of the %d %s providers: %s", err, len(errs), len(providers), family, errs.list())
+	}
+
+	return nil, errs
+}
+
+// consensus queries all the providers concurrently and returns the address
+// most of them agree on, provided at least ConsensusMin of them do.
+func (d *Detector) consensus(ctx context.Context, family Family, providers []Provider) (net.IP, error) {
+	type result struct {
+		provider Provider
+		ip       net.IP
+		err      error
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	results := make(chan result, len(providers))
+
+	for _, p := range providers {
+		go func(p Provider) {
+			ip, err := d.ask(ctx, p, family)
+			results <- result{provider: p, ip: ip, err: err}
+		}(p)
+	}
+
+	var (
+		errs  ProviderErrors
+		votes = make(map[string]int)
+		best  string
+	)
+
+	for range providers {
+		r := <-results
+
+		if r.err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", r.provider, r.err))
+			continue
+		}
+
+		ipStr := r.ip.String()
+
+		if votes[ipStr]++; votes[ipStr] > votes[best] {
+			best = ipStr
+		}
+	}
+
+	if len(votes) == 0 {
+		return nil, errs
+	}
+
+	if votes[best] < d.ConsensusMin {
+		return nil, fmt.Errorf("no %d providers agree on the %s address (votes: %v, failures: %v)", d.ConsensusMin, family, votes, errs)
+	}
+
+	debugf("%d of %d providers agree on %s", votes[best], len(providers), best)
+
+	return net.ParseIP(best), nil
+}
+
+// ask queries p and checks that the returned address is a valid public
+// address of the given family. The outcome is logged along with the time p
+// took to answer.
+func (d *Detector) ask(ctx context.Context, p Provider, family Family) (net.IP, error) {
+	start := time.Now()
+
+	ip, err := d.check(ctx, p, family)
+	if err != nil {
+		debugf("Provider %s failed after %v: %v", p, time.Since(start).Round(time.Microsecond), err)
+		return nil, err
+	}
+
+	debugf("Provider %s returned %s in %v", p, ip, time.Since(start).Round(time.Microsecond))
+
+	return ip, nil
+}
+
+func (d *Detector) check(ctx context.Context, p Provider, family Family) (net.IP, error) {
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+
+	ip, err := p.PublicIP(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if ip == nil || !family.Matches(ip) {
+		return nil, fmt.Errorf("%v is not an %s address", ip, family)
+	}
+
+	if n := rejectedRange(ip, d.Rejected); n != nil {
+		if IsCGNAT(ip) {
+			return nil, fmt.Errorf("%v is in the rejected range %v: the host is behind a carrier-grade NAT", ip, n)
+		}
+
+		return nil, fmt.Errorf("%v is in the rejected range %v", ip, n)
+	}
+
+	return ip, nil
+}
+
+// cgnat is the shared address space of RFC 6598, which carriers assign to
+// the customers behind their NAT. These addresses cannot be reached from the
+// Internet.
+var cgnat = &net.IPNet{IP: net.IPv4(100, 64, 0, 0).To4(), Mask: net.CIDRMask(10, 32)}
+
+// IsCGNAT reports whether ip is in the carrier-grade NAT range.
+func IsCGNAT(ip net.IP) bool {
+	return cgnat.Contains(ip)
+}
+
+// rejectedRange returns the first of nets containing ip, or nil.
+func rejectedRange(ip net.IP, nets []*net.IPNet) *net.IPNet {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return n
+		}
+	}
+
+	return nil
+}
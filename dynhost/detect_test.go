@@ -0,0 +1,368 @@
+package dynhost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// staticProvider returns ip, or err if it is not nil, and counts the calls.
+// It calls cancel when queried, if not nil.
+type staticProvider struct {
+	name   string
+	ip     string
+	err    error
+	cancel context.CancelFunc
+	calls  int
+}
+
+func (p *staticProvider) String() string {
+	return p.name
+}
+
+func (p *staticProvider) PublicIP(ctx context.Context) (net.IP, error) {
+	p.calls++
+
+	if p.cancel != nil {
+		p.cancel()
+	}
+
+	if p.err != nil {
+		return nil, p.err
+	}
+
+	return net.ParseIP(p.ip), nil
+}
+
+func TestHTTPProviderFormats(t *testing.T) {
+	tests := []struct {
+		name      string
+		body      string
+		jsonField string
+		ip        string
+		err       string
+	}{
+		{name: "text", body: "203.0.113.7\n", ip: "203.0.113.7"},
+		{name: "text IPv6", body: "2001:db8::7", ip: "2001:db8::7"},
+		{name: "text garbage", body: "not an address", err: `could not parse "not an address"`},
+		{name: "JSON", body: `{"ip": "203.0.113.7", "country": "FR"}`, jsonField: "ip", ip: "203.0.113.7"},
+		{name: "JSON custom field", body: `{"address": " 203.0.113.7 "}`, jsonField: "address", ip: "203.0.113.7"},
+		{name: "JSON missing field", body: `{"address": "203.0.113.7"}`, jsonField: "ip", err: `no "ip" string field`},
+		{name: "JSON field not a string", body: `{"ip": 42}`, jsonField: "ip", err: `no "ip" string field`},
+		{name: "malformed JSON", body: `{"ip": "203.0.113.7"`, jsonField: "ip", err: "could not decode the JSON response"},
+		{name: "JSON expected, text received", body: "203.0.113.7", jsonField: "ip", err: "could not decode the JSON response"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+
+			p := HTTPProvider{Client: srv.Client(), URL: srv.URL, JSONField: tt.jsonField}
+
+			ip, err := p.PublicIP(context.Background())
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error containing %q, got %v (%v)", tt.err, err, ip)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ip.String() != tt.ip {
+				t.Fatalf("got %s, expected %s", ip, tt.ip)
+			}
+		})
+	}
+}
+
+func TestDetectorConsensus(t *testing.T) {
+	failure := errors.New("unreachable")
+
+	tests := []struct {
+		name      string
+		min       int
+		providers []string
+		ip        string
+		err       string
+	}{
+		{name: "unanimous", min: 2, providers: []string{"203.0.113.7", "203.0.113.7", "203.0.113.7"}, ip: "203.0.113.7"},
+		{name: "majority", min: 2, providers: []string{"203.0.113.7", "198.51.100.1", "203.0.113.7"}, ip: "203.0.113.7"},
+		{name: "majority despite a failure", min: 2, providers: []string{"203.0.113.7", "", "203.0.113.7"}, ip: "203.0.113.7"},
+		{name: "all disagree", min: 2, providers: []string{"203.0.113.7", "198.51.100.1", "192.0.2.1"}, err: "no 2 providers agree"},
+		{name: "majority below the minimum", min: 3, providers: []string{"203.0.113.7", "198.51.100.1", "203.0.113.7"}, err: "no 3 providers agree"},
+		{name: "all fail", min: 2, providers: []string{"", "", ""}, err: "all providers failed"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var providers []Provider
+
+			for i, ip := range tt.providers {
+				p := staticProvider{name: fmt.Sprintf("provider %d", i), ip: ip}
+				if ip == "" {
+					p.err = failure
+				}
+
+				providers = append(providers, &p)
+			}
+
+			d := Detector{IPv4Providers: providers, ConsensusMin: tt.min}
+
+			ip, err := d.PublicIP(context.Background(), IPv4)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error containing %q, got %v (%v)", tt.err, err, ip)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ip.String() != tt.ip {
+				t.Fatalf("got %s, expected %s", ip, tt.ip)
+			}
+		})
+	}
+}
+
+func TestIsCGNAT(t *testing.T) {
+	tests := []struct {
+		ip    string
+		cgnat bool
+	}{
+		{ip: "100.64.0.0", cgnat: true},
+		{ip: "100.100.1.1", cgnat: true},
+		{ip: "100.127.255.255", cgnat: true},
+		{ip: "100.63.255.255"},
+		{ip: "100.128.0.0"},
+		{ip: "203.0.113.7"},
+		{ip: "::ffff:100.64.0.1", cgnat: true},
+		{ip: "2001:db8::1"},
+	}
+
+	for _, tt := range tests {
+		if cgnat := IsCGNAT(net.ParseIP(tt.ip)); cgnat != tt.cgnat {
+			t.Errorf("IsCGNAT(%s) = %v, expected %v", tt.ip, cgnat, tt.cgnat)
+		}
+	}
+}
+
+func TestDetectorShuffle(t *testing.T) {
+	providers := []Provider{
+		&staticProvider{name: "a", ip: "203.0.113.1"},
+		&staticProvider{name: "b", ip: "203.0.113.2"},
+		&staticProvider{name: "c", ip: "203.0.113.3"},
+	}
+
+	// winners returns the addresses returned by n detections.
+	winners := func(d *Detector, n int) []string {
+		var ips []string
+
+		for i := 0; i < n; i++ {
+			ip, err := d.PublicIP(context.Background(), IPv4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ips = append(ips, ip.String())
+		}
+
+		return ips
+	}
+
+	ordered := winners(&Detector{IPv4Providers: providers}, 20)
+	for _, ip := range ordered {
+		if ip != "203.0.113.1" {
+			t.Fatalf("got %s without shuffling, expected the address of the first provider", ip)
+		}
+	}
+
+	shuffled := winners(&Detector{IPv4Providers: providers, Rand: rand.New(rand.NewSource(42))}, 20)
+	again := winners(&Detector{IPv4Providers: providers, Rand: rand.New(rand.NewSource(42))}, 20)
+
+	// The order only depends on the seed.
+	if fmt.Sprint(shuffled) != fmt.Sprint(again) {
+		t.Fatalf("the same seed gave %v and %v", shuffled, again)
+	}
+
+	seen := make(map[string]bool)
+	for _, ip := range shuffled {
+		seen[ip] = true
+	}
+
+	if len(seen) != len(providers) {
+		t.Fatalf("only %d provider(s) came first in %v", len(seen), shuffled)
+	}
+
+	// The providers of the detector are left in order.
+	for i, name := range []string{"a", "b", "c"} {
+		if providers[i].String() != name {
+			t.Fatalf("the providers were reordered to %v", providers)
+		}
+	}
+}
+
+func TestInterfaceSelectAddress(t *testing.T) {
+	addrs := func(ips ...string) []net.Addr {
+		var a []net.Addr
+		for _, ip := range ips {
+			a = append(a, &net.IPNet{IP: net.ParseIP(ip)})
+		}
+
+		return a
+	}
+
+	flags := map[string]uint64{
+		"2001:db8::1": 0,
+		"2001:db8::2": ifaTemporary,
+		"2001:db8::3": ifaDeprecated,
+		"2001:db8::4": ifaTentative,
+		"2001:db8::5": ifaTemporary | ifaDeprecated,
+		"2001:db8::6": ifaDADFailed,
+	}
+
+	_, cgnat, _ := net.ParseCIDR("100.64.0.0/10")
+
+	tests := []struct {
+		name            string
+		family          Family
+		addrs           []net.Addr
+		preferTemporary bool
+		expected        string
+		err             string
+	}{
+		{name: "stable and temporary", family: IPv6, addrs: addrs("fe80::1", "2001:db8::2", "2001:db8::1"), expected: "2001:db8::1"},
+		{name: "prefer temporary", family: IPv6, addrs: addrs("2001:db8::1", "2001:db8::2"), preferTemporary: true, expected: "2001:db8::2"},
+		{name: "temporary only", family: IPv6, addrs: addrs("2001:db8::2"), expected: "2001:db8::2"},
+		{name: "deprecated stable", family: IPv6, addrs: addrs("2001:db8::3", "2001:db8::2"), expected: "2001:db8::2"},
+		{name: "deprecated only", family: IPv6, addrs: addrs("2001:db8::5", "2001:db8::3"), expected: "2001:db8::3"},
+		{name: "duplicate address detection", family: IPv6, addrs: addrs("2001:db8::4", "2001:db8::6"), err: "no global unicast IPv6 address"},
+		{name: "without flags", family: IPv6, addrs: addrs("fe80::1", "2001:db8::7"), expected: "2001:db8::7"},
+		{name: "IPv4", family: IPv4, addrs: addrs("2001:db8::1", "203.0.113.7"), expected: "203.0.113.7"},
+		{name: "CGNAT", family: IPv4, addrs: addrs("100.64.0.7"), err: "behind a carrier-grade NAT"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := InterfaceProvider{Name: "eth0", Family: tt.family, Rejected: []*net.IPNet{cgnat}, PreferTemporary: tt.preferTemporary}
+
+			ip, err := p.selectAddress(tt.addrs, flags)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error containing %q, got %v and %v", tt.err, ip, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !ip.Equal(net.ParseIP(tt.expected)) {
+				t.Fatalf("selected %s, expected %s", ip, tt.expected)
+			}
+		})
+	}
+}
+
+func TestParseIPv6Flags(t *testing.T) {
+	const ifInet6 = `20010db8000000000000000000000001 02 40 00 00     eth0
+20010db8000000000000000000000002 02 40 00 01     eth0
+fe800000000000000000000000000001 02 40 20 80     eth0
+20010db8000000000000000000000003 03 40 00 20     wlan0
+00000000000000000000000000000001 01 80 10 80       lo
+`
+
+	flags := parseIPv6Flags(ifInet6, "eth0")
+
+	expected := map[string]uint64{
+		"2001:db8::1": 0,
+		"2001:db8::2": ifaTemporary,
+		"fe80::1":     0x80,
+	}
+
+	if fmt.Sprint(flags) != fmt.Sprint(expected) {
+		t.Fatalf("got the flags %v, expected %v", flags, expected)
+	}
+}
+
+func TestDetectorFirstCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// The first provider fails as the context is canceled while it is
+	// queried, e.g. when go-dynhost is stopped.
+	providers := []*staticProvider{
+		{name: "provider 0", err: errors.New("unreachable"), cancel: cancel},
+		{name: "provider 1", ip: "203.0.113.7"},
+		{name: "provider 2", ip: "203.0.113.7"},
+	}
+
+	d := Detector{IPv4Providers: []Provider{providers[0], providers[1], providers[2]}}
+
+	ip, err := d.PublicIP(ctx, IPv4)
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the cancellation, got %v and %v", ip, err)
+	}
+
+	if !strings.Contains(err.Error(), "after trying 1 of the 3 IPv4 providers: provider 0: unreachable") {
+		t.Fatalf("unexpected error %v", err)
+	}
+
+	if providers[0].calls != 1 {
+		t.Fatalf("%s was queried %d time(s), expected 1", providers[0], providers[0].calls)
+	}
+
+	for _, p := range providers[1:] {
+		if p.calls != 0 {
+			t.Fatalf("%s was queried after the cancellation", p)
+		}
+	}
+}
+
+func TestDetectPublicIP(t *testing.T) {
+	providers := []*staticProvider{
+		{name: "provider 0", err: errors.New("unreachable")},
+		{name: "provider 1", ip: "2001:db8::7"},
+		{name: "provider 2", ip: "2001:db8::8"},
+	}
+
+	ip, err := DetectPublicIP(context.Background(), IPv6, providers[0], providers[1], providers[2])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ip.Equal(net.ParseIP("2001:db8::7")) {
+		t.Fatalf("got %v, expected the address of the first provider that succeeds", ip)
+	}
+
+	if providers[2].calls != 0 {
+		t.Fatalf("%s was queried after a provider succeeded", providers[2])
+	}
+
+	failing := &staticProvider{name: "provider 0", err: errors.New("unreachable")}
+
+	if _, err := DetectPublicIP(context.Background(), IPv4, failing); err == nil || !strings.Contains(err.Error(), "provider 0: unreachable") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
@@ -0,0 +1,221 @@
+package dynhost
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"os"
+	"strings"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var errNXDomain = errors.New("no such host")
+
+// maxUDPSize is the size of the buffer receiving the UDP responses. Servers
+// truncate those that do not fit in 512 bytes, which are then retried over
+// TCP.
+const maxUDPSize = 65535
+
+// lookupCNAME returns the target of the CNAME record of name, or an empty
+// string if it has none. Unlike net.Resolver.LookupCNAME, which returns the
+// end of the chain, only one hop is resolved.
+func lookupCNAME(ctx context.Context, r *net.Resolver, name string) (string, error) {
+	answers, err := lookup(ctx, r, name, dnsmessage.TypeCNAME)
+	if err != nil {
+		return "", err
+	}
+
+	for _, a := range answers {
+		rr, ok := a.Body.(*dnsmessage.CNAMEResource)
+		if ok && strings.EqualFold(a.Header.Name.String(), fqdn(name)) {
+			return rr.CNAME.String(), nil
+		}
+	}
+
+	return "", nil
+}
+
+// lookup sends a query of the given type for name to the DNS server r dials,
+// and returns the resources of the answer section, along with their TTL which
+// net.Resolver does not expose.
+func lookup(ctx context.Context, r *net.Resolver, name string, qtype dnsmessage.Type) ([]dnsmessage.Resource, error) {
+	qname, err := dnsmessage.NewName(fqdn(name))
+	if err != nil {
+		return nil, err
+	}
+
+	id := uint16(rand.Intn(1 << 16))
+
+	query := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{
+			{Name: qname, Type: qtype, Class: dnsmessage.ClassINET},
+		},
+	}
+
+	b, err := query.Pack()
+	if err != nil {
+		return nil, err
+	}
+
+	if b, err = exchange(ctx, r, b); err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+
+	h, err := p.Start(b)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the response: %v", err)
+	}
+
+	if h.ID != id {
+		return nil, errors.New("response ID mismatch")
+	}
+
+	switch h.RCode {
+	case dnsmessage.RCodeSuccess:
+	case dnsmessage.RCodeNameError:
+		return nil, errNXDomain
+	default:
+		return nil, fmt.Errorf("the server replied %v", h.RCode)
+	}
+
+	if err := p.SkipAllQuestions(); err != nil {
+		return nil, fmt.Errorf("could not parse the response: %v", err)
+	}
+
+	answers, err := p.AllAnswers()
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the response: %v", err)
+	}
+
+	return answers, nil
+}
+
+// exchange sends the query to the DNS server r dials, or to the first
+// nameserver of the system if r does not dial any, and returns the raw
+// response. As with net.Resolver, stream connections are used with the TCP
+// message framing, and truncated UDP responses are retried over TCP.
+func exchange(ctx context.Context, r *net.Resolver, query []byte) ([]byte, error) {
+	var server string
+
+	dial := r.Dial
+	if dial == nil {
+		var (
+			d   net.Dialer
+			err error
+		)
+
+		if server, err = systemNameserver(); err != nil {
+			return nil, err
+		}
+
+		dial = d.DialContext
+	}
+
+	b, err := exchangeOver(ctx, dial, "udp", server, query)
+	if err != nil {
+		return nil, err
+	}
+
+	var p dnsmessage.Parser
+
+	if h, err := p.Start(b); err == nil && h.Truncated {
+		debugf("Truncated DNS response; retrying over TCP")
+		return exchangeOver(ctx, dial, "tcp", server, query)
+	}
+
+	return b, nil
+}
+
+// exchangeOver sends the query to server through a connection over network
+// returned by dial, and returns the raw response.
+func exchangeOver(ctx context.Context, dial func(ctx context.Context, network, address string) (net.Conn, error), network, server string, query []byte) ([]byte, error) {
+	conn, err := dial(ctx, network, server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	if _, ok := conn.(net.PacketConn); ok {
+		if _, err := conn.Write(query); err != nil {
+			return nil, err
+		}
+
+		b := make([]byte, maxUDPSize)
+
+		n, err := conn.Read(b)
+		if err != nil {
+			return nil, err
+		}
+
+		return b[:n], nil
+	}
+
+	framed := make([]byte, 2+len(query))
+	binary.BigEndian.PutUint16(framed, uint16(len(query)))
+	copy(framed[2:], query)
+
+	if _, err := conn.Write(framed); err != nil {
+		return nil, err
+	}
+
+	var l uint16
+
+	if err := binary.Read(conn, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, l)
+
+	if _, err := io.ReadFull(conn, b); err != nil {
+		return nil, err
+	}
+
+	return b, nil
+}
+
+// resolvConf is the file listing the nameservers of the system.
+var resolvConf = "/etc/resolv.conf"
+
+// systemNameserver returns the address of the first nameserver listed in
+// resolvConf.
+func systemNameserver() (string, error) {
+	f, err := os.Open(resolvConf)
+	if err != nil {
+		return "", fmt.Errorf("no nameserver to query: %v", err)
+	}
+	defer f.Close()
+
+	s := bufio.NewScanner(f)
+
+	for s.Scan() {
+		fields := strings.Fields(s.Text())
+
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+
+	return "", fmt.Errorf("no nameserver to query: none is listed in %s", resolvConf)
+}
+
+// fqdn returns name with a trailing dot.
+func fqdn(name string) string {
+	if strings.HasSuffix(name, ".") {
+		return name
+	}
+
+	return name + "."
+}
@@ -0,0 +1,263 @@
+package dynhost
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dnsStub is a DNS server answering from zone over UDP and TCP, on the same
+// port of the loopback interface, as a recursive resolver would: CNAME
+// chains are followed within the zone.
+type dnsStub struct {
+	// zone holds the records by lower-case fully-qualified name. Names
+	// missing from it do not exist.
+	zone map[string][]dnsmessage.Resource
+
+	// truncate replies to the UDP queries with the TC bit set and no
+	// answer, so that they are sent again over TCP.
+	truncate bool
+
+	// delay is the time taken to reply.
+	delay time.Duration
+
+	// tls serves DNS-over-TLS rather than plain TCP, if not nil.
+	tls *tls.Config
+
+	addr string
+	udp  net.PacketConn
+	tcp  net.Listener
+
+	mu      sync.Mutex
+	queries []string
+}
+
+// start starts serving until the end of the test.
+func (s *dnsStub) start(t *testing.T) {
+	t.Helper()
+
+	tcp, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	udp, err := net.ListenPacket("udp", tcp.Addr().String())
+	if err != nil {
+		tcp.Close()
+		t.Fatal(err)
+	}
+
+	s.addr, s.udp, s.tcp = tcp.Addr().String(), udp, tcp
+
+	if s.tls != nil {
+		s.tcp = tls.NewListener(tcp, s.tls)
+	}
+
+	go s.serveUDP()
+	go s.serveTCP()
+
+	t.Cleanup(func() {
+		udp.Close()
+		tcp.Close()
+	})
+}
+
+// received returns the queries received so far, as "network type name".
+func (s *dnsStub) received() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.queries...)
+}
+
+func (s *dnsStub) serveUDP() {
+	b := make([]byte, 65535)
+
+	for {
+		n, addr, err := s.udp.ReadFrom(b)
+		if err != nil {
+			return
+		}
+
+		if res := s.reply("udp", b[:n]); res != nil {
+			s.udp.WriteTo(res, addr)
+		}
+	}
+}
+
+func (s *dnsStub) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			defer conn.Close()
+
+			for {
+				var l uint16
+
+				if err := binary.Read(conn, binary.BigEndian, &l); err != nil {
+					return
+				}
+
+				b := make([]byte, l)
+
+				if _, err := io.ReadFull(conn, b); err != nil {
+					return
+				}
+
+				res := s.reply("tcp", b)
+				if res == nil {
+					return
+				}
+
+				framed := make([]byte, 2+len(res))
+				binary.BigEndian.PutUint16(framed, uint16(len(res)))
+				copy(framed[2:], res)
+
+				if _, err := conn.Write(framed); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// reply returns the response to the query b received over network, or nil
+// if it cannot be parsed.
+func (s *dnsStub) reply(network string, b []byte) []byte {
+	var p dnsmessage.Parser
+
+	h, err := p.Start(b)
+	if err != nil {
+		return nil
+	}
+
+	q, err := p.Question()
+	if err != nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	s.queries = append(s.queries, network+" "+q.Type.String()+" "+q.Name.String())
+	s.mu.Unlock()
+
+	time.Sleep(s.delay)
+
+	res := dnsmessage.Message{
+		Header: dnsmessage.Header{
+			ID:                 h.ID,
+			Response:           true,
+			Authoritative:      true,
+			RecursionDesired:   h.RecursionDesired,
+			RecursionAvailable: true,
+		},
+		Questions: []dnsmessage.Question{q},
+	}
+
+	if s.truncate && network == "udp" {
+		res.Header.Truncated = true
+	} else {
+		res.Header.RCode, res.Answers = s.answer(q)
+	}
+
+	out, err := res.Pack()
+	if err != nil {
+		return nil
+	}
+
+	return out
+}
+
+// answer returns the records of the zone answering q.
+func (s *dnsStub) answer(q dnsmessage.Question) (dnsmessage.RCode, []dnsmessage.Resource) {
+	name := strings.ToLower(q.Name.String())
+
+	if _, ok := s.zone[name]; !ok {
+		return dnsmessage.RCodeNameError, nil
+	}
+
+	var answers []dnsmessage.Resource
+
+	for hops := 0; hops < 16; hops++ {
+		var target string
+
+		for _, rr := range s.zone[name] {
+			switch {
+			case rr.Header.Type == q.Type:
+				answers = append(answers, rr)
+			case rr.Header.Type == dnsmessage.TypeCNAME:
+				answers = append(answers, rr)
+				target = strings.ToLower(rr.Body.(*dnsmessage.CNAMEResource).CNAME.String())
+			}
+		}
+
+		if target == "" || q.Type == dnsmessage.TypeCNAME {
+			break
+		}
+
+		name = target
+	}
+
+	return dnsmessage.RCodeSuccess, answers
+}
+
+func rrHeader(name string, typ dnsmessage.Type, ttl uint32) dnsmessage.ResourceHeader {
+	return dnsmessage.ResourceHeader{
+		Name:  dnsmessage.MustNewName(fqdn(name)),
+		Type:  typ,
+		Class: dnsmessage.ClassINET,
+		TTL:   ttl,
+	}
+}
+
+func aRecord(name, ip string, ttl uint32) dnsmessage.Resource {
+	var a [4]byte
+	copy(a[:], net.ParseIP(ip).To4())
+
+	return dnsmessage.Resource{Header: rrHeader(name, dnsmessage.TypeA, ttl), Body: &dnsmessage.AResource{A: a}}
+}
+
+func aaaaRecord(name, ip string, ttl uint32) dnsmessage.Resource {
+	var a [16]byte
+	copy(a[:], net.ParseIP(ip).To16())
+
+	return dnsmessage.Resource{Header: rrHeader(name, dnsmessage.TypeAAAA, ttl), Body: &dnsmessage.AAAAResource{AAAA: a}}
+}
+
+func cnameRecord(name, target string) dnsmessage.Resource {
+	return dnsmessage.Resource{
+		Header: rrHeader(name, dnsmessage.TypeCNAME, 300),
+		Body:   &dnsmessage.CNAMEResource{CNAME: dnsmessage.MustNewName(fqdn(target))},
+	}
+}
+
+func txtRecord(name string, ttl uint32, txt ...string) dnsmessage.Resource {
+	return dnsmessage.Resource{Header: rrHeader(name, dnsmessage.TypeTXT, ttl), Body: &dnsmessage.TXTResource{TXT: txt}}
+}
+
+// zone returns the zone holding records, by name. Names without records
+// exist if they are listed in empty.
+func zone(records []dnsmessage.Resource, empty ...string) map[string][]dnsmessage.Resource {
+	z := make(map[string][]dnsmessage.Resource)
+
+	for _, name := range empty {
+		z[fqdn(name)] = nil
+	}
+
+	for _, rr := range records {
+		name := strings.ToLower(rr.Header.Name.String())
+		z[name] = append(z[name], rr)
+	}
+
+	return z
+}
@@ -0,0 +1,5 @@
+// Package dynhost keeps DynHost records in sync with the public addresses of
+// the host. It detects the public addresses through third-party providers,
+// reads the current value of the records from DNS, and updates them through
+// the DynDNS v2 protocol spoken by OVH and other dynamic DNS providers.
+package dynhost
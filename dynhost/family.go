@@ -0,0 +1,65 @@
+package dynhost
+
+import (
+	"net"
+)
+
+// Family is an IP address family.
+type Family int
+
+// The address families, kept up-to-date in A and AAAA records respectively.
+const (
+	IPv4 Family = iota
+	IPv6
+)
+
+// String returns "IPv4" or "IPv6".
+func (f Family) String() string {
+	if f == IPv6 {
+		return "IPv6"
+	}
+
+	return "IPv4"
+}
+
+// RecordType returns the DNS record type holding addresses of the family.
+func (f Family) RecordType() string {
+	if f == IPv6 {
+		return "AAAA"
+	}
+
+	return "A"
+}
+
+// Matches reports whether ip is an address of the family.
+func (f Family) Matches(ip net.IP) bool {
+	if f == IPv6 {
+		return ip.To4() == nil && ip.To16() != nil
+	}
+
+	return ip.To4() != nil
+}
+
+// Network returns the network name selecting the family in net lookups.
+func (f Family) Network() string {
+	if f == IPv6 {
+		return "ip6"
+	}
+
+	return "ip4"
+}
+
+// SameIP reports whether a and b are the same address, whether they are
+// stored in their 4-byte or 16-byte form. A nil or empty address matches
+// nothing, not even another nil address.
+func SameIP(a, b net.IP) bool {
+	if len(a) == 0 || len(b) == 0 {
+		return false
+	}
+
+	if a4, b4 := a.To4(), b.To4(); a4 != nil && b4 != nil {
+		return a4.Equal(b4)
+	}
+
+	return a.Equal(b)
+}
@@ -0,0 +1,39 @@
+package dynhost
+
+import (
+	"net"
+	"testing"
+)
+
+func TestSameIP(t *testing.T) {
+	v4 := net.IPv4(203, 0, 113, 7) // 16-byte form
+	v4Short := v4.To4()
+
+	tests := []struct {
+		name string
+		a, b net.IP
+		same bool
+	}{
+		{name: "4-byte and 4-byte", a: v4Short, b: net.IP{203, 0, 113, 7}, same: true},
+		{name: "16-byte and 16-byte", a: v4, b: net.ParseIP("203.0.113.7"), same: true},
+		{name: "4-byte and 16-byte", a: v4Short, b: v4, same: true},
+		{name: "16-byte and 4-byte", a: v4, b: v4Short, same: true},
+		{name: "different IPv4", a: v4Short, b: net.ParseIP("203.0.113.8"), same: false},
+		{name: "IPv6", a: net.ParseIP("2001:db8::1"), b: net.ParseIP("2001:db8:0::1"), same: true},
+		{name: "different IPv6", a: net.ParseIP("2001:db8::1"), b: net.ParseIP("2001:db8::2"), same: false},
+		{name: "IPv4 and IPv4-mapped IPv6", a: v4Short, b: net.ParseIP("::ffff:203.0.113.7"), same: true},
+		{name: "IPv4 and IPv6", a: v4Short, b: net.ParseIP("2001:db8::cb00:7107"), same: false},
+		{name: "nil and address", a: nil, b: v4Short, same: false},
+		{name: "address and nil", a: v4, b: nil, same: false},
+		{name: "nil and nil", a: nil, b: nil, same: false},
+		{name: "empty and empty", a: net.IP{}, b: net.IP{}, same: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := SameIP(tt.a, tt.b); got != tt.same {
+				t.Fatalf("SameIP(%v, %v) = %v, expected %v", tt.a, tt.b, got, tt.same)
+			}
+		})
+	}
+}
@@ -0,0 +1,395 @@
+package dynhost
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// discoveryTimeout bounds the discovery of the gateway when the context has
+// no deadline.
+const discoveryTimeout = 3 * time.Second
+
+// gatewayClient talks to the gateway directly: the proxy configured for the
+// other requests could not reach it.
+var gatewayClient = &http.Client{Transport: &http.Transport{}}
+
+// withDiscoveryTimeout returns ctx, bounded by discoveryTimeout if it has no
+// deadline.
+func withDiscoveryTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok {
+		return context.WithCancel(ctx)
+	}
+
+	return context.WithTimeout(ctx, discoveryTimeout)
+}
+
+// UPnPProvider asks the Internet gateway device of the local network, found
+// with SSDP, for its external IPv4 address over UPnP.
+type UPnPProvider struct{}
+
+// String returns "upnp://".
+func (p *UPnPProvider) String() string {
+	return "upnp://"
+}
+
+// upnpTargets are the search targets of the gateways, from the most recent
+// version.
+var upnpTargets = []string{
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:2",
+	"urn:schemas-upnp-org:device:InternetGatewayDevice:1",
+}
+
+// upnpServices are the types of the services able to tell the external
+// address, without their version.
+var upnpServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:",
+	"urn:schemas-upnp-org:service:WANPPPConnection:",
+}
+
+// PublicIP returns the external address of the first gateway that replies
+// to the discovery.
+func (p *UPnPProvider) PublicIP(ctx context.Context) (net.IP, error) {
+	ctx, cancel := withDiscoveryTimeout(ctx)
+	defer cancel()
+
+	location, err := discoverGateway(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	debugf("Found the UPnP gateway at %s", location)
+
+	controlURL, serviceType, err := gatewayService(ctx, location)
+	if err != nil {
+		return nil, err
+	}
+
+	return externalIPAddress(ctx, controlURL, serviceType)
+}
+
+// discoverGateway multicasts an SSDP search for the gateways and returns the
+// location of the description of the first one to answer.
+func discoverGateway(ctx context.Context) (string, error) {
+	conn, err := net.ListenPacket("udp4", ":0")
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	stop := make(chan struct{})
+	defer close(stop)
+
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	ssdp := &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+	for _, target := range upnpTargets {
+		msg := "M-SEARCH * HTTP/1.1\r\n" +
+			"HOST: 239.255.255.250:1900\r\n" +
+			"MAN: \"ssdp:discover\"\r\n" +
+			"MX: 2\r\n" +
+			"ST: " + target + "\r\n\r\n"
+
+		if _, err := conn.WriteTo([]byte(msg), ssdp); err != nil {
+			return "", fmt.Errorf("could not send the SSDP search: %v", err)
+		}
+	}
+
+	buf := make([]byte, 2048)
+
+	for {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded) {
+				return "", errors.New("no UPnP gateway answered")
+			}
+
+			return "", err
+		}
+
+		res, err := http.ReadResponse(bufio.NewReader(bytes.NewReader(buf[:n])), nil)
+		if err != nil {
+			continue
+		}
+
+		if location := res.Header.Get("Location"); location != "" {
+			return location, nil
+		}
+	}
+}
+
+// upnpDevice is a device of the description of a gateway, with its embedded
+// devices.
+type upnpDevice struct {
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+	Devices []upnpDevice `xml:"deviceList>device"`
+}
+
+// find returns the first service of d or its embedded devices whose type
+// starts with one of types.
+func (d *upnpDevice) find(types []string) (controlURL string, serviceType string) {
+	for _, s := range d.Services {
+		for _, t := range types {
+			if strings.HasPrefix(s.ServiceType, t) {
+				return s.ControlURL, s.ServiceType
+			}
+		}
+	}
+
+	for i := range d.Devices {
+		if controlURL, serviceType = d.Devices[i].find(types); controlURL != "" {
+			return controlURL, serviceType
+		}
+	}
+
+	return "", ""
+}
+
+// gatewayService reads the description of the gateway at location and
+// returns the control URL and the type of its WAN connection service.
+func gatewayService(ctx context.Context, location string) (string, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return "", "", err
+	}
+
+	res, err := gatewayClient.Do(req)
+	if err != nil {
+		return "", "", err
+	}
+	defer res.Body.Close()
+
+	debugf("GET %s: %s", location, res.Status)
+
+	if res.StatusCode != http.StatusOK {
+		return "", "", &StatusError{Server: "the gateway", Status: res.Status, Code: res.StatusCode}
+	}
+
+	var desc struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+
+	if err := xml.NewDecoder(res.Body).Decode(&desc); err != nil {
+		return "", "", fmt.Errorf("could not decode the description of the gateway: %v", err)
+	}
+
+	controlURL, serviceType := desc.Device.find(upnpServices)
+	if controlURL == "" {
+		return "", "", errors.New("the gateway has no WAN connection service")
+	}
+
+	base := location
+	if desc.URLBase != "" {
+		base = desc.URLBase
+	}
+
+	u, err := url.Parse(base)
+	if err != nil {
+		return "", "", err
+	}
+
+	ref, err := url.Parse(controlURL)
+	if err != nil {
+		return "", "", err
+	}
+
+	return u.ResolveReference(ref).String(), serviceType, nil
+}
+
+// externalIPAddress calls the GetExternalIPAddress action of the service at
+// controlURL.
+func externalIPAddress(ctx context.Context, controlURL, serviceType string) (net.IP, error) {
+	body := `<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body><u:GetExternalIPAddress xmlns:u="` + serviceType + `"/></s:Body>` +
+		`</s:Envelope>`
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, controlURL, strings.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", `"`+serviceType+`#GetExternalIPAddress"`)
+
+	res, err := gatewayClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	debugf("POST %s: %s", controlURL, res.Status)
+
+	if res.StatusCode != http.StatusOK {
+		return nil, &StatusError{Server: "the gateway", Status: res.Status, Code: res.StatusCode}
+	}
+
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, fmt.Errorf("could not read the response: %v", err)
+	}
+
+	d := xml.NewDecoder(bytes.NewReader(b))
+
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			return nil, errors.New("no NewExternalIPAddress in the response of the gateway")
+		}
+
+		if se, ok := tok.(xml.StartElement); ok && se.Name.Local == "NewExternalIPAddress" {
+			var s string
+
+			if err := d.DecodeElement(&s, &se); err != nil {
+				return nil, fmt.Errorf("could not decode the response of the gateway: %v", err)
+			}
+
+			return parseIP(s)
+		}
+	}
+}
+
+// NATPMPProvider asks the gateway for its external IPv4 address over NAT-PMP
+// (RFC 6886). The gateway is the default route of the host if Gateway is
+// empty.
+type NATPMPProvider struct {
+	// Gateway is the address of the gateway, without port.
+	Gateway string
+}
+
+// String returns the gateway, as natpmp://gateway.
+func (p *NATPMPProvider) String() string {
+	return "natpmp://" + p.Gateway
+}
+
+// natpmpResults describes the result codes of NAT-PMP.
+var natpmpResults = map[uint16]string{
+	1: "unsupported version",
+	2: "not authorized",
+	3: "network failure",
+	4: "out of resources",
+	5: "unsupported opcode",
+}
+
+// PublicIP returns the external address the gateway replies.
+func (p *NATPMPProvider) PublicIP(ctx context.Context) (net.IP, error) {
+	ctx, cancel := withDiscoveryTimeout(ctx)
+	defer cancel()
+
+	gateway := p.Gateway
+
+	if gateway == "" {
+		ip, err := defaultGateway()
+		if err != nil {
+			return nil, err
+		}
+
+		gateway = ip.String()
+	}
+
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "udp4", net.JoinHostPort(gateway, "5351"))
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	buf := make([]byte, 16)
+
+	// The request is sent again after 250ms, then twice as long each time,
+	// as the RFC recommends.
+	for wait := 250 * time.Millisecond; ; wait *= 2 {
+		if _, err := conn.Write([]byte{0, 0}); err != nil {
+			return nil, err
+		}
+
+		readDeadline := time.Now().Add(wait)
+		if deadline, _ := ctx.Deadline(); deadline.Before(readDeadline) {
+			readDeadline = deadline
+		}
+
+		conn.SetReadDeadline(readDeadline)
+
+		n, err := conn.Read(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("no NAT-PMP answer from %s", gateway)
+			}
+
+			if errors.Is(err, os.ErrDeadlineExceeded) {
+				continue
+			}
+
+			return nil, err
+		}
+
+		if n < 12 || buf[0] != 0 || buf[1] != 128 {
+			continue
+		}
+
+		if code := binary.BigEndian.Uint16(buf[2:4]); code != 0 {
+			if msg, ok := natpmpResults[code]; ok {
+				return nil, fmt.Errorf("the gateway answered: %s", msg)
+			}
+
+			return nil, fmt.Errorf("the gateway answered with the result code %d", code)
+		}
+
+		return net.IPv4(buf[8], buf[9], buf[10], buf[11]), nil
+	}
+}
+
+// defaultGateway returns the gateway of the default IPv4 route, as listed in
+// /proc/net/route.
+func defaultGateway() (net.IP, error) {
+	b, err := ioutil.ReadFile("/proc/net/route")
+	if err != nil {
+		return nil, fmt.Errorf("could not find the default gateway: %v", err)
+	}
+
+	for _, line := range strings.Split(string(b), "\n")[1:] {
+		fields := strings.Fields(line)
+
+		// The destination and the gateway are little-endian hexadecimal
+		// addresses.
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+
+		gw, err := hex.DecodeString(fields[2])
+		if err != nil || len(gw) != 4 || fields[2] == "00000000" {
+			continue
+		}
+
+		return net.IPv4(gw[3], gw[2], gw[1], gw[0]), nil
+	}
+
+	return nil, errors.New("could not find the default gateway")
+}
@@ -0,0 +1,11 @@
+package dynhost
+
+// Debugf, if not nil, receives the debug messages of the package, such as the
+// HTTP requests and the CNAME hops followed.
+var Debugf func(format string, v ...interface{})
+
+func debugf(format string, v ...interface{}) {
+	if Debugf != nil {
+		Debugf(format, v...)
+	}
+}
@@ -0,0 +1,348 @@
+package dynhost
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// maxCNAMEHops bounds the length of the CNAME chains followed by
+// followCNAMEs.
+const maxCNAMEHops = 8
+
+// NoRecordError is returned when the hostname exists, but has no record of
+// the family yet: it needs to be created rather than updated.
+type NoRecordError struct {
+	// Family is the family of the missing record.
+	Family Family
+}
+
+// Error names the type of the missing record.
+func (e *NoRecordError) Error() string {
+	return fmt.Sprintf("no %s record", e.Family.RecordType())
+}
+
+// CurrentRecord returns the first address of the family hostname resolves to
+// through r, after following its CNAME chain. Use CurrentRecords for the
+// hostnames with several A or AAAA records.
+func CurrentRecord(ctx context.Context, r *net.Resolver, hostname string, family Family) (net.IP, error) {
+	ips, err := CurrentRecords(ctx, r, hostname, family)
+	if err != nil {
+		return nil, err
+	}
+
+	return ips[0], nil
+}
+
+// CurrentRecords returns all the addresses of the family hostname resolves to
+// through r, after following its CNAME chain, for hostnames with several A or
+// AAAA records.
+func CurrentRecords(ctx context.Context, r *net.Resolver, hostname string, family Family) ([]net.IP, error) {
+	name, err := followCNAMEs(ctx, r, hostname)
+	if err != nil {
+		return nil, deadlineError(ctx, err)
+	}
+
+	addrs, err := r.LookupIP(ctx, family.Network(), name)
+	if err != nil {
+		// The resolver does not tell a missing record from a missing
+		// name.
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound && nameExists(ctx, r, name) {
+			return nil, &NoRecordError{family}
+		}
+
+		return nil, deadlineError(ctx, err)
+	}
+
+	var ips []net.IP
+
+	for _, a := range addrs {
+		if family.Matches(a) {
+			ips = append(ips, a)
+		}
+	}
+
+	if len(ips) == 0 {
+		return nil, &NoRecordError{family}
+	}
+
+	return ips, nil
+}
+
+// nameExists reports whether name exists, i.e. whether the nameserver r
+// dials does not reply NXDOMAIN to a query of its SOA record.
+func nameExists(ctx context.Context, r *net.Resolver, name string) bool {
+	_, err := lookup(ctx, r, name, dnsmessage.TypeSOA)
+	return err == nil
+}
+
+// CurrentRecordTTL is like CurrentRecord, but also returns the TTL of the
+// record. The nameserver r dials is queried directly.
+func CurrentRecordTTL(ctx context.Context, r *net.Resolver, hostname string, family Family) (net.IP, time.Duration, error) {
+	ips, ttl, err := CurrentRecordsTTL(ctx, r, hostname, family)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return ips[0], ttl, nil
+}
+
+// CurrentRecordsTTL is like CurrentRecords, but also returns the lowest TTL
+// of the records. The nameserver r dials is queried directly.
+func CurrentRecordsTTL(ctx context.Context, r *net.Resolver, hostname string, family Family) ([]net.IP, time.Duration, error) {
+	name, err := followCNAMEs(ctx, r, hostname)
+	if err != nil {
+		return nil, 0, deadlineError(ctx, err)
+	}
+
+	qtype := dnsmessage.TypeA
+	if family == IPv6 {
+		qtype = dnsmessage.TypeAAAA
+	}
+
+	answers, err := lookup(ctx, r, name, qtype)
+	if err != nil {
+		return nil, 0, deadlineError(ctx, err)
+	}
+
+	var (
+		ips []net.IP
+		ttl time.Duration
+	)
+
+	for _, a := range answers {
+		var ip net.IP
+
+		switch rr := a.Body.(type) {
+		case *dnsmessage.AResource:
+			ip = net.IP(append([]byte{}, rr.A[:]...))
+		case *dnsmessage.AAAAResource:
+			ip = net.IP(append([]byte{}, rr.AAAA[:]...))
+		}
+
+		if ip == nil || !family.Matches(ip) {
+			continue
+		}
+
+		if t := time.Duration(a.Header.TTL) * time.Second; len(ips) == 0 || t < ttl {
+			ttl = t
+		}
+
+		ips = append(ips, ip)
+	}
+
+	if len(ips) == 0 {
+		return nil, 0, &NoRecordError{family}
+	}
+
+	return ips, ttl, nil
+}
+
+// followCNAMEs resolves the CNAME chain starting at hostname one hop at a
+// time, and returns the name at its end. Errors name the hop that failed.
+// Without a configured resolver, the system one resolves the whole chain at
+// once instead.
+func followCNAMEs(ctx context.Context, r *net.Resolver, hostname string) (string, error) {
+	if r.Dial == nil {
+		return systemCNAME(ctx, r, hostname)
+	}
+
+	name := hostname
+	seen := map[string]bool{strings.ToLower(fqdn(name)): true}
+
+	for hop := 1; ; hop++ {
+		target, err := lookupCNAME(ctx, r, name)
+		if err != nil {
+			return "", fmt.Errorf("CNAME hop %d (%s): %v", hop, name, err)
+		}
+
+		if target == "" {
+			return name, nil
+		}
+
+		debugf("CNAME hop %d: %s -> %s", hop, name, target)
+
+		key := strings.ToLower(target)
+
+		if seen[key] {
+			return "", fmt.Errorf("CNAME hop %d (%s): loop back to %s", hop, name, target)
+		}
+
+		if hop == maxCNAMEHops {
+			return "", fmt.Errorf("CNAME hop %d (%s): chain longer than %d hops", hop, name, maxCNAMEHops)
+		}
+
+		seen[key] = true
+		name = target
+	}
+}
+
+// systemCNAME returns the name at the end of the CNAME chain starting at
+// hostname, as resolved by the system resolver r, or hostname itself if it
+// has no record at all: the lookup of its addresses then reports it.
+func systemCNAME(ctx context.Context, r *net.Resolver, hostname string) (string, error) {
+	target, err := r.LookupCNAME(ctx, hostname)
+	if err != nil {
+		var dnsErr *net.DNSError
+		if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+			return hostname, nil
+		}
+
+		return "", fmt.Errorf("CNAME chain of %s: %v", hostname, err)
+	}
+
+	if !strings.EqualFold(fqdn(target), fqdn(hostname)) {
+		debugf("CNAME chain: %s -> %s", hostname, target)
+	}
+
+	return target, nil
+}
+
+// CurrentTXTRecord returns the address of the family stored in the TXT record
+// of name, for hostnames whose A or AAAA record does not hold the DynHost
+// value (e.g. because they are fronted by a CDN).
+func CurrentTXTRecord(ctx context.Context, r *net.Resolver, name string, family Family) (net.IP, error) {
+	records, err := r.LookupTXT(ctx, name)
+	if err != nil {
+		return nil, deadlineError(ctx, err)
+	}
+
+	return ipFromTXT(records, family)
+}
+
+// CurrentTXTRecordTTL is like CurrentTXTRecord, but also returns the TTL of
+// the record. The nameserver r dials is queried directly.
+func CurrentTXTRecordTTL(ctx context.Context, r *net.Resolver, name string, family Family) (net.IP, time.Duration, error) {
+	answers, err := lookup(ctx, r, name, dnsmessage.TypeTXT)
+	if err != nil {
+		return nil, 0, deadlineError(ctx, err)
+	}
+
+	var records []string
+
+	for _, a := range answers {
+		rr, ok := a.Body.(*dnsmessage.TXTResource)
+		if !ok {
+			continue
+		}
+
+		if ip, err := ipFromTXT(rr.TXT, family); err == nil {
+			return ip, time.Duration(a.Header.TTL) * time.Second, nil
+		}
+
+		records = append(records, rr.TXT...)
+	}
+
+	return nil, 0, fmt.Errorf("no %s address in the TXT records %q", family, records)
+}
+
+// ipFromTXT returns the first address of the family found in the TXT records.
+// Records that do not hold such an address are ignored.
+func ipFromTXT(records []string, family Family) (net.IP, error) {
+	for _, rec := range records {
+		ip := net.ParseIP(strings.Trim(strings.TrimSpace(rec), `"`))
+		if ip != nil && family.Matches(ip) {
+			return ip, nil
+		}
+	}
+
+	return nil, fmt.Errorf("no %s address in the TXT records %q", family, records)
+}
+
+// AuthoritativeResolver returns a resolver sending its queries to a
+// nameserver authoritative for the zone of hostname, bypassing any cache.
+// The zone is found by looking up NS records through r, from hostname up to
+// its top-level domain.
+func AuthoritativeResolver(ctx context.Context, r *net.Resolver, hostname string) (*net.Resolver, error) {
+	labels := strings.Split(strings.TrimSuffix(hostname, "."), ".")
+
+	for i := 0; i < len(labels)-1; i++ {
+		zone := strings.Join(labels[i:], ".")
+
+		nss, err := r.LookupNS(ctx, zone)
+		if err != nil || len(nss) == 0 {
+			continue
+		}
+
+		return NewResolver(net.JoinHostPort(nss[0].Host, "53")), nil
+	}
+
+	return nil, fmt.Errorf("no NS record found for %s or its parent domains", hostname)
+}
+
+// deadlineError returns the error of ctx if it is done, so that lookups
+// interrupted by the deadline report it rather than a resolver failure, or err
+// otherwise.
+func deadlineError(ctx context.Context, err error) error {
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return fmt.Errorf("DNS lookup interrupted: %w", ctxErr)
+	}
+
+	// Connection deadlines set from the context may expire slightly before
+	// the context itself.
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return fmt.Errorf("DNS lookup interrupted: %w", context.DeadlineExceeded)
+	}
+
+	return err
+}
+
+// NewResolver returns a resolver sending all its queries to the DNS server at
+// address.
+func NewResolver(address string) *net.Resolver {
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// NewTLSResolver returns a resolver sending all its queries to the
+// DNS-over-TLS server at address (RFC 7858), whose certificate must be valid
+// for its host.
+func NewTLSResolver(address string) *net.Resolver {
+	return newTLSResolver(address, nil)
+}
+
+// newTLSResolver is NewTLSResolver, trusting the certificates issued by roots
+// rather than by the authorities of the system if it is not nil.
+func newTLSResolver(address string, roots *x509.CertPool) *net.Resolver {
+	host, _, _ := net.SplitHostPort(address)
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+
+			conn, err := d.DialContext(ctx, "tcp", address)
+			if err != nil {
+				return nil, err
+			}
+
+			if deadline, ok := ctx.Deadline(); ok {
+				conn.SetDeadline(deadline)
+			}
+
+			// Being a stream, the connection carries the queries with
+			// the TCP message framing, as DNS-over-TLS requires.
+			tlsConn := tls.Client(conn, &tls.Config{ServerName: host, RootCAs: roots, MinVersion: tls.VersionTLS12})
+
+			if err := tlsConn.Handshake(); err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("TLS handshake with the DNS-over-TLS server %s failed: %v", address, err)
+			}
+
+			return tlsConn, nil
+		},
+	}
+}
@@ -0,0 +1,400 @@
+package dynhost
+
+import (
+	"context"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+func TestCurrentRecordsResolver(t *testing.T) {
+	// The name only exists on the stub, as a split-horizon name would.
+	stub := dnsStub{zone: zone([]dnsmessage.Resource{
+		aRecord("home.dynhost.test", "203.0.113.7", 300),
+	})}
+	stub.start(t)
+
+	ips, err := CurrentRecords(context.Background(), NewResolver(stub.addr), "home.dynhost.test", IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ips) != 1 || ips[0].String() != "203.0.113.7" {
+		t.Fatalf("got %v, expected [203.0.113.7]", ips)
+	}
+
+	found := false
+
+	for _, q := range stub.received() {
+		found = found || q == "udp TypeA home.dynhost.test."
+	}
+
+	if !found {
+		t.Fatalf("the stub did not receive the A query, only %q", stub.received())
+	}
+}
+
+func TestFollowCNAMEs(t *testing.T) {
+	records := []dnsmessage.Resource{
+		cnameRecord("www.dynhost.test", "edge.dynhost.test"),
+		cnameRecord("edge.dynhost.test", "home.dynhost.test"),
+		aRecord("home.dynhost.test", "203.0.113.7", 300),
+		cnameRecord("dangling.dynhost.test", "edge2.dynhost.test"),
+		cnameRecord("edge2.dynhost.test", "missing.dynhost.test"),
+		cnameRecord("loop1.dynhost.test", "loop2.dynhost.test"),
+		cnameRecord("loop2.dynhost.test", "loop1.dynhost.test"),
+	}
+
+	for i := 0; i < maxCNAMEHops; i++ {
+		records = append(records, cnameRecord(fmt.Sprintf("long%d.dynhost.test", i), fmt.Sprintf("long%d.dynhost.test", i+1)))
+	}
+
+	stub := dnsStub{zone: zone(records)}
+	stub.start(t)
+
+	r := NewResolver(stub.addr)
+
+	tests := []struct {
+		hostname string
+		ip       string
+		err      string
+	}{
+		{hostname: "home.dynhost.test", ip: "203.0.113.7"},
+		{hostname: "www.dynhost.test", ip: "203.0.113.7"},
+		{hostname: "dangling.dynhost.test", err: "CNAME hop 3 (missing.dynhost.test.): no such host"},
+		{hostname: "loop1.dynhost.test", err: "CNAME hop 2 (loop2.dynhost.test.): loop back to loop1.dynhost.test."},
+		{hostname: "long0.dynhost.test", err: "CNAME hop 8 (long7.dynhost.test.): chain longer than 8 hops"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			ips, err := CurrentRecords(context.Background(), r, tt.hostname, IPv4)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error containing %q, got %v (%v)", tt.err, err, ips)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(ips) != 1 || ips[0].String() != tt.ip {
+				t.Fatalf("got %v, expected [%s]", ips, tt.ip)
+			}
+		})
+	}
+}
+
+func TestExchangeTruncated(t *testing.T) {
+	stub := dnsStub{
+		zone:     zone([]dnsmessage.Resource{aRecord("home.dynhost.test", "203.0.113.7", 300)}),
+		truncate: true,
+	}
+	stub.start(t)
+
+	ips, ttl, err := CurrentRecordsTTL(context.Background(), NewResolver(stub.addr), "home.dynhost.test", IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(ips) != 1 || ips[0].String() != "203.0.113.7" || ttl != 300*time.Second {
+		t.Fatalf("got %v with a TTL of %v, expected [203.0.113.7] with a TTL of 5m0s", ips, ttl)
+	}
+
+	found := false
+
+	for _, q := range stub.received() {
+		found = found || q == "tcp TypeA home.dynhost.test."
+	}
+
+	if !found {
+		t.Fatalf("the query was not retried over TCP: %q", stub.received())
+	}
+}
+
+func TestSystemNameserver(t *testing.T) {
+	defer func(path string) { resolvConf = path }(resolvConf)
+
+	dir := t.TempDir()
+
+	resolvConf = filepath.Join(dir, "missing")
+
+	if server, err := systemNameserver(); err == nil {
+		t.Fatalf("got %s without a resolv.conf", server)
+	}
+
+	resolvConf = filepath.Join(dir, "resolv.conf")
+
+	if err := ioutil.WriteFile(resolvConf, []byte("search example.com\nnameserver 192.0.2.53\nnameserver 192.0.2.54\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := systemNameserver()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server != "192.0.2.53:53" {
+		t.Fatalf("got %s, expected 192.0.2.53:53", server)
+	}
+
+	if err := ioutil.WriteFile(resolvConf, []byte("search example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if server, err := systemNameserver(); err == nil {
+		t.Fatalf("got %s without a nameserver in resolv.conf", server)
+	}
+}
+
+func TestCurrentRecordsDeadline(t *testing.T) {
+	stub := dnsStub{
+		zone:  zone([]dnsmessage.Resource{aRecord("home.dynhost.test", "203.0.113.7", 300)}),
+		delay: 2 * time.Second,
+	}
+	stub.start(t)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+
+	_, err := CurrentRecords(ctx, NewResolver(stub.addr), "home.dynhost.test", IPv4)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a deadline error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the lookup returned after %v, expected about 100ms", elapsed)
+	}
+}
+
+func TestCurrentRecordsMultiple(t *testing.T) {
+	stub := dnsStub{zone: zone([]dnsmessage.Resource{
+		aRecord("single.dynhost.test", "203.0.113.7", 300),
+		aRecord("multiple.dynhost.test", "203.0.113.7", 300),
+		aRecord("multiple.dynhost.test", "198.51.100.1", 60),
+		aaaaRecord("multiple.dynhost.test", "2001:db8::7", 30),
+	})}
+	stub.start(t)
+
+	tests := []struct {
+		hostname string
+		ips      []string
+		ttl      time.Duration
+	}{
+		{hostname: "single.dynhost.test", ips: []string{"203.0.113.7"}, ttl: 300 * time.Second},
+		// The TTL of the AAAA record is not the TTL of the A records.
+		{hostname: "multiple.dynhost.test", ips: []string{"203.0.113.7", "198.51.100.1"}, ttl: 60 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.hostname, func(t *testing.T) {
+			r := NewResolver(stub.addr)
+
+			ips, err := CurrentRecords(context.Background(), r, tt.hostname, IPv4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fmt.Sprint(ips); got != fmt.Sprint(tt.ips) {
+				t.Fatalf("CurrentRecords returned %s, expected %v", got, tt.ips)
+			}
+
+			ips, ttl, err := CurrentRecordsTTL(context.Background(), r, tt.hostname, IPv4)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fmt.Sprint(ips); got != fmt.Sprint(tt.ips) || ttl != tt.ttl {
+				t.Fatalf("CurrentRecordsTTL returned %s and %v, expected %v and %v", got, ttl, tt.ips, tt.ttl)
+			}
+		})
+	}
+}
+
+func TestCurrentRecord(t *testing.T) {
+	stub := dnsStub{zone: zone([]dnsmessage.Resource{
+		aRecord("home.dynhost.test", "203.0.113.7", 300),
+		aRecord("home.dynhost.test", "198.51.100.1", 60),
+	}, "empty.dynhost.test")}
+	stub.start(t)
+
+	r := NewResolver(stub.addr)
+
+	// The first of the records is returned, with the lowest of the TTLs.
+	ip, err := CurrentRecord(context.Background(), r, "home.dynhost.test", IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ip.Equal(net.ParseIP("203.0.113.7")) {
+		t.Fatalf("CurrentRecord returned %v, expected 203.0.113.7", ip)
+	}
+
+	ip, ttl, err := CurrentRecordTTL(context.Background(), r, "home.dynhost.test", IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !ip.Equal(net.ParseIP("203.0.113.7")) || ttl != 60*time.Second {
+		t.Fatalf("CurrentRecordTTL returned %v and %v, expected 203.0.113.7 and 1m0s", ip, ttl)
+	}
+
+	var noRecord *NoRecordError
+
+	if _, err := CurrentRecord(context.Background(), r, "empty.dynhost.test", IPv4); !errors.As(err, &noRecord) {
+		t.Fatalf("CurrentRecord returned %v, expected a NoRecordError", err)
+	}
+
+	if _, _, err := CurrentRecordTTL(context.Background(), r, "empty.dynhost.test", IPv4); !errors.As(err, &noRecord) {
+		t.Fatalf("CurrentRecordTTL returned %v, expected a NoRecordError", err)
+	}
+}
+
+func TestTLSResolver(t *testing.T) {
+	// The certificate of the test servers is valid for 127.0.0.1.
+	srv := httptest.NewTLSServer(http.NotFoundHandler())
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+
+	records := []dnsmessage.Resource{aRecord("home.dynhost.test", "203.0.113.7", 300)}
+
+	dot := dnsStub{zone: zone(records), tls: srv.TLS}
+	dot.start(t)
+
+	// closing closes the connections without a handshake.
+	closing, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closing.Close()
+
+	go func() {
+		for {
+			conn, err := closing.Accept()
+			if err != nil {
+				return
+			}
+
+			conn.Close()
+		}
+	}()
+
+	t.Run("trusted", func(t *testing.T) {
+		ips, err := CurrentRecords(context.Background(), newTLSResolver(dot.addr, roots), "home.dynhost.test", IPv4)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(ips) != 1 || ips[0].String() != "203.0.113.7" {
+			t.Fatalf("got %v, expected [203.0.113.7]", ips)
+		}
+
+		for _, q := range dot.received() {
+			if !strings.HasPrefix(q, "tcp ") {
+				t.Fatalf("the stub received the query %q outside of TLS", q)
+			}
+		}
+	})
+
+	tests := []struct {
+		name string
+		r    *net.Resolver
+	}{
+		{name: "untrusted certificate", r: NewTLSResolver(dot.addr)},
+		{name: "closed connection", r: newTLSResolver(closing.Addr().String(), roots)},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, err := CurrentRecords(ctx, tt.r, "home.dynhost.test", IPv4)
+			if err == nil || !strings.Contains(err.Error(), "TLS handshake with the DNS-over-TLS server") {
+				t.Fatalf("expected a handshake failure, got %v", err)
+			}
+		})
+	}
+}
+
+func TestCurrentRecordsMissing(t *testing.T) {
+	stub := dnsStub{zone: zone([]dnsmessage.Resource{
+		aRecord("ipv4.dynhost.test", "203.0.113.7", 300),
+		aaaaRecord("ipv6.dynhost.test", "2001:db8::7", 300),
+	})}
+	stub.start(t)
+
+	tests := []struct {
+		name     string
+		hostname string
+		family   Family
+		expected string
+		missing  bool
+	}{
+		{name: "A only, A", hostname: "ipv4.dynhost.test", family: IPv4, expected: "203.0.113.7"},
+		{name: "A only, AAAA", hostname: "ipv4.dynhost.test", family: IPv6, missing: true},
+		{name: "AAAA only, AAAA", hostname: "ipv6.dynhost.test", family: IPv6, expected: "2001:db8::7"},
+		{name: "AAAA only, A", hostname: "ipv6.dynhost.test", family: IPv4, missing: true},
+		{name: "NXDOMAIN", hostname: "missing.dynhost.test", family: IPv4},
+	}
+
+	lookups := map[string]func(ctx context.Context, r *net.Resolver, hostname string, family Family) ([]net.IP, error){
+		"CurrentRecords": CurrentRecords,
+		"CurrentRecordsTTL": func(ctx context.Context, r *net.Resolver, hostname string, family Family) ([]net.IP, error) {
+			ips, _, err := CurrentRecordsTTL(ctx, r, hostname, family)
+			return ips, err
+		},
+	}
+
+	for name, lookup := range lookups {
+		for _, tt := range tests {
+			t.Run(name+"/"+tt.name, func(t *testing.T) {
+				ips, err := lookup(context.Background(), NewResolver(stub.addr), tt.hostname, tt.family)
+
+				if tt.expected != "" {
+					if err != nil {
+						t.Fatal(err)
+					}
+
+					if len(ips) != 1 || ips[0].String() != tt.expected {
+						t.Fatalf("got %v, expected [%s]", ips, tt.expected)
+					}
+
+					return
+				}
+
+				if err == nil {
+					t.Fatalf("got %v for a missing record", ips)
+				}
+
+				// A missing name is not a record to create.
+				var noRecord *NoRecordError
+				if errors.As(err, &noRecord) != tt.missing {
+					t.Fatalf("unexpected error %v", err)
+				}
+
+				if tt.missing && noRecord.Family != tt.family {
+					t.Fatalf("the %s record is missing, expected the %s one", noRecord.Family.RecordType(), tt.family.RecordType())
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,271 @@
+package dynhost
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// OVHAPIEndpoint is the default endpoint of the updates of the OVH DynHost
+// records. Updater.Endpoint overrides it, e.g. for the regional endpoints.
+const OVHAPIEndpoint = "https://www.ovh.com/nic/update"
+
+// Sentinel errors matching, through errors.Is, the OVHError returned for each
+// documented failure response of the DynHost protocol.
+var (
+	ErrBadAuth     = errors.New("invalid username or password")
+	ErrNotFQDN     = errors.New("the hostname is not a fully-qualified domain name")
+	ErrNoHost      = errors.New("the hostname does not exist or is not a DynHost")
+	ErrNumHost     = errors.New("too many hostnames in the request")
+	ErrAbuse       = errors.New("the hostname is blocked for abuse")
+	ErrBadAgent    = errors.New("the user agent is blocked")
+	ErrDNSError    = errors.New("the server could not update the DNS")
+	ErrServerError = errors.New("the server had a problem, try again later")
+)
+
+var responseErrors = map[string]error{
+	"badauth":  ErrBadAuth,
+	"notfqdn":  ErrNotFQDN,
+	"nohost":   ErrNoHost,
+	"numhost":  ErrNumHost,
+	"abuse":    ErrAbuse,
+	"badagent": ErrBadAgent,
+	"dnserr":   ErrDNSError,
+	"911":      ErrServerError,
+}
+
+// OVHError is returned when the DynHost API, or the API of another DynDNS v2
+// provider, rejects an update with one of the documented protocol responses.
+type OVHError struct {
+	// Provider is the name of the provider that replied, such as "ovh".
+	Provider string
+
+	// Code is the response code, such as "badauth" or "911".
+	Code string
+}
+
+// Error describes the response code.
+func (e *OVHError) Error() string {
+	return fmt.Sprintf("the %s API replied %s: %v", e.Provider, e.Code, responseErrors[e.Code])
+}
+
+// Is reports whether target is the sentinel error of the response code.
+func (e *OVHError) Is(target error) bool {
+	return responseErrors[e.Code] == target
+}
+
+// StatusError is returned when a server replies with an unexpected HTTP
+// status.
+type StatusError struct {
+	// Server describes the server, such as "the ovh API".
+	Server string
+
+	// Status is the status line, such as "401 Unauthorized".
+	Status string
+
+	// Code is the status code, such as 401.
+	Code int
+}
+
+// Error describes the server and the status it replied.
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s replied %s", e.Server, e.Status)
+}
+
+// Parameters are the names of the parameters of the update requests in the
+// protocol, which Updater.Params may rename.
+var Parameters = []string{"system", "hostname", "myip", "myip6"}
+
+// Updater updates records through the DynDNS v2 protocol, the nic/update API
+// spoken by OVH and many other dynamic DNS providers.
+type Updater struct {
+	// Client sends the update requests.
+	Client *http.Client
+
+	// Provider is the name of the provider, such as "ovh", used in errors.
+	Provider string
+
+	// Endpoint is the URL of the nic/update API of the provider, such as
+	// OVHAPIEndpoint.
+	Endpoint string
+
+	// Username and Password are sent with HTTP basic authentication.
+	Username string
+	Password string
+
+	// UserAgent is sent in the User-Agent header, which the protocol
+	// requires to describe the client.
+	UserAgent string
+
+	// Method is GET, the default, to send the parameters in the query
+	// string, or POST to send them as a form.
+	Method string
+
+	// Params renames the parameters of the requests, from their names in
+	// the protocol, for providers using other names, such as "ip" instead
+	// of "myip". A parameter renamed to an empty string is not sent.
+	Params map[string]string
+
+	// Success matches the successful responses of providers that do not
+	// reply with the "good" and "nochg" codes of the protocol, such as "OK"
+	// or a JSON document. The codes are expected if it is nil.
+	Success *regexp.Regexp
+}
+
+// Result is the successful response of the provider to an update.
+type Result struct {
+	// Changed is false if the record already held the address ("nochg").
+	// It is true if the provider does not tell.
+	Changed bool
+
+	// Code is the response code, "good" or "nochg", or empty if the
+	// response was matched by Updater.Success.
+	Code string
+
+	// Detail is the rest of the response, usually the address.
+	Detail string
+
+	// IPs are the addresses published to the records.
+	IPs []net.IP
+}
+
+// Request returns the request Update sends to set the DynHost record of
+// hostname to addresses. A single address, of either family, is sent in the
+// myip parameter. An IPv4 and an IPv6 address are sent in the myip and myip6
+// parameters, which OVH uses to update both the A and AAAA records at once.
+func (u *Updater) Request(ctx context.Context, hostname string, addresses ...net.IP) (*http.Request, error) {
+	params := url.Values{}
+
+	add := func(name, value string) {
+		if n, ok := u.Params[name]; ok {
+			name = n
+		}
+
+		if name != "" {
+			params.Add(name, value)
+		}
+	}
+
+	add("system", "dyndns")
+	add("hostname", hostname)
+
+	switch len(addresses) {
+	case 1:
+		add("myip", addresses[0].String())
+	case 2:
+		v4, v6 := addresses[0], addresses[1]
+		if IPv6.Matches(v4) {
+			v4, v6 = v6, v4
+		}
+
+		if !IPv4.Matches(v4) || !IPv6.Matches(v6) {
+			return nil, fmt.Errorf("expected an IPv4 and an IPv6 address, got %v and %v", addresses[0], addresses[1])
+		}
+
+		add("myip", v4.String())
+		add("myip6", v6.String())
+	default:
+		return nil, fmt.Errorf("expected 1 or 2 addresses, got %d", len(addresses))
+	}
+
+	var (
+		req *http.Request
+		err error
+	)
+
+	switch u.Method {
+	case "", http.MethodGet:
+		if req, err = http.NewRequestWithContext(ctx, http.MethodGet, u.Endpoint, nil); err != nil {
+			return nil, err
+		}
+
+		q := req.URL.Query()
+		for k, v := range params {
+			q[k] = v
+		}
+
+		req.URL.RawQuery = q.Encode()
+	case http.MethodPost:
+		if req, err = http.NewRequestWithContext(ctx, http.MethodPost, u.Endpoint, strings.NewReader(params.Encode())); err != nil {
+			return nil, err
+		}
+
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	default:
+		return nil, fmt.Errorf("unsupported method %q", u.Method)
+	}
+
+	req.SetBasicAuth(u.Username, u.Password)
+	req.Header.Set("User-Agent", u.UserAgent)
+
+	return req, nil
+}
+
+// Update sets the DynHost records of hostname to addresses, as described in
+// Request. Both the "good" and "nochg" responses are successes, unless
+// Success is set: responses it does not match are then failures.
+func (u *Updater) Update(ctx context.Context, hostname string, addresses ...net.IP) (Result, error) {
+	req, err := u.Request(ctx, hostname, addresses...)
+	if err != nil {
+		return Result{}, err
+	}
+
+	debugf("%s %s (as %s)", req.Method, req.URL, u.Username)
+
+	res, err := u.Client.Do(req)
+	if err != nil {
+		return Result{}, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return Result{}, &StatusError{Server: "the " + u.Provider + " API", Status: res.Status, Code: res.StatusCode}
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return Result{}, fmt.Errorf("could not read the response body: %v", err)
+	}
+
+	body = bytes.TrimSpace(body)
+
+	debugf("Response of the %s API: %s %s", u.Provider, res.Status, body)
+
+	// Such responses do not tell whether the record already held the
+	// address.
+	if u.Success != nil && u.Success.Match(body) {
+		return Result{Changed: true, Detail: string(body), IPs: addresses}, nil
+	}
+
+	words := strings.Fields(string(body))
+	if len(words) == 0 {
+		return Result{}, errors.New("empty response body")
+	}
+
+	code := words[0]
+
+	if u.Success == nil && (code == "good" || code == "nochg") {
+		return Result{Changed: code == "good", Code: code, Detail: strings.Join(words[1:], " "), IPs: addresses}, nil
+	}
+
+	if _, ok := responseErrors[code]; ok {
+		return Result{}, &OVHError{Provider: u.Provider, Code: code}
+	}
+
+	return Result{}, fmt.Errorf("unexpected response body: %s", body)
+}
+
+// Publish is like Update, for the callers that only need to know whether the
+// update succeeded.
+func (u *Updater) Publish(ctx context.Context, hostname string, addresses ...net.IP) error {
+	_, err := u.Update(ctx, hostname, addresses...)
+	return err
+}
@@ -0,0 +1,407 @@
+package dynhost
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// fakeEndpoint returns an Updater sending its requests to a server replying
+// body to all of them.
+func fakeEndpoint(t *testing.T, body string) *Updater {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return &Updater{
+		Client:   srv.Client(),
+		Provider: "ovh",
+		Endpoint: srv.URL,
+		Username: "user",
+		Password: "secret",
+	}
+}
+
+func TestUpdateResponses(t *testing.T) {
+	tests := []struct {
+		body    string
+		ok      bool
+		changed bool
+		code    string
+		detail  string
+	}{
+		{body: "good 203.0.113.7", ok: true, changed: true, code: "good", detail: "203.0.113.7"},
+		{body: "good 203.0.113.7\n", ok: true, changed: true, code: "good", detail: "203.0.113.7"},
+		{body: "good", ok: true, changed: true, code: "good"},
+		{body: "nochg 203.0.113.7", ok: true, changed: false, code: "nochg", detail: "203.0.113.7"},
+		{body: "nochg", ok: true, changed: false, code: "nochg"},
+		{body: "badauth"},
+		{body: "notfqdn"},
+		{body: "nohost"},
+		{body: "numhost"},
+		{body: "abuse"},
+		{body: "badagent"},
+		{body: "dnserr"},
+		{body: "911"},
+		{body: "goodbye"},
+		{body: "<html>Service unavailable</html>"},
+		{body: ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%q", tt.body), func(t *testing.T) {
+			u := fakeEndpoint(t, tt.body)
+
+			res, err := u.Update(context.Background(), "home.example.com", net.ParseIP("203.0.113.7"))
+
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("the update succeeded: %+v", res)
+				}
+
+				if res.Changed || res.Code != "" || res.Detail != "" || res.IPs != nil {
+					t.Fatalf("the failed update returned %+v", res)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if res.Changed != tt.changed || res.Code != tt.code || res.Detail != tt.detail {
+				t.Fatalf("got %+v, expected Changed %v, Code %q and Detail %q", res, tt.changed, tt.code, tt.detail)
+			}
+
+			if len(res.IPs) != 1 || !res.IPs[0].Equal(net.ParseIP("203.0.113.7")) {
+				t.Fatalf("got the addresses %v, expected [203.0.113.7]", res.IPs)
+			}
+		})
+	}
+}
+
+func TestUpdateResultAddresses(t *testing.T) {
+	u := fakeEndpoint(t, "good 203.0.113.7 2001:db8::7")
+
+	res, err := u.Update(context.Background(), "home.example.com", net.ParseIP("203.0.113.7"), net.ParseIP("2001:db8::7"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fmt.Sprint(res.IPs) != "[203.0.113.7 2001:db8::7]" || res.Detail != "203.0.113.7 2001:db8::7" {
+		t.Fatalf("unexpected result %+v", res)
+	}
+}
+
+func TestPublish(t *testing.T) {
+	if err := fakeEndpoint(t, "nochg 203.0.113.7").Publish(context.Background(), "home.example.com", net.ParseIP("203.0.113.7")); err != nil {
+		t.Fatalf("expected a success, got %v", err)
+	}
+
+	err := fakeEndpoint(t, "badauth").Publish(context.Background(), "home.example.com", net.ParseIP("203.0.113.7"))
+	if !errors.Is(err, ErrBadAuth) {
+		t.Fatalf("expected ErrBadAuth, got %v", err)
+	}
+}
+
+func TestUpdateErrors(t *testing.T) {
+	tests := []struct {
+		body string
+		code string
+		err  error
+	}{
+		{body: "badauth", code: "badauth", err: ErrBadAuth},
+		{body: "notfqdn", code: "notfqdn", err: ErrNotFQDN},
+		{body: "nohost", code: "nohost", err: ErrNoHost},
+		{body: "numhost", code: "numhost", err: ErrNumHost},
+		{body: "abuse", code: "abuse", err: ErrAbuse},
+		{body: "badagent", code: "badagent", err: ErrBadAgent},
+		{body: "dnserr", code: "dnserr", err: ErrDNSError},
+		{body: "911", code: "911", err: ErrServerError},
+		{body: "911 maintenance\n", code: "911", err: ErrServerError},
+	}
+
+	sentinels := []error{ErrBadAuth, ErrNotFQDN, ErrNoHost, ErrNumHost, ErrAbuse, ErrBadAgent, ErrDNSError, ErrServerError}
+
+	for _, tt := range tests {
+		t.Run(tt.body, func(t *testing.T) {
+			u := fakeEndpoint(t, tt.body)
+
+			_, err := u.Update(context.Background(), "home.example.com", net.ParseIP("203.0.113.7"))
+
+			var ovhErr *OVHError
+			if !errors.As(err, &ovhErr) {
+				t.Fatalf("expected an OVHError, got %v", err)
+			}
+
+			if ovhErr.Code != tt.code || ovhErr.Provider != "ovh" {
+				t.Fatalf("got %+v, expected the code %s of ovh", ovhErr, tt.code)
+			}
+
+			for _, sentinel := range sentinels {
+				if is := errors.Is(err, sentinel); is != (sentinel == tt.err) {
+					t.Fatalf("errors.Is(%v, %v) = %v", err, sentinel, is)
+				}
+			}
+		})
+	}
+}
+
+func TestUpdateUnexpectedErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+	}{
+		{name: "unknown code", status: http.StatusOK, body: "whatever"},
+		{name: "empty body", status: http.StatusOK, body: ""},
+		{name: "HTTP error", status: http.StatusUnauthorized, body: "badauth"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer srv.Close()
+
+			u := Updater{Client: srv.Client(), Provider: "ovh", Endpoint: srv.URL}
+
+			_, err := u.Update(context.Background(), "home.example.com", net.ParseIP("203.0.113.7"))
+			if err == nil {
+				t.Fatal("the update succeeded")
+			}
+
+			var ovhErr *OVHError
+			if errors.As(err, &ovhErr) {
+				t.Fatalf("got the OVHError %v", err)
+			}
+
+			var statusErr *StatusError
+			if isStatus := errors.As(err, &statusErr); isStatus != (tt.status != http.StatusOK) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+
+			if statusErr != nil && statusErr.Code != tt.status {
+				t.Fatalf("got the status %d, expected %d", statusErr.Code, tt.status)
+			}
+		})
+	}
+}
+
+func TestUpdateEndpoint(t *testing.T) {
+	var received *http.Request
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received = r
+		fmt.Fprint(w, "good 203.0.113.7")
+	}))
+	defer srv.Close()
+
+	u := Updater{
+		Client:   srv.Client(),
+		Provider: "ovh",
+		Endpoint: srv.URL + "/nic/update",
+		Username: "user",
+		Password: "secret",
+	}
+
+	if _, err := u.Update(context.Background(), "home.example.com", net.ParseIP("203.0.113.7")); err != nil {
+		t.Fatal(err)
+	}
+
+	if received == nil {
+		t.Fatal("the endpoint received no request")
+	}
+
+	if received.URL.Path != "/nic/update" {
+		t.Fatalf("the request was sent to %s, expected /nic/update", received.URL.Path)
+	}
+
+	if user, password, ok := received.BasicAuth(); !ok || user != "user" || password != "secret" {
+		t.Fatalf("unexpected credentials %q and %q", user, password)
+	}
+
+	q := received.URL.Query()
+
+	if q.Get("system") != "dyndns" || q.Get("hostname") != "home.example.com" || q.Get("myip") != "203.0.113.7" {
+		t.Fatalf("unexpected query string %s", received.URL.RawQuery)
+	}
+}
+
+func TestUpdateMethod(t *testing.T) {
+	tests := []struct {
+		name     string
+		method   string
+		expected string
+	}{
+		{name: "default", expected: http.MethodGet},
+		{name: "GET", method: http.MethodGet, expected: http.MethodGet},
+		{name: "POST", method: http.MethodPost, expected: http.MethodPost},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				method      string
+				contentType string
+				query       string
+				form        url.Values
+			)
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				method, contentType, query = r.Method, r.Header.Get("Content-Type"), r.URL.RawQuery
+
+				b, _ := ioutil.ReadAll(r.Body)
+				form, _ = url.ParseQuery(string(b))
+
+				fmt.Fprint(w, "good 203.0.113.7")
+			}))
+			defer srv.Close()
+
+			u := Updater{Client: srv.Client(), Provider: "ovh", Endpoint: srv.URL + "/nic/update?token=abc", Method: tt.method}
+
+			if _, err := u.Update(context.Background(), "home.example.com", net.ParseIP("203.0.113.7")); err != nil {
+				t.Fatal(err)
+			}
+
+			if method != tt.expected {
+				t.Fatalf("the request was sent with %s, expected %s", method, tt.expected)
+			}
+
+			expected := url.Values{"system": {"dyndns"}, "hostname": {"home.example.com"}, "myip": {"203.0.113.7"}}
+
+			if tt.expected == http.MethodGet {
+				// The parameters are added to those of the endpoint.
+				expected.Set("token", "abc")
+
+				if q, _ := url.ParseQuery(query); q.Encode() != expected.Encode() {
+					t.Fatalf("unexpected query string %s, expected %s", query, expected.Encode())
+				}
+
+				if len(form) != 0 {
+					t.Fatalf("unexpected body %v", form)
+				}
+
+				return
+			}
+
+			if contentType != "application/x-www-form-urlencoded" {
+				t.Fatalf("the body was sent as %q", contentType)
+			}
+
+			if form.Encode() != expected.Encode() {
+				t.Fatalf("unexpected body %s, expected %s", form.Encode(), expected.Encode())
+			}
+
+			if query != "token=abc" {
+				t.Fatalf("unexpected query string %q", query)
+			}
+		})
+	}
+}
+
+func TestUpdateAddresses(t *testing.T) {
+	tests := []struct {
+		name      string
+		addresses []string
+		myip      string
+		myip6     string
+		err       string
+	}{
+		{name: "IPv4", addresses: []string{"203.0.113.7"}, myip: "203.0.113.7"},
+		{name: "IPv6", addresses: []string{"2001:db8::7"}, myip: "2001:db8::7"},
+		{name: "both", addresses: []string{"203.0.113.7", "2001:db8::7"}, myip: "203.0.113.7", myip6: "2001:db8::7"},
+		{name: "both, IPv6 first", addresses: []string{"2001:db8::7", "203.0.113.7"}, myip: "203.0.113.7", myip6: "2001:db8::7"},
+		{name: "two IPv4", addresses: []string{"203.0.113.7", "203.0.113.8"}, err: "expected an IPv4 and an IPv6 address"},
+		{name: "none", err: "expected 1 or 2 addresses, got 0"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var addresses []net.IP
+			for _, a := range tt.addresses {
+				addresses = append(addresses, net.ParseIP(a))
+			}
+
+			u := Updater{Provider: "ovh", Endpoint: OVHAPIEndpoint}
+
+			req, err := u.Request(context.Background(), "home.example.com", addresses...)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			q := req.URL.Query()
+
+			if q.Get("myip") != tt.myip {
+				t.Fatalf("myip=%q, expected %q", q.Get("myip"), tt.myip)
+			}
+
+			if _, ok := q["myip6"]; ok != (tt.myip6 != "") || q.Get("myip6") != tt.myip6 {
+				t.Fatalf("unexpected myip6 in %s", req.URL.RawQuery)
+			}
+		})
+	}
+}
+
+func TestUpdateSuccess(t *testing.T) {
+	tests := []struct {
+		name    string
+		success string
+		body    string
+		ok      bool
+	}{
+		{name: "match", success: `^OK$`, body: "OK\n", ok: true},
+		{name: "JSON match", success: `"status":\s*"success"`, body: `{"status": "success"}`, ok: true},
+		{name: "mismatch", success: `^OK$`, body: "KO"},
+		{name: "protocol code", success: `^OK$`, body: "good 203.0.113.7"},
+		{name: "protocol error", success: `^OK$`, body: "badauth"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			u := fakeEndpoint(t, tt.body)
+			u.Success = regexp.MustCompile(tt.success)
+
+			res, err := u.Update(context.Background(), "home.example.com", net.ParseIP("203.0.113.7"))
+
+			if !tt.ok {
+				if err == nil {
+					t.Fatalf("the response %q was a success: %+v", tt.body, res)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// The response does not tell whether the record changed.
+			if !res.Changed || res.Code != "" || res.Detail != strings.TrimSpace(tt.body) {
+				t.Fatalf("unexpected result %+v", res)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/smtp"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// smtpTimeout is the maximum time spent sending an email.
+const smtpTimeout = 30 * time.Second
+
+// emailNotifier sends emails about the changes or the failures, or both,
+// through an SMTP server. STARTTLS is used whenever the server supports it.
+type emailNotifier struct {
+	cfg SMTPConfig
+}
+
+func (n *emailNotifier) String() string {
+	return "SMTP server " + n.cfg.Host
+}
+
+func (n *emailNotifier) notifyChange(ctx context.Context, c *ipChange) error {
+	if !n.cfg.NotifyChanges {
+		return nil
+	}
+
+	oldIP := "unknown"
+	if c.OldIP != nil {
+		oldIP = c.OldIP.String()
+	}
+
+	return n.send(ctx,
+		fmt.Sprintf("%s updated to %s", recordName(c.Hostname, c.family), c.NewIP),
+		fmt.Sprintf("The %s record of %s was updated on %s.\r\n\r\nOld address: %s\r\nNew address: %s\r\n",
+			c.Type, c.Hostname, c.Time.Format(time.RFC1123Z), oldIP, c.NewIP))
+}
+
+func (n *emailNotifier) notifyFailure(ctx context.Context, f *updateFailure) error {
+	if !n.cfg.NotifyFailures {
+		return nil
+	}
+
+	return n.send(ctx,
+		fmt.Sprintf("Could not update %s", recordName(f.Hostname, f.family)),
+		fmt.Sprintf("The %s record of %s could not be updated to %s in %d consecutive cycle(s), as of %s:\r\n\r\n%v\r\n",
+			f.Type, f.Hostname, f.IP, f.Cycles, f.Time.Format(time.RFC1123Z), f.Err))
+}
+
+func (n *emailNotifier) notifyDetectionFailure(ctx context.Context, f *detectionFailure) error {
+	if !n.cfg.NotifyFailures {
+		return nil
+	}
+
+	return n.send(ctx,
+		fmt.Sprintf("Could not detect the public %s address", f.Family),
+		fmt.Sprintf("The public %s address could not be detected in %d consecutive cycle(s), as of %s:\r\n\r\n%v\r\n",
+			f.Family, f.Cycles, f.Time.Format(time.RFC1123Z), f.Err))
+}
+
+// send sends an email with the given subject and body to every recipient.
+func (n *emailNotifier) send(ctx context.Context, subject, body string) error {
+	ctx, cancel := context.WithTimeout(ctx, smtpTimeout)
+	defer cancel()
+
+	var d net.Dialer
+
+	conn, err := d.DialContext(ctx, "tcp", net.JoinHostPort(n.cfg.Host, strconv.Itoa(n.cfg.Port)))
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	c, err := smtp.NewClient(conn, n.cfg.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if hostname, err := os.Hostname(); err == nil {
+		if err := c.Hello(hostname); err != nil {
+			return err
+		}
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: n.cfg.Host}); err != nil {
+			return fmt.Errorf("STARTTLS failed: %v", err)
+		}
+	}
+
+	if n.cfg.User != "" {
+		if err := c.Auth(smtp.PlainAuth("", n.cfg.User, n.cfg.Password, n.cfg.Host)); err != nil {
+			return fmt.Errorf("authentication failed: %v", err)
+		}
+	}
+
+	if err := c.Mail(n.cfg.From); err != nil {
+		return err
+	}
+
+	for _, to := range n.cfg.To {
+		if err := c.Rcpt(to); err != nil {
+			return fmt.Errorf("recipient %s refused: %v", to, err)
+		}
+	}
+
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+
+	var msg bytes.Buffer
+
+	fmt.Fprintf(&msg, "From: %s\r\n", n.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(n.cfg.To, ", "))
+	fmt.Fprintf(&msg, "Subject: go-dynhost: %s\r\n", subject)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: text/plain; charset=utf-8\r\n\r\n")
+	msg.WriteString(body)
+
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
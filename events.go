@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// ipChange describes a record that was updated to a new address.
+type ipChange struct {
+	Hostname string    `json:"hostname"`
+	Type     string    `json:"type"`
+	OldIP    net.IP    `json:"old_ip"`
+	NewIP    net.IP    `json:"new_ip"`
+	Time     time.Time `json:"timestamp"`
+
+	family dynhost.Family
+}
+
+// updateFailure describes a record that could not be updated in Cycles
+// consecutive cycles.
+type updateFailure struct {
+	Hostname string
+	Type     string
+	IP       net.IP
+	Cycles   int
+	Err      error
+	Time     time.Time
+
+	family dynhost.Family
+}
+
+// detectionFailure describes consecutive cycles in which the public address
+// of a family could not be detected.
+type detectionFailure struct {
+	Family dynhost.Family
+	Cycles int
+	Err    error
+	Time   time.Time
+}
+
+// failureStreaks counts the consecutive cycles in which each record could not
+// be updated.
+type failureStreaks struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// failed records a failure of the record called name, and returns the length
+// of its streak of failures.
+func (f *failureStreaks) failed(name string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.counts == nil {
+		f.counts = make(map[string]int)
+	}
+
+	f.counts[name]++
+
+	return f.counts[name]
+}
+
+// reset ends the streak of failures of the record called name, which was
+// updated.
+func (f *failureStreaks) reset(name string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	delete(f.counts, name)
+}
+
+// notifier is told about the changes of the records, e.g. to trigger some
+// automation.
+type notifier interface {
+	fmt.Stringer
+
+	notifyChange(ctx context.Context, c *ipChange) error
+}
+
+// failureNotifier is a notifier that is also told about the records that
+// could not be updated, and about the public address not being detected.
+type failureNotifier interface {
+	notifier
+
+	notifyFailure(ctx context.Context, f *updateFailure) error
+	notifyDetectionFailure(ctx context.Context, f *detectionFailure) error
+}
+
+// newNotifiers returns the notifiers enabled in the configuration.
+func newNotifiers(cfg *Config, client *http.Client) []notifier {
+	var notifiers []notifier
+
+	if cfg.WebhookURL != "" {
+		notifiers = append(notifiers, &webhook{client: client, url: cfg.WebhookURL})
+	}
+
+	if e := useEventSocket(cfg.EventSocket); e != nil {
+		notifiers = append(notifiers, e)
+	}
+
+	if len(cfg.PostUpdateCommand) > 0 {
+		notifiers = append(notifiers, &commandHook{args: cfg.PostUpdateCommand, timeout: cfg.PostUpdateTimeout})
+	}
+
+	if cfg.SlackWebhookURL != "" {
+		notifiers = append(notifiers, newSlackNotifier(client, cfg.SlackWebhookURL))
+	}
+
+	if cfg.DiscordWebhookURL != "" {
+		notifiers = append(notifiers, newDiscordNotifier(client, cfg.DiscordWebhookURL))
+	}
+
+	if cfg.SMTP.Host != "" {
+		notifiers = append(notifiers, &emailNotifier{cfg: cfg.SMTP})
+	}
+
+	return notifiers
+}
+
+// notifyChange tells every notifier about c. Failures are only logged as
+// warnings, as the record itself was updated.
+func (s *syncer) notifyChange(ctx context.Context, c *ipChange) {
+	for _, n := range s.notifiers {
+		end := s.stages.begin(ctx, "notification by "+n.String())
+		err := n.notifyChange(ctx, c)
+		end()
+
+		if err != nil {
+			with(fields{"hostname": c.Hostname, "type": c.Type, "notifier": n.String()}).warnf("Could not notify %s of the change of %s: %v", n, recordName(c.Hostname, c.family), err)
+		}
+	}
+}
+
+// notifyFailure tells the notifiers interested in failures about f. Their own
+// failures are only logged.
+func (s *syncer) notifyFailure(ctx context.Context, f *updateFailure) {
+	for _, n := range s.notifiers {
+		fn, ok := n.(failureNotifier)
+		if !ok {
+			continue
+		}
+
+		end := s.stages.begin(ctx, "notification by "+n.String())
+		err := fn.notifyFailure(ctx, f)
+		end()
+
+		if err != nil {
+			with(fields{"hostname": f.Hostname, "type": f.Type, "notifier": n.String()}).warnf("Could not notify %s of the failure of %s: %v", n, recordName(f.Hostname, f.family), err)
+		}
+	}
+}
+
+// notifyDetectionFailure tells the notifiers interested in failures about f.
+// Their own failures are only logged.
+func (s *syncer) notifyDetectionFailure(ctx context.Context, f *detectionFailure) {
+	for _, n := range s.notifiers {
+		fn, ok := n.(failureNotifier)
+		if !ok {
+			continue
+		}
+
+		end := s.stages.begin(ctx, "notification by "+n.String())
+		err := fn.notifyDetectionFailure(ctx, f)
+		end()
+
+		if err != nil {
+			with(fields{"notifier": n.String()}).warnf("Could not notify %s of the %s detection failure: %v", n, f.Family, err)
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"time"
+)
+
+const (
+	// eventQueueSize is the number of events waiting to be written to the
+	// event socket, beyond which they are dropped.
+	eventQueueSize = 64
+
+	// eventSocketTimeout bounds the connection to the event socket and each
+	// write to it.
+	eventSocketTimeout = 5 * time.Second
+)
+
+// eventSocket writes the changes as JSON lines to a Unix domain socket or a
+// named pipe, for a local consumer such as a supervisor. It connects on the
+// first event and reconnects after a failure. The events are written in the
+// background, so that a slow consumer does not hold up the updates: they are
+// dropped once eventQueueSize of them are waiting.
+type eventSocket struct {
+	path    string
+	events  chan []byte
+	done    chan struct{}
+	stopped chan struct{}
+
+	// w is only used by run.
+	w io.WriteCloser
+}
+
+func newEventSocket(path string) *eventSocket {
+	e := &eventSocket{
+		path:    path,
+		events:  make(chan []byte, eventQueueSize),
+		done:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+
+	go e.run()
+
+	return e
+}
+
+func (e *eventSocket) String() string {
+	return e.path
+}
+
+func (e *eventSocket) notifyChange(ctx context.Context, c *ipChange) error {
+	line, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	select {
+	case e.events <- append(line, '\n'):
+		return nil
+	default:
+		return errors.New("the consumer is too slow; dropping the event")
+	}
+}
+
+// run writes the events until close is called, and then those still waiting.
+func (e *eventSocket) run() {
+	defer func() {
+		if e.w != nil {
+			e.w.Close()
+		}
+
+		close(e.stopped)
+	}()
+
+	for {
+		select {
+		case line := <-e.events:
+			e.write(line)
+		case <-e.done:
+			for {
+				select {
+				case line := <-e.events:
+					e.write(line)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// write writes line, reconnecting once if the connection was broken.
+func (e *eventSocket) write(line []byte) {
+	var err error
+
+	for attempt := 0; attempt < 2; attempt++ {
+		if e.w == nil {
+			if e.w, err = e.open(); err != nil {
+				break
+			}
+		}
+
+		if d, ok := e.w.(interface{ SetWriteDeadline(time.Time) error }); ok {
+			d.SetWriteDeadline(time.Now().Add(eventSocketTimeout))
+		}
+
+		if _, err = e.w.Write(line); err == nil {
+			return
+		}
+
+		e.w.Close()
+		e.w = nil
+	}
+
+	warnf("Could not write to the event socket %s: %v; dropping the event", e.path, err)
+}
+
+// open connects to the socket, or opens the named pipe, at the path. Opening
+// a named pipe waits for a reader.
+func (e *eventSocket) open() (io.WriteCloser, error) {
+	if fi, err := os.Stat(e.path); err == nil && fi.Mode()&os.ModeNamedPipe != 0 {
+		return os.OpenFile(e.path, os.O_WRONLY, 0)
+	}
+
+	return net.DialTimeout("unix", e.path, eventSocketTimeout)
+}
+
+// close stops the writing once the events waiting are written, and returns
+// when they are, or after eventSocketTimeout.
+func (e *eventSocket) close() {
+	close(e.done)
+
+	select {
+	case <-e.stopped:
+	case <-time.After(eventSocketTimeout):
+		warnf("Could not write the events waiting for the event socket %s in time", e.path)
+	}
+}
+
+// eventSink is the event socket of the configuration, kept across reloads so
+// that its connection is reused.
+var eventSink *eventSocket
+
+// useEventSocket returns the event socket at path, or nil if path is empty.
+// The current event socket is closed if its path changed.
+func useEventSocket(path string) *eventSocket {
+	if eventSink != nil && eventSink.path == path {
+		return eventSink
+	}
+
+	if eventSink != nil {
+		eventSink.close()
+		eventSink = nil
+	}
+
+	if path != "" {
+		eventSink = newEventSocket(path)
+	}
+
+	return eventSink
+}
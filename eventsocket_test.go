@@ -0,0 +1,108 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// readEvent accepts a connection from l, and returns it with the first event
+// read from it.
+func readEvent(t *testing.T, l net.Listener) (net.Conn, map[string]interface{}) {
+	t.Helper()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+
+	line, err := bufio.NewReader(conn).ReadBytes('\n')
+	if err != nil {
+		t.Fatalf("could not read an event: %v", err)
+	}
+
+	var event map[string]interface{}
+	if err := json.Unmarshal(line, &event); err != nil {
+		t.Fatalf("invalid event %q: %v", line, err)
+	}
+
+	return conn, event
+}
+
+func TestEventSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "events.sock")
+
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	l.(*net.UnixListener).SetDeadline(time.Now().Add(5 * time.Second))
+
+	t.Cleanup(func() { useEventSocket("") })
+
+	cfg := loadTestConfig(t, `
+event_socket = `+path+`
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+	d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+	r := &fakeReader{values: map[string][]net.IP{"home.example.com/A": {net.ParseIP("198.51.100.1")}}}
+
+	s := newTestSyncer(t, cfg, d, r, &fakeUpdater{})
+
+	if err := s.syncAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	conn, event := readEvent(t, l)
+
+	expected := map[string]string{
+		"hostname": "home.example.com",
+		"type":     "A",
+		"old_ip":   "198.51.100.1",
+		"new_ip":   "203.0.113.7",
+	}
+
+	for k, v := range expected {
+		if event[k] != v {
+			t.Errorf("%s is %v in the event, expected %s", k, event[k], v)
+		}
+	}
+
+	if _, err := time.Parse(time.RFC3339, event["timestamp"].(string)); err != nil {
+		t.Errorf("invalid timestamp in the event %v: %v", event, err)
+	}
+
+	// The next event is written to a new connection once the consumer
+	// closed the first one.
+	conn.Close()
+
+	d.ips[dynhost.IPv4] = net.ParseIP("203.0.113.8")
+	r.values["home.example.com/A"] = []net.IP{net.ParseIP("203.0.113.7")}
+
+	if err := s.syncAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	_, event = readEvent(t, l)
+
+	if event["old_ip"] != "203.0.113.7" || event["new_ip"] != "203.0.113.8" {
+		t.Fatalf("unexpected event %v after the reconnection", event)
+	}
+}
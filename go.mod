@@ -1,5 +1,10 @@
 module git.quba.fr/qbarrand/go-dynhost
 
-go 1.12
+go 1.18
 
-require gopkg.in/ini.v1 v1.42.0
+require (
+	github.com/BurntSushi/toml v1.3.2
+	golang.org/x/net v0.7.0
+	gopkg.in/ini.v1 v1.42.0
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,47 @@
+package main
+
+import (
+	_ "embed"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// sampleConfig is the commented example configuration, documenting every key.
+//
+//go:embed config.sample.cfg
+var sampleConfig string
+
+// writeSampleConfig writes the example configuration to path, which must not
+// exist unless overwrite is true. The file may hold credentials once filled
+// in, so only its owner can read it.
+func writeSampleConfig(path string, overwrite bool) error {
+	if path == "-" {
+		return errors.New("cannot write the example configuration to the standard input")
+	}
+
+	if configFormat(path) != formatINI {
+		return fmt.Errorf("%s: the example configuration is an INI file", path)
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if overwrite {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+
+	f, err := os.OpenFile(path, flags, 0600)
+	if os.IsExist(err) {
+		return fmt.Errorf("%s already exists; use -force to overwrite it", path)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	if _, err := f.WriteString(sampleConfig); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
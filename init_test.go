@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSampleConfig(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dynhost.cfg")
+
+	if err := writeSampleConfig(path, false); err != nil {
+		t.Fatal(err)
+	}
+
+	// Only the credentials and the hostname are left to fill in.
+	_, err := loadConfig(path, "", "")
+
+	var problems configErrors
+	if !errors.As(err, &problems) {
+		t.Fatalf("expected the problems of the provider section, got %v", err)
+	}
+
+	for _, p := range problems {
+		if msg := p.Error(); !strings.HasPrefix(msg, "[ovh]: username cannot be empty") &&
+			!strings.HasPrefix(msg, "[ovh]: password cannot be empty") &&
+			!strings.HasPrefix(msg, "[ovh]: hostname cannot be empty") {
+			t.Errorf("unexpected problem: %v", p)
+		}
+	}
+
+	if len(problems) != 3 {
+		t.Fatalf("%d problem(s), expected 3: %v", len(problems), err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(string(b), "\n")
+
+	for i, line := range lines {
+		switch line {
+		case "username=":
+			lines[i] = "username=user"
+		case "password=":
+			lines[i] = "password=secret"
+		case "hostname=":
+			lines[i] = "hostname=home.example.com"
+		}
+	}
+
+	if err := ioutil.WriteFile(path, []byte(strings.Join(lines, "\n")), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(path, "", "")
+	if err != nil {
+		t.Fatalf("could not load the filled in example: %v", err)
+	}
+
+	if len(cfg.Accounts) != 1 || cfg.Accounts[0].Username != "user" || cfg.Accounts[0].Hostnames[0] != "home.example.com" {
+		t.Fatalf("unexpected accounts %+v", cfg.Accounts)
+	}
+}
+
+func TestWriteSampleConfigExisting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dynhost.cfg")
+
+	if err := ioutil.WriteFile(path, []byte("[ovh]\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := writeSampleConfig(path, false); err == nil || !strings.Contains(err.Error(), "use -force to overwrite it") {
+		t.Fatalf("expected an error about the existing file, got %v", err)
+	}
+
+	if err := writeSampleConfig(path, true); err != nil {
+		t.Fatal(err)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if fi.Size() != int64(len(sampleConfig)) {
+		t.Fatalf("the file holds %d bytes, expected the %d of the example", fi.Size(), len(sampleConfig))
+	}
+}
@@ -0,0 +1,123 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+)
+
+// Multicast groups of the rtnetlink events, from linux/rtnetlink.h, which the
+// syscall package does not define.
+const (
+	rtmgrpIPv4IfAddr = 0x10
+	rtmgrpIPv4Route  = 0x40
+	rtmgrpIPv6IfAddr = 0x100
+	rtmgrpIPv6Route  = 0x400
+)
+
+// watchLinks subscribes to the netlink events of the addresses and the
+// default routes of the host, and sends on the returned channel when one of
+// them changes, until ctx is done. Sends do not block: the changes occurring
+// before the previous one is received are merged.
+func watchLinks(ctx context.Context) (<-chan struct{}, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC|syscall.SOCK_NONBLOCK, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("could not open a netlink socket: %v", err)
+	}
+
+	sa := &syscall.SockaddrNetlink{
+		Family: syscall.AF_NETLINK,
+		Groups: rtmgrpIPv4IfAddr | rtmgrpIPv6IfAddr | rtmgrpIPv4Route | rtmgrpIPv6Route,
+	}
+
+	if err := syscall.Bind(fd, sa); err != nil {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("could not subscribe to the netlink events: %v", err)
+	}
+
+	// The socket is non-blocking, so that the file is read through the
+	// runtime poller, and closing it interrupts the read.
+	f := os.NewFile(uintptr(fd), "netlink")
+
+	go func() {
+		<-ctx.Done()
+		f.Close()
+	}()
+
+	events := make(chan struct{}, 1)
+
+	changed := func() {
+		select {
+		case events <- struct{}{}:
+		default:
+		}
+	}
+
+	go func() {
+		buf := make([]byte, 1<<16)
+
+		for {
+			n, err := f.Read(buf)
+			if err != nil {
+				// The kernel dropped events that did not fit in the
+				// buffer of the socket.
+				if errors.Is(err, syscall.ENOBUFS) {
+					changed()
+					continue
+				}
+
+				if ctx.Err() == nil {
+					warnf("Stopped watching the network changes: %v", err)
+				}
+
+				return
+			}
+
+			msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+			if err != nil {
+				debugf("Could not parse a netlink message: %v", err)
+				continue
+			}
+
+			for _, m := range msgs {
+				if change := linkChange(m); change != "" {
+					debugf("Network change: %s", change)
+					changed()
+				}
+			}
+		}
+	}()
+
+	return events, nil
+}
+
+// linkChange describes the change notified by m, or returns an empty string
+// if it does not affect the public addresses, such as a route to a local
+// network.
+func linkChange(m syscall.NetlinkMessage) string {
+	switch m.Header.Type {
+	case syscall.RTM_NEWADDR:
+		return "address added"
+	case syscall.RTM_DELADDR:
+		return "address removed"
+	case syscall.RTM_NEWROUTE, syscall.RTM_DELROUTE:
+		// The rtmsg header starts with the family, the destination prefix
+		// length and, at offset 4, the routing table.
+		if len(m.Data) < syscall.SizeofRtMsg || m.Data[1] != 0 || m.Data[4] != syscall.RT_TABLE_MAIN {
+			return ""
+		}
+
+		if m.Header.Type == syscall.RTM_NEWROUTE {
+			return "default route added"
+		}
+
+		return "default route removed"
+	}
+
+	return ""
+}
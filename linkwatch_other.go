@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"context"
+	"errors"
+)
+
+func watchLinks(ctx context.Context) (<-chan struct{}, error) {
+	return nil, errors.New("watch_links is only supported on Linux")
+}
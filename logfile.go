@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sync"
+)
+
+// rotatingFile is a log file renamed to name.1 once it reaches maxSize bytes,
+// the previous name.1 being renamed to name.2 and so on, up to maxFiles old
+// files.
+type rotatingFile struct {
+	mu       sync.Mutex
+	name     string
+	maxSize  int64
+	maxFiles int
+
+	f    *os.File
+	size int64
+}
+
+// openRotatingFile opens the log file at name for appending.
+func openRotatingFile(name string, maxSize int64, maxFiles int) (*rotatingFile, error) {
+	r := rotatingFile{name: name, maxSize: maxSize, maxFiles: maxFiles}
+
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+
+	return &r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	r.f, r.size = f, fi.Size()
+
+	return nil
+}
+
+// Write appends p to the file, rotating it first if p would make it exceed
+// its maximum size. Rotation is disabled if the maximum size is 0.
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.maxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		if err := r.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "Could not rotate the log file %s: %v\n", r.name, err)
+		}
+	}
+
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+
+	return n, err
+}
+
+// rotate shifts the old files and starts a new file. Without old files to
+// keep, the file is truncated. The file is reopened even if it could not be
+// shifted, so that the messages keep being appended to it.
+func (r *rotatingFile) rotate() error {
+	err := r.f.Close()
+	if err == nil {
+		err = r.shift()
+	}
+
+	if openErr := r.open(); openErr != nil {
+		return openErr
+	}
+
+	return err
+}
+
+// shift renames the file and its old files, or truncates it.
+func (r *rotatingFile) shift() error {
+	for i := r.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(fmt.Sprintf("%s.%d", r.name, i), fmt.Sprintf("%s.%d", r.name, i+1)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	if r.maxFiles > 0 {
+		return os.Rename(r.name, r.name+".1")
+	}
+
+	return os.Truncate(r.name, 0)
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.f.Close()
+}
+
+// logFile is the file the messages are written to, if not nil.
+var logFile *rotatingFile
+
+// logOutput receives the messages not sent to syslog.
+var logOutput io.Writer = os.Stderr
+
+// useLogFile writes the messages to the log file described in cfg, or to
+// stderr if there is none. The file is reopened if its settings changed.
+func useLogFile(cfg *Config) {
+	if logFile != nil && logFile.name == cfg.LogFile && logFile.maxSize == cfg.LogMaxSize && logFile.maxFiles == cfg.LogMaxFiles {
+		return
+	}
+
+	var w io.Writer = os.Stderr
+
+	if cfg.LogFile != "" {
+		f, err := openRotatingFile(cfg.LogFile, cfg.LogMaxSize, cfg.LogMaxFiles)
+		if err != nil {
+			warnf("Could not open the log file: %v; logging to stderr", err)
+			return
+		}
+
+		w = f
+	}
+
+	old := logFile
+
+	logMu.Lock()
+	log.SetOutput(w)
+	logOutput = w
+	logFile, _ = w.(*rotatingFile)
+	logMu.Unlock()
+
+	if old != nil {
+		old.Close()
+	}
+}
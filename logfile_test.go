@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeLines writes each line to r.
+func writeLines(t *testing.T, r *rotatingFile, lines ...string) {
+	t.Helper()
+
+	for _, line := range lines {
+		if _, err := r.Write([]byte(line)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// assertContent fails the test unless the file at name holds content.
+func assertContent(t *testing.T, name, content string) {
+	t.Helper()
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(b) != content {
+		t.Fatalf("%s holds %q, expected %q", filepath.Base(name), b, content)
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "dynhost.log")
+
+	r, err := openRotatingFile(name, 10, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	// Each line but the first would exceed the 10 bytes.
+	writeLines(t, r, "first\n", "second\n", "third\n", "fourth\n")
+
+	assertContent(t, name, "fourth\n")
+	assertContent(t, name+".1", "third\n")
+	assertContent(t, name+".2", "second\n")
+
+	if _, err := os.Stat(name + ".3"); !os.IsNotExist(err) {
+		t.Fatalf("more than 2 old files were kept: %v", err)
+	}
+}
+
+func TestRotatingFileTruncated(t *testing.T) {
+	name := filepath.Join(t.TempDir(), "dynhost.log")
+
+	r, err := openRotatingFile(name, 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	writeLines(t, r, "first\n", "second\n")
+
+	assertContent(t, name, "second\n")
+
+	if _, err := os.Stat(name + ".1"); !os.IsNotExist(err) {
+		t.Fatalf("an old file was kept: %v", err)
+	}
+}
+
+func TestRotatingFileRenameFailure(t *testing.T) {
+	dir := t.TempDir()
+	name := filepath.Join(dir, "dynhost.log")
+
+	// The file cannot be renamed over a directory that is not empty.
+	if err := os.MkdirAll(filepath.Join(name+".1", "busy"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := openRotatingFile(name, 10, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	stderr := os.Stderr
+	os.Stderr, _ = os.Open(os.DevNull)
+	defer func() { os.Stderr = stderr }()
+
+	// The messages keep being appended to the file.
+	writeLines(t, r, "first\n", "second\n", "third\n")
+
+	assertContent(t, name, "first\nsecond\nthird\n")
+}
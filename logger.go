@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// logLevel is the severity of a message.
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+func (l logLevel) String() string {
+	switch l {
+	case levelDebug:
+		return "debug"
+	case levelWarn:
+		return "warn"
+	case levelError:
+		return "error"
+	}
+
+	return "info"
+}
+
+// parseLogLevel returns the level named s.
+func parseLogLevel(s string) (logLevel, error) {
+	for l := levelDebug; l <= levelError; l++ {
+		if s == l.String() {
+			return l, nil
+		}
+	}
+
+	return levelInfo, fmt.Errorf("invalid log level %q (expected debug, info, warn or error)", s)
+}
+
+// minLevel is the level below which messages are discarded.
+var minLevel = levelInfo
+
+// quiet discards every message but the errors and the changes of the records.
+var quiet bool
+
+// jsonLogs writes the messages as JSON objects, one per line, instead of
+// human-readable text.
+var jsonLogs bool
+
+// syslogWriter sends messages to syslog with the severity of their level.
+type syslogWriter interface {
+	write(level logLevel, change bool, msg string) error
+	Close() error
+}
+
+// sysLog receives the messages instead of stderr, if not nil.
+var (
+	sysLog         syslogWriter
+	sysLogFacility string
+)
+
+// useSyslog sends the messages to syslog with the facility, reconnecting if
+// it changed. Messages go to stderr if syslog is unavailable.
+func useSyslog(facility string) {
+	if sysLog != nil && facility == sysLogFacility {
+		return
+	}
+
+	w, err := openSyslog(facility)
+	if err != nil {
+		warnf("Could not connect to syslog: %v; logging to stderr", err)
+		return
+	}
+
+	if sysLog != nil {
+		sysLog.Close()
+	}
+
+	sysLog, sysLogFacility = w, facility
+}
+
+// logMu serializes the JSON messages written to logOutput.
+var logMu sync.Mutex
+
+// fields are structured data attached to a message. They only appear in the
+// JSON messages, as the text messages already mention them.
+type fields map[string]interface{}
+
+// entry is a message about to be logged along with its fields.
+type entry struct {
+	fields fields
+}
+
+// with returns an entry logging the fields along with its messages.
+func with(f fields) *entry {
+	return &entry{fields: f}
+}
+
+func (e *entry) debugf(format string, v ...interface{}) {
+	output(levelDebug, false, e.fields, format, v...)
+}
+
+func (e *entry) infof(format string, v ...interface{}) {
+	output(levelInfo, false, e.fields, format, v...)
+}
+
+// changef logs the change of a record at the info level, which is kept in
+// quiet mode.
+func (e *entry) changef(format string, v ...interface{}) {
+	output(levelInfo, true, e.fields, format, v...)
+}
+
+func (e *entry) warnf(format string, v ...interface{}) {
+	output(levelWarn, false, e.fields, format, v...)
+}
+
+func (e *entry) errorf(format string, v ...interface{}) {
+	output(levelError, false, e.fields, format, v...)
+}
+
+// debugf logs details useful to troubleshoot go-dynhost.
+func debugf(format string, v ...interface{}) {
+	with(nil).debugf(format, v...)
+}
+
+// infof logs a routine message.
+func infof(format string, v ...interface{}) {
+	with(nil).infof(format, v...)
+}
+
+// warnf logs a failure that go-dynhost recovers from.
+func warnf(format string, v ...interface{}) {
+	with(nil).warnf(format, v...)
+}
+
+// errorf logs a failure.
+func errorf(format string, v ...interface{}) {
+	with(nil).errorf(format, v...)
+}
+
+// output writes a message in the selected format, unless its level is below
+// minLevel or it is discarded by the quiet mode.
+func output(level logLevel, change bool, f fields, format string, v ...interface{}) {
+	if level < minLevel || (quiet && level < levelError && !change) {
+		return
+	}
+
+	msg := fmt.Sprintf(format, v...)
+
+	if !jsonLogs {
+		if sysLog == nil || sysLog.write(level, change, msg) != nil {
+			log.Print(msg)
+		}
+
+		return
+	}
+
+	var b bytes.Buffer
+
+	fmt.Fprintf(&b, `{"ts":%s,"level":%s,"msg":%s`,
+		jsonValue(time.Now().UTC().Format(time.RFC3339Nano)), jsonValue(level.String()), jsonValue(msg))
+
+	keys := make([]string, 0, len(f))
+	for k := range f {
+		keys = append(keys, k)
+	}
+
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		fmt.Fprintf(&b, ",%s:%s", jsonValue(k), jsonValue(f[k]))
+	}
+
+	b.WriteString("}\n")
+
+	if sysLog != nil && sysLog.write(level, change, strings.TrimSuffix(b.String(), "\n")) == nil {
+		return
+	}
+
+	logMu.Lock()
+	defer logMu.Unlock()
+
+	logOutput.Write(b.Bytes())
+}
+
+// jsonValue returns the JSON encoding of v. Errors are encoded as their
+// message.
+func jsonValue(v interface{}) []byte {
+	if err, ok := v.(error); ok {
+		v = err.Error()
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		b, _ = json.Marshal(fmt.Sprint(v))
+	}
+
+	return b
+}
@@ -1,170 +1,631 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net"
 	"net/http"
+	"os"
 	"strings"
+	"sync/atomic"
+	"time"
 
-	"gopkg.in/ini.v1"
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
 )
 
-const OVHAPIEndpoint = "https://www.ovh.com/nic/update"
-
-func main() {
-	configFile := flag.String(
-		"config",
-		"./config.cfg",
-		"path to the configuration file to uses")
+// Exit statuses of the process.
+const (
+	exitOK        = 0
+	exitFailure   = 1
+	exitConfig    = 2
+	exitDetection = 3
+	exitAuth      = 4
+	exitUpdate    = 5
+	exitDrift     = 6
+)
 
-	dryRun := flag.Bool(
-		"dry",
-		false,
-		"do not actually configure the new DynHost")
+// Commands of the command line.
+const (
+	commandCheck  = "check"
+	commandUpdate = "update"
+	commandDaemon = "daemon"
+)
 
-	showVersion := flag.Bool(
-		"version",
-		false,
-		"show the version of this software")
+// isCommand reports whether arg names a command.
+func isCommand(arg string) bool {
+	return arg == commandCheck || arg == commandUpdate || arg == commandDaemon
+}
 
-	flag.Parse()
+// usage prints the help of the command line, including the exit statuses.
+func usage() {
+	out := flag.CommandLine.Output()
+
+	fmt.Fprintf(out, `Usage: %s [command] [flags]
+
+Commands:
+  check   detect the public addresses and report the records out of date,
+          without updating them
+  update  update the records out of date once
+  daemon  keep the records up-to-date, synchronizing them periodically
+
+Flags, accepted by every command:
+`, os.Args[0])
+	flag.PrintDefaults()
+	fmt.Fprint(out, `
+Without a command, go-dynhost runs the update command, or the daemon command
+if -daemon, -interval or the interval key is set. This is deprecated. -once
+forces a single synchronization whatever the interval key, as the update
+command does.
+
+Environment:
+  DYNHOST_PROVIDER      provider to use, overriding the provider key
+  DYNHOST_API_ENDPOINT  api_endpoint of the provider section
+  DYNHOST_USERNAME      username of the provider section
+  DYNHOST_PASSWORD      password of the provider section
+  DYNHOST_HOSTNAME      comma-separated hostnames of the provider section
+  The variables take precedence over the configuration file, which may be
+  missing if they hold the credentials. The flags take precedence over both.
+
+Exit status:
+  0  every record is up-to-date or was updated
+  1  unexpected failure
+  2  invalid command line or configuration
+  3  the public address could not be detected
+  4  the provider rejected the credentials
+  5  a record could not be updated
+  6  the check command found records out of date
+`)
+}
 
-	if *showVersion {
-		println("go-dynhost 1.0.0")
-		return
+// reportConfigError logs err, the failure to load the configuration file at
+// path, with one message per problem.
+func reportConfigError(path string, err error) {
+	problems, ok := err.(configErrors)
+	if !ok {
+		problems = configErrors{err}
 	}
 
-	cfg, err := ini.Load(*configFile)
-	if err != nil {
-		log.Fatalf("Could not open %s: %v", *configFile, err)
-	}
+	for _, p := range problems {
+		// The files of the configuration directory are named in their
+		// errors.
+		var fe *fileError
+		if errors.As(p, &fe) {
+			errorf("%v", fe)
+			continue
+		}
 
-	publicIP, err := getPublicIPv4()
-	if err != nil {
-		log.Fatalf("Could not get my public IPv4 address: %v", err)
+		errorf("%s: %v", path, p)
 	}
+}
+
+// parseIPFlag parses the comma-separated addresses of -ip, at most one of
+// each family.
+func parseIPFlag(value string) (map[dynhost.Family]net.IP, error) {
+	ips := make(map[dynhost.Family]net.IP)
+
+	for _, v := range strings.Split(value, ",") {
+		ip := net.ParseIP(strings.TrimSpace(v))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address %q", v)
+		}
+
+		family := dynhost.IPv4
+		if dynhost.IPv6.Matches(ip) {
+			family = dynhost.IPv6
+		}
+
+		if ips[family] != nil {
+			return nil, fmt.Errorf("several %s addresses given", family)
+		}
 
-	log.Printf("Public IP: %s", publicIP.String())
+		ips[family] = ip
+	}
 
-	cfgSection := cfg.Section("ovh")
+	return ips, nil
+}
 
-	username := cfgSection.Key("username").String()
-	if username == "" {
-		log.Fatalf("%s: username cannot be empty", *configFile)
+// exitStatus returns the exit status reporting err, the failure of a
+// synchronization. Rejected credentials prevail over the other failures, as
+// they need to be fixed by hand.
+func exitStatus(err error) int {
+	errs, ok := err.(syncErrors)
+	if !ok {
+		errs = syncErrors{err}
 	}
 
-	password := cfgSection.Key("password").String()
-	if password == "" {
-		log.Fatalf("%s: password cannot be empty", *configFile)
+	status := exitUpdate
+
+	for _, err := range errs {
+		var (
+			de *detectionError
+			se *dynhost.StatusError
+		)
+
+		switch {
+		case errors.Is(err, dynhost.ErrBadAuth):
+			return exitAuth
+		case errors.As(err, &se) && (se.Code == http.StatusUnauthorized || se.Code == http.StatusForbidden):
+			return exitAuth
+		case errors.As(err, &de):
+			status = exitDetection
+		}
 	}
 
-	hostname := cfgSection.Key("hostname").String()
-	if hostname == "" {
-		log.Fatalf("%s: hostname cannot be empty", *configFile)
+	return status
+}
+
+// options holds the command-line flags, some of which override the
+// configuration file.
+type options struct {
+	configFile string
+	format     string
+	configDir  string
+	section    string
+	daemon     bool
+	interval   time.Duration
+	deadline   time.Duration
+	dryRun     bool
+	force      bool
+
+	// oneShot synchronizes only once, whatever the interval.
+	oneShot bool
+
+	// check only reports the records out of date.
+	check bool
+
+	// ips are the addresses given by -ip, published instead of the
+	// detected ones.
+	ips map[dynhost.Family]net.IP
+
+	// syslog sends the messages to syslog rather than stderr.
+	syslog bool
+
+	// logLevel is the level set by -log-level or -debug, if any, which takes
+	// precedence over the configuration file.
+	logLevel *logLevel
+}
+
+// config reads the configuration file and applies the command-line
+// overrides. Its secrets are only resolved if secrets is true.
+func (o *options) config(secrets bool) (*Config, error) {
+	read := validateConfig
+	if secrets {
+		read = loadConfig
 	}
 
-	currentDynHostIP, err := getDynHostValue(hostname)
+	cfg, err := read(o.configFile, o.format, o.configDir)
 	if err != nil {
-		log.Fatalf("Could not get the current DynHost value: %v", err)
+		return nil, err
 	}
 
-	log.Printf("Current DynHost value: %s", currentDynHostIP.String())
-
-	if publicIP.Equal(currentDynHostIP) {
-		log.Print("The current DynHost record is up-to-date; exiting.")
-		return
+	if o.oneShot {
+		cfg.Interval = 0
+	} else if o.interval > 0 {
+		cfg.Interval = o.interval
+	} else if o.daemon && cfg.Interval == 0 {
+		cfg.Interval = defaultInterval
 	}
 
-	if *dryRun {
-		log.Print("Dry run; exiting.")
-		return
+	if o.section != "" {
+		if err := cfg.selectAccount(o.section); err != nil {
+			return nil, err
+		}
 	}
 
-	if err := updateDynHost(username, password, hostname, publicIP); err != nil {
-		log.Fatalf("Could not update the DynHost record: %v", err)
+	cfg.dedupHostnames()
+
+	for family, ip := range o.ips {
+		configured := false
+		for _, f := range cfg.Families {
+			configured = configured || f == family
+		}
+
+		if !configured {
+			return nil, fmt.Errorf("-ip %s: the protocol key does not include %s", ip, family)
+		}
 	}
+
+	return cfg, nil
 }
 
-func getDynHostValue(hostname string) (net.IP, error) {
-	addrs, err := net.LookupIP(hostname)
+// validate checks the configuration file and the command-line overrides,
+// without resolving the secrets nor acting on the configuration: nothing is
+// logged to its log file nor to syslog, and neither its state file nor its
+// event socket are used.
+func (o *options) validate() (*Config, error) {
+	cfg, err := o.config(false)
 	if err != nil {
 		return nil, err
 	}
 
-	for _, a := range addrs {
-		if a.To4() != nil {
-			return a, nil
-		}
+	// The providers are only parsed.
+	if _, err := newIPDetector(cfg, http.DefaultClient); err != nil {
+		return nil, err
 	}
 
-	return nil, errors.New("no IPv4 found")
+	return cfg, nil
 }
 
-func getPublicIPv4() (net.IP, error) {
-	errIP := net.IPv4zero
+// failureStatus describes the consecutive failed runs counted in the state
+// file, or returns an empty string if the configuration file cannot be read
+// or has no state file.
+func (o *options) failureStatus() string {
+	// The standard input is left to the command.
+	if o.configFile == "-" {
+		return ""
+	}
+
+	cfg, err := validateConfig(o.configFile, o.format, o.configDir)
+	if err != nil || cfg.StateFile == "" {
+		return ""
+	}
 
-	res, err := http.Get("https://api.ipify.org")
+	return fmt.Sprintf("%d consecutive failed run(s), according to %s", loadState(cfg.StateFile).consecutiveFailures(), cfg.StateFile)
+}
+
+// load reads the configuration file, applies the command-line overrides, and
+// returns the syncer it describes.
+func (o *options) load() (*syncer, error) {
+	cfg, err := o.config(true)
 	if err != nil {
-		return errIP, err
+		return nil, err
 	}
-	defer res.Body.Close()
 
-	resCode := res.StatusCode
+	if o.logLevel != nil {
+		minLevel = *o.logLevel
+	} else {
+		minLevel = cfg.LogLevel
+	}
+
+	useLogFile(cfg)
 
-	if resCode != http.StatusOK {
-		return errIP, fmt.Errorf("returned %d", resCode)
+	if o.syslog {
+		useSyslog(cfg.SyslogFacility)
 	}
 
-	ipStrBytes, err := ioutil.ReadAll(res.Body)
+	s, err := newSyncer(cfg, newHTTPClient(cfg), &dnsReader{cfg: cfg})
 	if err != nil {
-		return errIP, fmt.Errorf("could not read the response: %v", err)
+		return nil, err
 	}
 
-	return net.ParseIP(string(ipStrBytes)).To4(), nil
+	s.dryRun = o.dryRun || o.check
+	s.check = o.check
+	s.deadline = o.deadline
+	s.force = o.force
+	s.ips = o.ips
+
+	return s, nil
 }
 
-func updateDynHost(username, password, hostname string, address net.IP) error {
-	req, err := http.NewRequest(http.MethodGet, OVHAPIEndpoint, nil)
-	if err != nil {
-		return err
+func main() {
+	os.Exit(run())
+}
+
+// run runs go-dynhost and returns its exit status.
+func run() int {
+	var opts options
+
+	flag.StringVar(
+		&opts.configFile,
+		"config",
+		"./config.cfg",
+		"path to the configuration file to uses, or - to read it from the standard input")
+
+	flag.StringVar(
+		&opts.format,
+		"config-format",
+		"",
+		"format of the configuration file: ini, toml or yaml, which also reads JSON (default: from its extension, ini if unknown)")
+
+	flag.StringVar(
+		&opts.configDir,
+		"config-dir",
+		"",
+		"directory whose *.cfg files, loaded in the order of their names, add their sections to the configuration file, e.g. /etc/go-dynhost.d")
+
+	flag.BoolVar(
+		&opts.dryRun,
+		"dry",
+		false,
+		"do not actually configure the new DynHost")
+
+	flag.BoolVar(
+		&opts.force,
+		"force",
+		false,
+		"update the DynHost even if it is up-to-date, or overwrite the file written by -init")
+
+	debug := flag.Bool(
+		"debug",
+		false,
+		"log debug messages (same as -log-level debug)")
+
+	flag.BoolVar(
+		&dumpHTTP,
+		"verbose",
+		false,
+		"log the HTTP requests and responses, with their credentials redacted")
+
+	flag.StringVar(
+		&opts.section,
+		"section",
+		"",
+		"only update the hostnames of this configuration section")
+
+	flag.BoolVar(
+		&opts.daemon,
+		"daemon",
+		false,
+		"keep running and synchronize the records periodically")
+
+	flag.DurationVar(
+		&opts.interval,
+		"interval",
+		0,
+		"time between two synchronizations in daemon mode (implies -daemon)")
+
+	ipFlag := flag.String(
+		"ip",
+		"",
+		"publish this address rather than detecting the public one, e.g. to publish the address of a port forward; an IPv4 and an IPv6 address may be given, separated by a comma")
+
+	flag.BoolVar(
+		&opts.oneShot,
+		"once",
+		false,
+		"synchronize once and exit, even if the interval key is set, as the check and update commands do")
+
+	flag.DurationVar(
+		&opts.deadline,
+		"deadline",
+		0,
+		"maximum duration of a synchronization, including the detection, the lookups, the updates and the notifications; in daemon mode, of each cycle")
+
+	startupDelayMax := flag.Duration(
+		"startup-delay-max",
+		0,
+		"wait for a random duration up to this one before the first synchronization, so that hosts run by the same schedule do not all query the providers at once")
+
+	flag.BoolVar(
+		&quiet,
+		"quiet",
+		false,
+		"only log the errors and the changes of the records")
+
+	logLevel := flag.String(
+		"log-level",
+		"",
+		"minimum level of the logged messages: debug, info, warn or error (default info)")
+
+	metricsAddr := flag.String(
+		"metrics-addr",
+		"",
+		"serve Prometheus metrics on /metrics and a health check on /healthz at this address in daemon mode, e.g. :9100")
+
+	healthMaxAge := flag.Duration(
+		"health-max-age",
+		0,
+		"age of the last successful cycle above which /healthz reports a failure (default 3 intervals)")
+
+	flag.BoolVar(
+		&opts.syslog,
+		"syslog",
+		false,
+		"send the log messages to syslog, with the facility set by the syslog_facility key, rather than stderr")
+
+	logFormat := flag.String(
+		"log-format",
+		"text",
+		"format of the log messages: text or json")
+
+	initConfig := flag.Bool(
+		"init",
+		false,
+		"write a commented example configuration file, listing every key, to the -config path and exit")
+
+	checkConfig := flag.Bool(
+		"check-config",
+		false,
+		"check the configuration file, reporting every problem found, and exit without any network access, nor running password_command")
+
+	checkConnectivity := flag.Bool(
+		"check-connectivity",
+		false,
+		"check that the address providers answer, that the update endpoints respond and that the records can be read, reporting each check, and exit without sending any credentials nor updating any record")
+
+	showVersion := flag.Bool(
+		"version",
+		false,
+		"show the version of this software, and the number of consecutive failed runs counted in the state file of the configuration")
+
+	flag.Usage = usage
+
+	// The command may come before or after the flags.
+	command := ""
+	args := os.Args[1:]
+
+	if len(args) > 0 && isCommand(args[0]) {
+		command, args = args[0], args[1:]
 	}
 
-	req.SetBasicAuth(username, password)
+	flag.CommandLine.Parse(args)
 
-	q := req.URL.Query()
-	q.Add("system", "dyndns")
-	q.Add("hostname", hostname)
-	q.Add("myip", address.String())
+	if command == "" && flag.NArg() > 0 && isCommand(flag.Arg(0)) {
+		command = flag.Arg(0)
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
 
-	req.URL.RawQuery = q.Encode()
+	if flag.NArg() > 0 {
+		fmt.Fprintf(flag.CommandLine.Output(), "unexpected argument %q\n", flag.Arg(0))
+		flag.Usage()
+		return exitConfig
+	}
 
-	res, err := http.DefaultClient.Do(req)
-	if err != nil {
-		return err
+	dynhost.Debugf = debugf
+
+	switch *logFormat {
+	case "text":
+	case "json":
+		jsonLogs = true
+	default:
+		errorf("invalid -log-format %q (expected text or json)", *logFormat)
+		return exitConfig
+	}
+
+	if *logLevel != "" {
+		level, err := parseLogLevel(*logLevel)
+		if err != nil {
+			errorf("-log-level: %v", err)
+			return exitConfig
+		}
+
+		opts.logLevel = &level
+	} else if *debug {
+		level := levelDebug
+		opts.logLevel = &level
 	}
 
-	defer res.Body.Close()
+	if *ipFlag != "" {
+		ips, err := parseIPFlag(*ipFlag)
+		if err != nil {
+			errorf("-ip: %v", err)
+			return exitConfig
+		}
 
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("the OVH API replied %s", res.Status)
+		opts.ips = ips
 	}
 
-	body, err := ioutil.ReadAll(res.Body)
+	if *showVersion {
+		fmt.Println(versionString())
+
+		if status := opts.failureStatus(); status != "" {
+			fmt.Println(status)
+		}
+
+		return exitOK
+	}
+
+	if *initConfig {
+		if err := writeSampleConfig(opts.configFile, opts.force); err != nil {
+			errorf("Could not write the example configuration: %v", err)
+			return exitFailure
+		}
+
+		fmt.Printf("Wrote %s; fill in its provider section, then run go-dynhost -check-config\n", opts.configFile)
+		return exitOK
+	}
+
+	switch command {
+	case commandCheck, commandUpdate:
+		if opts.daemon || opts.interval > 0 {
+			errorf("-daemon and -interval only apply to the daemon command")
+			return exitConfig
+		}
+
+		opts.oneShot = true
+		opts.check = command == commandCheck
+	case commandDaemon:
+		if opts.oneShot {
+			errorf("-once does not apply to the daemon command")
+			return exitConfig
+		}
+
+		opts.daemon = true
+	default:
+		if opts.oneShot && (opts.daemon || opts.interval > 0) {
+			errorf("-once cannot be combined with -daemon or -interval")
+			return exitConfig
+		}
+
+		if !*checkConfig && !*checkConnectivity {
+			warnf("Running without a command is deprecated; run \"%s update\" or \"%s daemon\" instead", os.Args[0], os.Args[0])
+		}
+	}
+
+	if *checkConfig {
+		cfg, err := opts.validate()
+		if err != nil {
+			reportConfigError(opts.configFile, err)
+			return exitConfig
+		}
+
+		var hostnames int
+		for _, account := range cfg.Accounts {
+			hostnames += len(account.Hostnames)
+		}
+
+		fmt.Printf("%s: valid, %d account(s) and %d hostname(s)\n", opts.configFile, len(cfg.Accounts), hostnames)
+		return exitOK
+	}
+
+	s, err := opts.load()
 	if err != nil {
-		return fmt.Errorf("could not read the response body: %v", err)
+		reportConfigError(opts.configFile, err)
+		return exitConfig
 	}
 
-	bodyStr := strings.Split(string(body), " ")
+	// The events are written in the background: wait for those of the last
+	// cycle.
+	defer useEventSocket("")
 
+	if *checkConnectivity {
+		if !s.checkConnectivity(context.Background(), os.Stdout) {
+			return exitFailure
+		}
 
+		return exitOK
+	}
 
-	if len(bodyStr) < 1 || bodyStr[0] != "good" {
-		return fmt.Errorf("response body: %s", bodyStr)
+	if !startupDelay(*startupDelayMax, time.Now().UnixNano()) {
+		return exitOK
 	}
 
-	return nil
-}
\ No newline at end of file
+	if s.cfg.Interval > 0 {
+		if *metricsAddr != "" {
+			s.metrics = newMetrics()
+
+			// The failures of the previous runs are counted in the
+			// state file.
+			s.metrics.consecutiveFailures = s.state.consecutiveFailures()
+
+			maxAge := *healthMaxAge
+			if maxAge == 0 {
+				maxAge = 3 * s.cfg.Interval
+			}
+
+			srv, err := serveStatus(*metricsAddr, s.metrics, maxAge)
+			if err != nil {
+				errorf("Could not serve the metrics: %v", err)
+				return exitFailure
+			}
+
+			defer func() {
+				ctx, cancel := context.WithTimeout(context.Background(), shutdownGrace)
+				defer cancel()
+
+				srv.Shutdown(ctx)
+			}()
+		}
+
+		runDaemon(s, opts.load, newJitter(s.cfg.IntervalJitter, time.Now().UnixNano()))
+		return exitOK
+	}
+
+	if *metricsAddr != "" {
+		warnf("The metrics are only served in daemon mode; ignoring -metrics-addr")
+	}
+
+	if err := s.syncAll(context.Background()); err != nil {
+		errorf("Synchronization failed: %v", err)
+		return exitStatus(err)
+	}
+
+	if n := atomic.LoadInt32(&s.drifted); n > 0 {
+		warnf("%d record(s) out of date", n)
+		return exitDrift
+	}
+
+	return exitOK
+}
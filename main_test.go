@@ -0,0 +1,584 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+func TestMain(m *testing.M) {
+	// The tests assert the messages they care about through logOutput.
+	log.SetOutput(ioutil.Discard)
+	logOutput = ioutil.Discard
+
+	os.Exit(m.Run())
+}
+
+// captureLogs writes the messages in JSON to a buffer until the end of the
+// test, and returns the function returning those written so far.
+func captureLogs(t *testing.T) func() string {
+	t.Helper()
+
+	var b bytes.Buffer
+
+	logMu.Lock()
+	oldJSON, oldOutput := jsonLogs, logOutput
+	jsonLogs, logOutput = true, &b
+	logMu.Unlock()
+
+	t.Cleanup(func() {
+		logMu.Lock()
+		jsonLogs, logOutput = oldJSON, oldOutput
+		logMu.Unlock()
+	})
+
+	return func() string {
+		logMu.Lock()
+		defer logMu.Unlock()
+
+		return b.String()
+	}
+}
+
+func TestQuiet(t *testing.T) {
+	var b bytes.Buffer
+
+	logMu.Lock()
+	oldQuiet, oldJSON, oldOutput := quiet, jsonLogs, logOutput
+	quiet, jsonLogs, logOutput = true, false, &b
+	log.SetOutput(&b)
+	logMu.Unlock()
+
+	t.Cleanup(func() {
+		logMu.Lock()
+		quiet, jsonLogs, logOutput = oldQuiet, oldJSON, oldOutput
+		log.SetOutput(ioutil.Discard)
+		logMu.Unlock()
+	})
+
+	cfg := loadTestConfig(t, `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+	d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+	r := &fakeReader{values: map[string][]net.IP{"home.example.com/A": {net.ParseIP("203.0.113.7")}}}
+
+	if err := newTestSyncer(t, cfg, d, r, &fakeUpdater{}).syncAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	warnf("Could not connect to syslog")
+
+	if b.Len() != 0 {
+		t.Fatalf("the routine messages were logged in quiet mode: %q", b.String())
+	}
+
+	// The changes of the records and the errors are still logged.
+	with(fields{"hostname": "home.example.com"}).changef("DynHost home.example.com/A updated from 198.51.100.1 to 203.0.113.7")
+	errorf("Could not update the DynHost record")
+
+	for _, msg := range []string{"updated from 198.51.100.1 to 203.0.113.7", "Could not update the DynHost record"} {
+		if !strings.Contains(b.String(), msg) {
+			t.Fatalf("%q was not logged in quiet mode: %q", msg, b.String())
+		}
+	}
+}
+
+// runArgs runs go-dynhost with the command-line args and returns its exit
+// status. The flags and the logging settings are restored afterwards.
+func runArgs(t *testing.T, args ...string) int {
+	t.Helper()
+
+	oldArgs, oldFlags, oldUsage := os.Args, flag.CommandLine, flag.Usage
+	oldJSON, oldLevel, oldDump := jsonLogs, minLevel, dumpHTTP
+
+	t.Cleanup(func() {
+		os.Args, flag.CommandLine, flag.Usage = oldArgs, oldFlags, oldUsage
+		jsonLogs, minLevel, dumpHTTP = oldJSON, oldLevel, oldDump
+
+		logMu.Lock()
+		if logFile != nil {
+			logFile.Close()
+			logFile = nil
+		}
+		log.SetOutput(ioutil.Discard)
+		logOutput = ioutil.Discard
+		logMu.Unlock()
+	})
+
+	os.Args = append([]string{"go-dynhost"}, args...)
+
+	flag.CommandLine = flag.NewFlagSet("go-dynhost", flag.ContinueOnError)
+	flag.CommandLine.SetOutput(ioutil.Discard)
+
+	return run()
+}
+
+// serveRecords serves the A and AAAA records over UDP until the end of the
+// test, and returns the address of the server. The records are keyed by
+// "hostname/type", as those of fakeReader; the others do not exist.
+func serveRecords(t *testing.T, records map[string][]net.IP) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		b := make([]byte, 512)
+
+		for {
+			n, addr, err := conn.ReadFrom(b)
+			if err != nil {
+				return
+			}
+
+			var p dnsmessage.Parser
+
+			h, err := p.Start(b[:n])
+			if err != nil {
+				continue
+			}
+
+			q, err := p.Question()
+			if err != nil {
+				continue
+			}
+
+			res := dnsmessage.Message{
+				Header:    dnsmessage.Header{ID: h.ID, Response: true, RecursionAvailable: true},
+				Questions: []dnsmessage.Question{q},
+			}
+
+			hostname := strings.TrimSuffix(q.Name.String(), ".")
+			_, a := records[hostname+"/A"]
+			_, aaaa := records[hostname+"/AAAA"]
+
+			if !a && !aaaa {
+				res.Header.RCode = dnsmessage.RCodeNameError
+			}
+
+			for _, ip := range records[hostname+"/"+strings.TrimPrefix(q.Type.String(), "Type")] {
+				rh := dnsmessage.ResourceHeader{Name: q.Name, Type: q.Type, Class: dnsmessage.ClassINET, TTL: 60}
+
+				if ip4 := ip.To4(); ip4 != nil {
+					var body dnsmessage.AResource
+					copy(body.A[:], ip4)
+					res.Answers = append(res.Answers, dnsmessage.Resource{Header: rh, Body: &body})
+				} else {
+					var body dnsmessage.AAAAResource
+					copy(body.AAAA[:], ip)
+					res.Answers = append(res.Answers, dnsmessage.Resource{Header: rh, Body: &body})
+				}
+			}
+
+			if packed, err := res.Pack(); err == nil {
+				conn.WriteTo(packed, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+func TestExitStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+	}{
+		{name: "update failure", err: errors.New("connection refused"), status: exitUpdate},
+		{name: "detection failure", err: &detectionError{err: errors.New("no provider answered")}, status: exitDetection},
+		{name: "badauth", err: fmt.Errorf("home.example.com: %w", dynhost.ErrBadAuth), status: exitAuth},
+		{name: "HTTP 401", err: &dynhost.StatusError{Status: "401 Unauthorized", Code: http.StatusUnauthorized}, status: exitAuth},
+		{name: "HTTP 403", err: &dynhost.StatusError{Status: "403 Forbidden", Code: http.StatusForbidden}, status: exitAuth},
+		{name: "HTTP 500", err: &dynhost.StatusError{Status: "500 Internal Server Error", Code: http.StatusInternalServerError}, status: exitUpdate},
+		{
+			name:   "detection and update failures",
+			err:    syncErrors{errors.New("connection refused"), &detectionError{err: errors.New("no provider answered")}},
+			status: exitDetection,
+		},
+		{
+			name:   "authentication failure first",
+			err:    syncErrors{&detectionError{err: errors.New("no provider answered")}, dynhost.ErrBadAuth},
+			status: exitAuth,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if status := exitStatus(tt.err); status != tt.status {
+				t.Fatalf("exit status %d, expected %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestRunExitStatus(t *testing.T) {
+	detected := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "203.0.113.7")
+	}))
+	defer detected.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer broken.Close()
+
+	// replying returns the endpoint of a provider replying body to the
+	// updates.
+	replying := func(body string) string {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, body)
+		}))
+
+		t.Cleanup(srv.Close)
+
+		return srv.URL
+	}
+
+	resolver := serveRecords(t, map[string][]net.IP{
+		"home.example.com/A": {net.ParseIP("198.51.100.1")},
+	})
+
+	tests := []struct {
+		name     string
+		provider string
+		endpoint string
+		body     string
+		args     []string
+		status   int
+	}{
+		{name: "version", args: []string{"-version"}, status: exitOK},
+		{name: "updated", provider: detected.URL, endpoint: replying("good 203.0.113.7"), args: []string{"update"}, status: exitOK},
+		{name: "valid configuration", provider: detected.URL, endpoint: replying("good"), args: []string{"-check-config"}, status: exitOK},
+		{name: "unwritable example", args: []string{"-init", "-config", "/nonexistent/dynhost.cfg"}, status: exitFailure},
+		{name: "invalid flag", args: []string{"-log-format", "xml", "update"}, status: exitConfig},
+		{name: "invalid configuration", body: "[ovh]\nusername = user\n", args: []string{"update"}, status: exitConfig},
+		{name: "detection failure", provider: broken.URL, endpoint: replying("good"), args: []string{"update"}, status: exitDetection},
+		{name: "authentication failure", provider: detected.URL, endpoint: replying("badauth"), args: []string{"update"}, status: exitAuth},
+		{name: "update failure", provider: detected.URL, endpoint: replying("nohost"), args: []string{"update"}, status: exitUpdate},
+		{name: "out of date", provider: detected.URL, endpoint: replying("good"), args: []string{"check"}, status: exitDrift},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			body := tt.body
+			if body == "" {
+				body = fmt.Sprintf(`
+ipv4_providers = %s
+resolver = %s
+retries = 0
+log_file = %s
+
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+`, tt.provider, resolver, filepath.Join(dir, "dynhost.log"), tt.endpoint)
+			}
+
+			path := filepath.Join(dir, "dynhost.cfg")
+
+			if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			args := append([]string{"-config", path}, tt.args...)
+
+			if status := runArgs(t, args...); status != tt.status {
+				t.Fatalf("exit status %d, expected %d", status, tt.status)
+			}
+		})
+	}
+}
+
+func TestCheckConfigSideEffects(t *testing.T) {
+	dir := t.TempDir()
+
+	marker := filepath.Join(dir, "marker")
+	logFile := filepath.Join(dir, "dynhost.log")
+
+	path := filepath.Join(dir, "dynhost.cfg")
+
+	body := fmt.Sprintf(`
+log_file = %s
+
+[ovh]
+username = user
+password_command = touch %s
+hostname = home.example.com
+`, logFile, marker)
+
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := runArgs(t, "-config", path, "-check-config"); status != exitOK {
+		t.Fatalf("exit status %d, expected %d", status, exitOK)
+	}
+
+	for _, name := range []string{marker, logFile} {
+		if _, err := os.Stat(name); !os.IsNotExist(err) {
+			t.Fatalf("-check-config created %s", name)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+
+	creds := filepath.Join(dir, "credentials.cfg")
+	if err := ioutil.WriteFile(creds, []byte("[home]\nusername = user\npassword = secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		body string
+		err  string
+	}{
+		{
+			name: "credentials file",
+			body: "credentials_file = " + creds + "\n\n[ovh]\ncredentials_ref = home\nhostname = home.example.com\n",
+		},
+		{
+			name: "missing credentials file",
+			body: "credentials_file = " + filepath.Join(dir, "missing") + "\n\n[ovh]\ncredentials_ref = home\nhostname = home.example.com\n",
+			err:  "could not read credentials_file",
+		},
+		{
+			name: "missing password file",
+			body: "[ovh]\nusername = user\npassword_file = " + filepath.Join(dir, "missing") + "\nhostname = home.example.com\n",
+			err:  "could not read password_file",
+		},
+		{
+			name: "missing password command",
+			body: "[ovh]\nusername = user\npassword_command = /nonexistent/pass show dynhost\nhostname = home.example.com\n",
+			err:  "password_command",
+		},
+		{
+			name: "invalid provider",
+			body: "ipv4_providers = ftp://example.com\n\n[ovh]\nusername = user\npassword = secret\nhostname = home.example.com\n",
+			err:  "ftp://example.com",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "dynhost.cfg")
+
+			if err := ioutil.WriteFile(path, []byte(tt.body), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			opts := options{configFile: path}
+
+			_, err := opts.validate()
+
+			if tt.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				return
+			}
+
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestOnce(t *testing.T) {
+	detected := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, "203.0.113.7")
+	}))
+	defer detected.Close()
+
+	var updates int32
+
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&updates, 1)
+		fmt.Fprint(w, "good 203.0.113.7")
+	}))
+	defer endpoint.Close()
+
+	resolver := serveRecords(t, map[string][]net.IP{
+		"home.example.com/A": {net.ParseIP("198.51.100.1")},
+	})
+
+	tests := []struct {
+		name    string
+		args    []string
+		status  int
+		updates int32
+	}{
+		{name: "interval key", args: []string{"-once"}, status: exitOK, updates: 1},
+		{name: "update command", args: []string{"-once", "update"}, status: exitOK, updates: 1},
+		{name: "interval flag", args: []string{"-once", "-interval", "1m"}, status: exitConfig},
+		{name: "daemon flag", args: []string{"-once", "-daemon"}, status: exitConfig},
+		{name: "daemon command", args: []string{"-once", "daemon"}, status: exitConfig},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			atomic.StoreInt32(&updates, 0)
+
+			dir := t.TempDir()
+			path := filepath.Join(dir, "dynhost.cfg")
+
+			// The interval would run a daemon without -once.
+			body := fmt.Sprintf(`
+interval = 1h
+ipv4_providers = %s
+resolver = %s
+retries = 0
+log_file = %s
+
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+`, detected.URL, resolver, filepath.Join(dir, "dynhost.log"), endpoint.URL)
+
+			if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			status := make(chan int, 1)
+
+			go func() {
+				status <- runArgs(t, append([]string{"-config", path}, tt.args...)...)
+			}()
+
+			select {
+			case s := <-status:
+				if s != tt.status {
+					t.Fatalf("exit status %d, expected %d", s, tt.status)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("go-dynhost did not exit after a single synchronization")
+			}
+
+			if n := atomic.LoadInt32(&updates); n != tt.updates {
+				t.Fatalf("%d update(s), expected %d", n, tt.updates)
+			}
+		})
+	}
+}
+
+func TestParseIPFlag(t *testing.T) {
+	tests := []struct {
+		value string
+		ipv4  string
+		ipv6  string
+		err   string
+	}{
+		{value: "203.0.113.7", ipv4: "203.0.113.7"},
+		{value: "2001:db8::7", ipv6: "2001:db8::7"},
+		{value: "203.0.113.7, 2001:db8::7", ipv4: "203.0.113.7", ipv6: "2001:db8::7"},
+		{value: "203.0.113.7,203.0.113.8", err: "several IPv4 addresses given"},
+		{value: "home.example.com", err: `invalid address "home.example.com"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			ips, err := parseIPFlag(tt.value)
+
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := fmt.Sprint(ips[dynhost.IPv4], ips[dynhost.IPv6]); got != fmt.Sprint(net.ParseIP(tt.ipv4), net.ParseIP(tt.ipv6)) {
+				t.Fatalf("got %v, expected %s and %s", ips, tt.ipv4, tt.ipv6)
+			}
+		})
+	}
+}
+
+func TestIPFlag(t *testing.T) {
+	var detections int32
+
+	// The provider would fail the detection if it were queried.
+	provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&detections, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer provider.Close()
+
+	ovh, reqs := fakeOVH(t)
+
+	resolver := serveRecords(t, map[string][]net.IP{
+		"home.example.com/A": {net.ParseIP("198.51.100.1")},
+	})
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "dynhost.cfg")
+
+	body := fmt.Sprintf(`
+ipv4_providers = %s
+resolver = %s
+retries = 0
+log_file = %s
+
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+`, provider.URL, resolver, filepath.Join(dir, "dynhost.log"), ovh.URL)
+
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	if status := runArgs(t, "-config", path, "-ip", "203.0.113.9", "update"); status != exitOK {
+		t.Fatalf("exit status %d, expected %d", status, exitOK)
+	}
+
+	if n := atomic.LoadInt32(&detections); n != 0 {
+		t.Fatalf("the provider was queried %d time(s)", n)
+	}
+
+	queries := reqs.list()
+	if len(queries) != 1 || queries[0].Get("myip") != "203.0.113.9" {
+		t.Fatalf("unexpected updates %v, expected one to 203.0.113.9", queries)
+	}
+}
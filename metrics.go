@@ -0,0 +1,302 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// metrics holds the statistics of the daemon, exposed in the Prometheus text
+// format. Its methods do nothing on a nil *metrics, so that the syncer needs
+// not check whether they are collected.
+type metrics struct {
+	mu sync.Mutex
+
+	cycles              map[string]int
+	lastSuccess         time.Time
+	lastError           error
+	lastErrorTime       time.Time
+	consecutiveFailures int
+	changes             int
+	publicIPs           map[dynhost.Family]net.IP
+
+	// skips counts the cycles that skipped the records of each family, for
+	// lack of a public address.
+	skips map[dynhost.Family]int
+
+	// durations are the durations of the stages of the cycles, by stage.
+	durations map[string]*histogram
+}
+
+// Stages of a cycle whose durations are measured.
+var timedStages = []string{"cycle", "detection", "lookup", "update"}
+
+// durationBuckets are the upper bounds of the buckets of the durations, in
+// seconds.
+var durationBuckets = []float64{0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// histogram counts observations in cumulative buckets, as Prometheus
+// histograms do.
+type histogram struct {
+	counts []int
+	sum    float64
+	count  int
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		cycles:    make(map[string]int),
+		publicIPs: make(map[dynhost.Family]net.IP),
+		skips:     make(map[dynhost.Family]int),
+		durations: make(map[string]*histogram),
+	}
+}
+
+// cycle records the outcome of a synchronization cycle.
+func (m *metrics) cycle(err error) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.cycles["failure"]++
+		m.consecutiveFailures++
+		m.lastError = err
+		m.lastErrorTime = time.Now()
+		return
+	}
+
+	m.cycles["success"]++
+	m.consecutiveFailures = 0
+	m.lastSuccess = time.Now()
+}
+
+// detected records the public address of the family.
+func (m *metrics) detected(family dynhost.Family, ip net.IP) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.publicIPs[family] = ip
+}
+
+// skipped records that the records of the family were skipped, as its public
+// address could not be detected.
+func (m *metrics) skipped(family dynhost.Family) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.skips[family]++
+}
+
+// observe records the duration of an instance of the stage.
+func (m *metrics) observe(stage string, d time.Duration) {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	h := m.durations[stage]
+	if h == nil {
+		h = &histogram{counts: make([]int, len(durationBuckets))}
+		m.durations[stage] = h
+	}
+
+	seconds := d.Seconds()
+
+	for i, le := range durationBuckets {
+		if seconds <= le {
+			h.counts[i]++
+		}
+	}
+
+	h.sum += seconds
+	h.count++
+}
+
+// timed returns a function that, when called, records the time elapsed since
+// the beginning of an instance of the stage, described by what, and logs it
+// at the debug level.
+func (s *syncer) timed(stage, what string) func() {
+	start := time.Now()
+
+	return func() {
+		d := time.Since(start)
+
+		s.metrics.observe(stage, d)
+		debugf("%s took %v", what, d.Round(time.Millisecond))
+	}
+}
+
+// changed records the change of a record.
+func (m *metrics) changed() {
+	if m == nil {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.changes++
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	fmt.Fprintln(w, "# HELP dynhost_cycles_total Synchronization cycles, by result.")
+	fmt.Fprintln(w, "# TYPE dynhost_cycles_total counter")
+
+	for _, result := range []string{"success", "failure"} {
+		fmt.Fprintf(w, "dynhost_cycles_total{result=%q} %d\n", result, m.cycles[result])
+	}
+
+	fmt.Fprintln(w, "# HELP dynhost_last_success_timestamp_seconds Time of the last successful cycle.")
+	fmt.Fprintln(w, "# TYPE dynhost_last_success_timestamp_seconds gauge")
+
+	var lastSuccess float64
+	if !m.lastSuccess.IsZero() {
+		lastSuccess = float64(m.lastSuccess.UnixNano()) / 1e9
+	}
+
+	fmt.Fprintf(w, "dynhost_last_success_timestamp_seconds %.3f\n", lastSuccess)
+
+	fmt.Fprintln(w, "# HELP dynhost_consecutive_failures Cycles failed since the last successful one.")
+	fmt.Fprintln(w, "# TYPE dynhost_consecutive_failures gauge")
+	fmt.Fprintf(w, "dynhost_consecutive_failures %d\n", m.consecutiveFailures)
+
+	fmt.Fprintln(w, "# HELP dynhost_ip_changes_total Records updated to a new address.")
+	fmt.Fprintln(w, "# TYPE dynhost_ip_changes_total counter")
+	fmt.Fprintf(w, "dynhost_ip_changes_total %d\n", m.changes)
+
+	fmt.Fprintln(w, "# HELP dynhost_stage_duration_seconds Durations of the stages of the cycles: the whole cycle, the detection of an address, the lookup of a record and the update of a record.")
+	fmt.Fprintln(w, "# TYPE dynhost_stage_duration_seconds histogram")
+
+	for _, stage := range timedStages {
+		h := m.durations[stage]
+		if h == nil {
+			h = &histogram{counts: make([]int, len(durationBuckets))}
+		}
+
+		for i, le := range durationBuckets {
+			fmt.Fprintf(w, "dynhost_stage_duration_seconds_bucket{stage=%q,le=\"%g\"} %d\n", stage, le, h.counts[i])
+		}
+
+		fmt.Fprintf(w, "dynhost_stage_duration_seconds_bucket{stage=%q,le=\"+Inf\"} %d\n", stage, h.count)
+		fmt.Fprintf(w, "dynhost_stage_duration_seconds_sum{stage=%q} %g\n", stage, h.sum)
+		fmt.Fprintf(w, "dynhost_stage_duration_seconds_count{stage=%q} %d\n", stage, h.count)
+	}
+
+	fmt.Fprintln(w, "# HELP dynhost_family_skips_total Cycles that skipped the records of a family for lack of a public address, by family.")
+	fmt.Fprintln(w, "# TYPE dynhost_family_skips_total counter")
+
+	for _, family := range []dynhost.Family{dynhost.IPv4, dynhost.IPv6} {
+		fmt.Fprintf(w, "dynhost_family_skips_total{family=%q} %d\n", family, m.skips[family])
+	}
+
+	fmt.Fprintln(w, "# HELP dynhost_http_connections_total HTTP connections used by the requests, by whether they were opened or reused.")
+	fmt.Fprintln(w, "# TYPE dynhost_http_connections_total counter")
+	fmt.Fprintf(w, "dynhost_http_connections_total{state=\"new\"} %d\n", atomic.LoadInt64(&connsOpened))
+	fmt.Fprintf(w, "dynhost_http_connections_total{state=\"reused\"} %d\n", atomic.LoadInt64(&connsReused))
+
+	fmt.Fprintln(w, "# HELP dynhost_public_ip_info Last public address detected, by family.")
+	fmt.Fprintln(w, "# TYPE dynhost_public_ip_info gauge")
+
+	families := make([]dynhost.Family, 0, len(m.publicIPs))
+	for family := range m.publicIPs {
+		families = append(families, family)
+	}
+
+	sort.Slice(families, func(i, j int) bool { return families[i] < families[j] })
+
+	for _, family := range families {
+		fmt.Fprintf(w, "dynhost_public_ip_info{family=%q,ip=%q} 1\n", family, m.publicIPs[family])
+	}
+}
+
+// healthHandler reports whether the last successful cycle is more recent than
+// maxAge, with a 200 or 503 status, and describes the last success and error
+// in a JSON object.
+func (m *metrics) healthHandler(maxAge time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		m.mu.Lock()
+		defer m.mu.Unlock()
+
+		var body struct {
+			Healthy       bool       `json:"healthy"`
+			LastSuccess   *time.Time `json:"last_success"`
+			LastError     string     `json:"last_error,omitempty"`
+			LastErrorTime *time.Time `json:"last_error_time,omitempty"`
+
+			ConsecutiveFailures int `json:"consecutive_failures"`
+		}
+
+		body.ConsecutiveFailures = m.consecutiveFailures
+
+		if !m.lastSuccess.IsZero() {
+			lastSuccess := m.lastSuccess.UTC()
+			body.LastSuccess = &lastSuccess
+			body.Healthy = time.Since(m.lastSuccess) <= maxAge
+		}
+
+		if m.lastError != nil {
+			lastErrorTime := m.lastErrorTime.UTC()
+			body.LastError = m.lastError.Error()
+			body.LastErrorTime = &lastErrorTime
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if !body.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		json.NewEncoder(w).Encode(&body)
+	}
+}
+
+// serveStatus serves m on /metrics and the health check on /healthz at addr,
+// in the background. It only returns an error if addr cannot be listened on.
+func serveStatus(addr string, m *metrics, maxAge time.Duration) (*http.Server, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", m)
+	mux.Handle("/healthz", m.healthHandler(maxAge))
+
+	srv := &http.Server{Handler: mux}
+
+	go func() {
+		if err := srv.Serve(l); err != nil && err != http.ErrServerClosed {
+			errorf("Status server failed: %v", err)
+		}
+	}()
+
+	infof("Serving the metrics and health check on http://%s", l.Addr())
+
+	return srv, nil
+}
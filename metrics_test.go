@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+func TestObserve(t *testing.T) {
+	m := newMetrics()
+
+	for _, d := range []time.Duration{30 * time.Millisecond, 2 * time.Second, time.Minute} {
+		m.observe("update", d)
+	}
+
+	h := m.durations["update"]
+
+	// The buckets are cumulative: the minute is only counted in +Inf.
+	expected := []int{0, 1, 1, 1, 1, 1, 2, 2, 2, 2}
+
+	if fmt.Sprint(h.counts) != fmt.Sprint(expected) {
+		t.Fatalf("got the buckets %v, expected %v", h.counts, expected)
+	}
+
+	if h.count != 3 || h.sum != 62.03 {
+		t.Fatalf("got %d observations summing to %vs, expected 3 and 62.03s", h.count, h.sum)
+	}
+}
+
+func TestStageDurations(t *testing.T) {
+	cfg := loadTestConfig(t, `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+	d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+	r := &fakeReader{values: map[string][]net.IP{"home.example.com/A": {net.ParseIP("198.51.100.1")}}}
+
+	s := newTestSyncer(t, cfg, d, r, &fakeUpdater{})
+	s.metrics = newMetrics()
+
+	if err := s.syncAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	s.metrics.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+
+	body := rec.Body.String()
+
+	for _, stage := range timedStages {
+		for _, line := range []string{
+			fmt.Sprintf(`dynhost_stage_duration_seconds_count{stage=%q} 1`, stage),
+			fmt.Sprintf(`dynhost_stage_duration_seconds_bucket{stage=%q,le="+Inf"} 1`, stage),
+		} {
+			if !strings.Contains(body, line+"\n") {
+				t.Errorf("no %s in the metrics:\n%s", line, body)
+			}
+		}
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+)
+
+// sdNotify sends a state such as READY=1 to systemd through the socket named
+// by $NOTIFY_SOCKET. It does nothing when the variable is not set, that is
+// when go-dynhost is not run as a Type=notify service.
+func sdNotify(state string) error {
+	name := os.Getenv("NOTIFY_SOCKET")
+	if name == "" {
+		return nil
+	}
+
+	// A leading @ denotes a socket in the abstract namespace.
+	if name[0] == '@' {
+		name = "\x00" + name[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: name, Net: "unixgram"})
+	if err != nil {
+		return fmt.Errorf("could not connect to the notification socket: %v", err)
+	}
+	defer conn.Close()
+
+	if _, err := conn.Write([]byte(state)); err != nil {
+		return fmt.Errorf("could not send %q: %v", state, err)
+	}
+
+	return nil
+}
+
+// watchdogInterval returns the time after which systemd considers the service
+// hung if it has not sent WATCHDOG=1, or 0 if the watchdog is not enabled for
+// this process.
+func watchdogInterval() time.Duration {
+	usec := os.Getenv("WATCHDOG_USEC")
+	if usec == "" {
+		return 0
+	}
+
+	if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return 0
+	}
+
+	n, err := strconv.ParseInt(usec, 10, 64)
+	if err != nil || n <= 0 {
+		return 0
+	}
+
+	return time.Duration(n) * time.Microsecond
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+func TestUpdateFailureStreak(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		messages []string
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload struct {
+			Text string `json:"text"`
+		}
+
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &payload); err != nil {
+			t.Errorf("the chat received invalid JSON %s: %v", b, err)
+		}
+
+		mu.Lock()
+		messages = append(messages, payload.Text)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+slack_webhook_url = %s
+update_failure_threshold = 2
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`, srv.URL))
+
+	failure := errors.New("connection refused")
+
+	d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+	r := &fakeReader{values: map[string][]net.IP{"home.example.com/A": {net.ParseIP("198.51.100.1")}}}
+
+	// Three failed cycles and a successful one.
+	u := &fakeUpdater{errs: []error{failure, failure, failure}}
+
+	s := newTestSyncer(t, cfg, d, r, u)
+
+	failures := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+
+		n := 0
+
+		for _, m := range messages {
+			if strings.Contains(m, "Could not update home.example.com") {
+				n++
+			}
+		}
+
+		return n
+	}
+
+	for i, expected := range []int{0, 1, 1, 1} {
+		_ = s.syncAll(context.Background())
+
+		if n := failures(); n != expected {
+			t.Fatalf("cycle %d: %d failure notification(s), expected %d", i+1, n, expected)
+		}
+	}
+
+	// The public address changes again.
+	d.ips[dynhost.IPv4] = net.ParseIP("203.0.113.8")
+
+	u.mu.Lock()
+	u.errs = []error{failure, failure}
+	u.mu.Unlock()
+
+	for i, expected := range []int{1, 2} {
+		_ = s.syncAll(context.Background())
+
+		if n := failures(); n != expected {
+			t.Fatalf("cycle %d of the second streak: %d failure notification(s), expected %d", i+1, n, expected)
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	for _, m := range messages {
+		if strings.Contains(m, "Could not update") && !strings.Contains(m, "in 2 consecutive cycle(s)") {
+			t.Fatalf("unexpected message %q", m)
+		}
+	}
+}
+
+func TestUpdateFailureThresholdInvalid(t *testing.T) {
+	err := loadTestConfigError(t, `
+update_failure_threshold = 0
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+	if !strings.Contains(err.Error(), "update_failure_threshold must be at least 1") {
+		t.Fatalf("unexpected error %v", err)
+	}
+}
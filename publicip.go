@@ -0,0 +1,72 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// detector finds the public addresses of the host.
+type detector interface {
+	PublicIP(ctx context.Context, family dynhost.Family) (net.IP, error)
+}
+
+// newIPDetector returns the detector querying the providers configured in
+// cfg, or the configured interface.
+func newIPDetector(cfg *Config, client *http.Client) (*dynhost.Detector, error) {
+	d := dynhost.Detector{
+		Timeout:      cfg.ProviderTimeout,
+		Rejected:     cfg.RejectedRanges,
+		ConsensusMin: cfg.ConsensusMin,
+	}
+
+	if cfg.ShuffleProviders {
+		d.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+
+	var jsonField string
+	if cfg.ProviderFormat == "json" {
+		jsonField = cfg.ProviderField
+	}
+
+	var err error
+
+	if d.IPv4Providers, err = dynhost.ParseProviders(client, cfg.IPv4Providers, dynhost.IPv4, jsonField); err != nil {
+		return nil, err
+	}
+
+	if d.IPv6Providers, err = dynhost.ParseProviders(client, cfg.IPv6Providers, dynhost.IPv6, jsonField); err != nil {
+		return nil, err
+	}
+
+	// The HTTP providers go through the client, bound to the source
+	// addresses by its transport.
+	for _, p := range append(append([]dynhost.Provider{}, d.IPv4Providers...), d.IPv6Providers...) {
+		if p, ok := p.(*dynhost.DNSProvider); ok {
+			p.Source = cfg.SourceAddresses[p.Family]
+		}
+	}
+
+	if cfg.Interface != "" {
+		d.IPv4Providers = []dynhost.Provider{
+			&dynhost.InterfaceProvider{Name: cfg.Interface, Family: dynhost.IPv4, Rejected: d.Rejected},
+		}
+
+		d.IPv6Providers = []dynhost.Provider{
+			&dynhost.InterfaceProvider{Name: cfg.Interface, Family: dynhost.IPv6, Rejected: d.Rejected, PreferTemporary: cfg.PreferTemporary},
+		}
+	}
+
+	for _, family := range cfg.Families {
+		if n := len(d.Providers(family)); d.ConsensusMin > n {
+			return nil, fmt.Errorf("consensus_min is %d but only %d %s providers are configured", d.ConsensusMin, n, family)
+		}
+	}
+
+	return &d, nil
+}
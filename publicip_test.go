@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// serveAddress returns a provider replying body to every request.
+func serveAddress(t *testing.T, body string) *httptest.Server {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, body)
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return srv
+}
+
+func TestDetectorRejectedRanges(t *testing.T) {
+	tests := []struct {
+		class string
+		ip    string
+		cidr  string
+	}{
+		{class: "private 10/8", ip: "10.1.2.3", cidr: "10.0.0.0/8"},
+		{class: "private 172.16/12", ip: "172.20.0.1", cidr: "172.16.0.0/12"},
+		{class: "private 192.168/16", ip: "192.168.1.254", cidr: "192.168.0.0/16"},
+		{class: "loopback", ip: "127.0.0.1", cidr: "127.0.0.0/8"},
+		{class: "link-local", ip: "169.254.10.20", cidr: "169.254.0.0/16"},
+		{class: "CGNAT", ip: "100.100.1.1", cidr: "100.64.0.0/10"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.class, func(t *testing.T) {
+			provider := serveAddress(t, tt.ip)
+
+			cfg := loadTestConfig(t, fmt.Sprintf(`
+ipv4_providers = %s
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`, provider.URL))
+
+			d, err := newIPDetector(cfg, http.DefaultClient)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ip, err := d.PublicIP(context.Background(), dynhost.IPv4)
+			if err == nil {
+				t.Fatalf("%s was not rejected", ip)
+			}
+
+			if !strings.Contains(err.Error(), "rejected range "+tt.cidr) {
+				t.Fatalf("unexpected error: %v", err)
+			}
+		})
+	}
+}
+
+func TestDetectorRejectedRangesOverride(t *testing.T) {
+	provider := serveAddress(t, "10.1.2.3")
+
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+ipv4_providers = %s
+rejected_ranges =
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`, provider.URL))
+
+	d, err := newIPDetector(cfg, http.DefaultClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ip, err := d.PublicIP(context.Background(), dynhost.IPv4)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip.String() != "10.1.2.3" {
+		t.Fatalf("got %s, expected 10.1.2.3", ip)
+	}
+}
+
+func TestDetectCGNAT(t *testing.T) {
+	tests := []struct {
+		name    string
+		ip      string
+		fail    bool
+		warning bool
+		err     bool
+	}{
+		{name: "inside", ip: "100.100.1.1", warning: true},
+		{name: "inside with fail_on_cgnat", ip: "100.100.1.1", fail: true, err: true},
+		{name: "outside", ip: "100.128.0.1"},
+		{name: "outside with fail_on_cgnat", ip: "100.128.0.1", fail: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+
+			cfg := loadTestConfig(t, fmt.Sprintf(`
+fail_on_cgnat = %v
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`, tt.fail))
+
+			d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP(tt.ip)}}
+			u := &fakeUpdater{}
+
+			s := newTestSyncer(t, cfg, d, &fakeReader{}, u)
+
+			err := s.syncAll(context.Background())
+
+			if tt.err {
+				if status := exitStatus(err); status != exitDetection {
+					t.Fatalf("exit status %d for %v, expected %d", status, err, exitDetection)
+				}
+
+				if !strings.Contains(logs(), "is a carrier-grade NAT address, which cannot be reached from the Internet") {
+					t.Fatalf("the refusal was not logged:\n%s", logs())
+				}
+
+				if n := len(u.updates()); n != 0 {
+					t.Fatalf("%d update(s) of a carrier-grade NAT address", n)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n := len(u.updates()); n != 1 {
+				t.Fatalf("%d update(s), expected 1", n)
+			}
+
+			if warned := strings.Contains(logs(), "Publishing it anyway"); warned != tt.warning {
+				t.Fatalf("warned: %v, expected %v:\n%s", warned, tt.warning, logs())
+			}
+		})
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// recordReader reads the current values of the DynHost records, several if
+// the hostname has several records of the family, along with their TTL, or 0
+// if it is unknown.
+type recordReader interface {
+	currentValues(ctx context.Context, hostname string, family dynhost.Family) ([]net.IP, time.Duration, error)
+}
+
+// dnsReader reads the DynHost records through DNS, as configured in cfg.
+type dnsReader struct {
+	cfg *Config
+}
+
+// currentValues only reads the TTL when it is needed, as doing so bypasses
+// the system resolver. The TXT record holds a single value.
+func (r *dnsReader) currentValues(ctx context.Context, hostname string, family dynhost.Family) ([]net.IP, time.Duration, error) {
+	name := hostname
+
+	txt := r.cfg.txtName(hostname)
+	if txt != "" {
+		name = txt
+	}
+
+	res := recordResolver(ctx, r.cfg, name)
+
+	if txt == "" {
+		if r.cfg.RespectTTL {
+			return dynhost.CurrentRecordsTTL(ctx, res, name, family)
+		}
+
+		ips, err := dynhost.CurrentRecords(ctx, res, name, family)
+		return ips, 0, err
+	}
+
+	var (
+		ip  net.IP
+		ttl time.Duration
+		err error
+	)
+
+	if r.cfg.RespectTTL {
+		ip, ttl, err = dynhost.CurrentTXTRecordTTL(ctx, res, name, family)
+	} else {
+		ip, err = dynhost.CurrentTXTRecord(ctx, res, name, family)
+	}
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return []net.IP{ip}, ttl, nil
+}
+
+// recordResolver returns the resolver used to read the current value of the
+// hostname record: one of the authoritative nameservers of its zone if the
+// authoritative check is enabled and they can be found, or the configured
+// resolver otherwise, over TLS or not, defaulting to the system one.
+func recordResolver(ctx context.Context, cfg *Config, hostname string) *net.Resolver {
+	r := net.DefaultResolver
+	if cfg.ResolverDoT != "" {
+		r = dynhost.NewTLSResolver(cfg.ResolverDoT)
+	} else if cfg.Resolver != "" {
+		r = dynhost.NewResolver(cfg.Resolver)
+	}
+
+	if !cfg.AuthoritativeCheck {
+		return r
+	}
+
+	auth, err := dynhost.AuthoritativeResolver(ctx, r, hostname)
+	if err != nil {
+		warnf("Could not find the authoritative nameservers of %s: %v; falling back to the default resolver", hostname, err)
+		return r
+	}
+
+	return auth
+}
+
+// recordCache holds the values read from the records until their TTL
+// expires.
+type recordCache struct {
+	mu     sync.Mutex
+	values map[string]*cachedValue
+}
+
+type cachedValue struct {
+	ips     []net.IP
+	ttl     time.Duration
+	expires time.Time
+}
+
+// get returns the cached values of the hostname record of the family and
+// their remaining lifetime, or nil if they are unknown or expired.
+func (c *recordCache) get(hostname string, family dynhost.Family) ([]net.IP, time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v := c.values[recordName(hostname, family)]
+	if v == nil {
+		return nil, 0
+	}
+
+	left := time.Until(v.expires)
+	if left <= 0 {
+		return nil, 0
+	}
+
+	return v.ips, left
+}
+
+// set caches the values of the hostname record of the family for ttl.
+func (c *recordCache) set(hostname string, family dynhost.Family, ips []net.IP, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.values == nil {
+		c.values = make(map[string]*cachedValue)
+	}
+
+	c.values[recordName(hostname, family)] = &cachedValue{ips: ips, ttl: ttl, expires: time.Now().Add(ttl)}
+}
+
+// updated caches ip, just published to the hostname record of the family, for
+// the TTL last read from the record, if any: until then, resolvers may still
+// return the previous value.
+func (c *recordCache) updated(hostname string, family dynhost.Family, ip net.IP) {
+	c.mu.Lock()
+	ttl := time.Duration(0)
+	if v := c.values[recordName(hostname, family)]; v != nil {
+		ttl = v.ttl
+	}
+	c.mu.Unlock()
+
+	if ttl > 0 {
+		c.set(hostname, family, []net.IP{ip}, ttl)
+	}
+}
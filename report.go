@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"text/tabwriter"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// Actions listed in the report of a dry run.
+const (
+	actionUpdate   = "update"
+	actionNoChange = "no change"
+	actionSkip     = "skip"
+	actionFail     = "fail"
+)
+
+// reportRow is the action a dry run would take on a record.
+type reportRow struct {
+	Hostname string `json:"hostname"`
+	Type     string `json:"type"`
+	Current  string `json:"current"`
+	Detected string `json:"detected"`
+	Action   string `json:"action"`
+	Reason   string `json:"reason,omitempty"`
+}
+
+// dryRunReport lists the actions of a dry run, so that a configuration can be
+// validated at a glance. Its methods do nothing on a nil *dryRunReport.
+type dryRunReport struct {
+	mu   sync.Mutex
+	rows []reportRow
+}
+
+// add records the action that would be taken on the record of the family of
+// hostname, whose current values are current and whose public address is
+// detected.
+func (r *dryRunReport) add(hostname string, family dynhost.Family, current []net.IP, detected net.IP, action, reason string) {
+	if r == nil {
+		return
+	}
+
+	d := "unknown"
+	if detected != nil {
+		d = detected.String()
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.rows = append(r.rows, reportRow{
+		Hostname: hostname,
+		Type:     family.RecordType(),
+		Current:  describeIPs(current),
+		Detected: d,
+		Action:   action,
+		Reason:   reason,
+	})
+}
+
+// write writes the report to w, sorted by record, as a table or as a JSON
+// object.
+func (r *dryRunReport) write(w io.Writer, asJSON bool) error {
+	if r == nil {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sort.Slice(r.rows, func(i, j int) bool {
+		if r.rows[i].Hostname != r.rows[j].Hostname {
+			return r.rows[i].Hostname < r.rows[j].Hostname
+		}
+
+		return r.rows[i].Type < r.rows[j].Type
+	})
+
+	if asJSON {
+		return json.NewEncoder(w).Encode(struct {
+			Records []reportRow `json:"records"`
+		}{r.rows})
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+
+	fmt.Fprintln(tw, "HOSTNAME\tTYPE\tCURRENT\tDETECTED\tACTION\tREASON")
+
+	for _, row := range r.rows {
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", row.Hostname, row.Type, row.Current, row.Detected, row.Action, row.Reason)
+	}
+
+	return tw.Flush()
+}
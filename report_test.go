@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// brokenReader is a fakeReader failing to read the records of one hostname.
+type brokenReader struct {
+	*fakeReader
+	hostname string
+}
+
+func (r *brokenReader) currentValues(ctx context.Context, hostname string, family dynhost.Family) ([]net.IP, time.Duration, error) {
+	if hostname == r.hostname {
+		return nil, 0, errors.New("SERVFAIL")
+	}
+
+	return r.fakeReader.currentValues(ctx, hostname, family)
+}
+
+// captureStdout returns what f writes to the standard output.
+func captureStdout(t *testing.T, f func()) string {
+	t.Helper()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	f()
+
+	os.Stdout = stdout
+	w.Close()
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return string(out)
+}
+
+func TestDryRunReport(t *testing.T) {
+	// Each row is "hostname type action".
+	expected := []string{
+		"broken.example.com A fail",
+		"broken.example.com AAAA skip",
+		"current.example.com A no change",
+		"current.example.com AAAA skip",
+		"stale.example.com A update",
+		"stale.example.com AAAA skip",
+	}
+
+	for _, asJSON := range []bool{false, true} {
+		t.Run(fmt.Sprintf("JSON %v", asJSON), func(t *testing.T) {
+			if asJSON {
+				captureLogs(t)
+			}
+
+			cfg := loadTestConfig(t, `
+protocol = dual
+
+[ovh]
+username = user
+password = secret
+hostname = stale.example.com, current.example.com, broken.example.com
+`)
+
+			d := &fakeDetector{
+				ips:  map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")},
+				errs: map[dynhost.Family]error{dynhost.IPv6: errors.New("network is unreachable")},
+			}
+			r := &brokenReader{
+				fakeReader: &fakeReader{values: map[string][]net.IP{
+					"stale.example.com/A":   {net.ParseIP("198.51.100.1")},
+					"current.example.com/A": {net.ParseIP("203.0.113.7")},
+				}},
+				hostname: "broken.example.com",
+			}
+			u := &fakeUpdater{}
+
+			s := newTestSyncer(t, cfg, d, r, u)
+			s.dryRun = true
+
+			var err error
+
+			out := captureStdout(t, func() {
+				err = s.syncAll(context.Background())
+			})
+
+			if err == nil {
+				t.Fatal("the failure to read broken.example.com was not returned")
+			}
+
+			if calls := u.updates(); len(calls) != 0 {
+				t.Fatalf("the dry run sent the updates %v", calls)
+			}
+
+			var rows []string
+
+			if asJSON {
+				var report struct {
+					Records []reportRow `json:"records"`
+				}
+
+				if err := json.Unmarshal([]byte(out), &report); err != nil {
+					t.Fatalf("invalid report %q: %v", out, err)
+				}
+
+				for _, row := range report.Records {
+					rows = append(rows, strings.Join([]string{row.Hostname, row.Type, row.Action}, " "))
+				}
+			} else {
+				lines := strings.Split(strings.TrimSpace(out), "\n")
+
+				if !strings.HasPrefix(lines[0], "HOSTNAME") {
+					t.Fatalf("the report has no header:\n%s", out)
+				}
+
+				for _, line := range lines[1:] {
+					f := strings.Fields(line)
+
+					action := ""
+					for _, a := range []string{actionUpdate, actionNoChange, actionSkip, actionFail} {
+						if strings.Contains(line, "  "+a) {
+							action = a
+						}
+					}
+
+					rows = append(rows, strings.Join([]string{f[0], f[1], action}, " "))
+				}
+			}
+
+			if fmt.Sprint(rows) != fmt.Sprint(expected) {
+				t.Fatalf("got the rows %q, expected %q\n%s", rows, expected, out)
+			}
+		})
+	}
+}
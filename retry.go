@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// isTransient reports whether err may go away by trying again: network errors,
+// 5xx responses and the 911 DynHost response are transient, anything else
+// (such as a 4xx response) is not.
+func isTransient(err error) bool {
+	if pe, ok := err.(dynhost.ProviderErrors); ok {
+		for _, e := range pe {
+			if isTransient(e) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if errors.Is(err, dynhost.ErrServerError) {
+		return true
+	}
+
+	var se *dynhost.StatusError
+	if errors.As(err, &se) {
+		return se.Code >= 500
+	}
+
+	var ne net.Error
+	return errors.As(err, &ne)
+}
+
+// maxRetries bounds the retries key, and maxRetryDelay the delay between two
+// attempts.
+const (
+	maxRetries    = 10
+	maxRetryDelay = time.Hour
+)
+
+// retrier runs operations again with an exponential backoff when they fail
+// with a transient error.
+type retrier struct {
+	retries   int
+	baseDelay time.Duration
+
+	mu   sync.Mutex
+	rand *rand.Rand
+}
+
+func newRetrier(cfg *Config) *retrier {
+	return &retrier{
+		retries:   cfg.Retries,
+		baseDelay: cfg.RetryBaseDelay,
+		rand:      rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// do calls f until it succeeds, fails with a permanent error, the retry
+// budget is exhausted or ctx is done, and returns its last error.
+func (r *retrier) do(ctx context.Context, what string, f func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= r.retries || !isTransient(err) || ctx.Err() != nil {
+			return err
+		}
+
+		delay := r.backoff(attempt)
+
+		warnf("%s failed (attempt %d/%d): %v; retrying in %v", what, attempt+1, r.retries+1, err, delay)
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return err
+		}
+	}
+}
+
+// backoff returns the delay before the retry following attempt: the base
+// delay doubled on every attempt, up to maxRetryDelay, of which the upper half
+// is random jitter. A base delay of 0 retries immediately.
+func (r *retrier) backoff(attempt int) time.Duration {
+	if r.baseDelay <= 0 {
+		return 0
+	}
+
+	d := r.baseDelay
+	for i := 0; i < attempt && d < maxRetryDelay; i++ {
+		d *= 2
+	}
+
+	if d > maxRetryDelay {
+		d = maxRetryDelay
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return d/2 + time.Duration(r.rand.Int63n(int64(d/2)+1))
+}
+
+// maxServerErrorDoublings bounds the growth of the backoff after consecutive
+// server errors.
+const maxServerErrorDoublings = 4
+
+// serverBackoff suspends the updates of the hostnames whose provider replied
+// 911, its server error, for a time doubling on each consecutive 911.
+type serverBackoff struct {
+	mu       sync.Mutex
+	failures map[string]*serverFailure
+}
+
+// serverFailure counts the consecutive 911 responses to the updates of a
+// hostname, and tells when they may be tried again.
+type serverFailure struct {
+	count int
+	until time.Time
+}
+
+// failed records a 911 response to the updates of the hostname identified
+// by key, and returns how long they are suspended for.
+func (b *serverBackoff) failed(key string, base time.Duration) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.failures == nil {
+		b.failures = make(map[string]*serverFailure)
+	}
+
+	f := b.failures[key]
+	if f == nil {
+		f = &serverFailure{}
+		b.failures[key] = f
+	}
+
+	doublings := f.count
+	if doublings > maxServerErrorDoublings {
+		doublings = maxServerErrorDoublings
+	}
+
+	d := base << uint(doublings)
+
+	f.count++
+	f.until = time.Now().Add(d)
+
+	return d
+}
+
+// wait returns how much longer the updates of the hostname identified by key
+// are suspended, or 0.
+func (b *serverBackoff) wait(key string) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	f := b.failures[key]
+	if f == nil {
+		return 0
+	}
+
+	if left := time.Until(f.until); left > 0 {
+		return left
+	}
+
+	return 0
+}
+
+// reset forgets the 911 responses to the updates of the hostname identified
+// by key, which succeeded.
+func (b *serverBackoff) reset(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	delete(b.failures, key)
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+func TestRetrierRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		failures int
+		status   int
+		retries  int
+		requests int32
+		ok       bool
+	}{
+		{name: "no failure", failures: 0, status: http.StatusServiceUnavailable, retries: 2, requests: 1, ok: true},
+		{name: "recovers within the retries", failures: 2, status: http.StatusServiceUnavailable, retries: 2, requests: 3, ok: true},
+		{name: "retries exhausted", failures: 3, status: http.StatusServiceUnavailable, retries: 2, requests: 3},
+		{name: "no retries", failures: 1, status: http.StatusBadGateway, retries: 0, requests: 1},
+		{name: "client error", failures: 1, status: http.StatusUnauthorized, retries: 2, requests: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests int32
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if atomic.AddInt32(&requests, 1) <= int32(tt.failures) {
+					w.WriteHeader(tt.status)
+					return
+				}
+
+				fmt.Fprintln(w, "203.0.113.7")
+			}))
+			defer srv.Close()
+
+			r := retrier{
+				retries:   tt.retries,
+				baseDelay: time.Millisecond,
+				rand:      rand.New(rand.NewSource(1)),
+			}
+
+			p := dynhost.HTTPProvider{Client: srv.Client(), URL: srv.URL}
+
+			err := r.do(context.Background(), "Detection", func() error {
+				_, err := p.PublicIP(context.Background())
+				return err
+			})
+
+			if tt.ok && err != nil {
+				t.Fatal(err)
+			}
+
+			if !tt.ok && err == nil {
+				t.Fatal("the detection succeeded")
+			}
+
+			if n := atomic.LoadInt32(&requests); n != tt.requests {
+				t.Fatalf("%d request(s) were sent, expected %d", n, tt.requests)
+			}
+		})
+	}
+}
+
+func TestRetrierBackoff(t *testing.T) {
+	r := retrier{baseDelay: 100 * time.Millisecond, rand: rand.New(rand.NewSource(1))}
+
+	for attempt := 0; attempt < 4; attempt++ {
+		max := r.baseDelay << uint(attempt)
+
+		if d := r.backoff(attempt); d < max/2 || d > max {
+			t.Fatalf("attempt %d: backoff of %v, expected between %v and %v", attempt, d, max/2, max)
+		}
+	}
+}
+
+func TestRetrierBackoffBounds(t *testing.T) {
+	tests := []struct {
+		name      string
+		baseDelay time.Duration
+		attempt   int
+		min, max  time.Duration
+	}{
+		{name: "no delay", baseDelay: 0, attempt: 3, min: 0, max: 0},
+		// Shifting the base delay by the attempt would overflow.
+		{name: "large attempt", baseDelay: time.Second, attempt: 100, min: maxRetryDelay / 2, max: maxRetryDelay},
+		{name: "large base delay", baseDelay: 1000 * time.Hour, attempt: 1, min: maxRetryDelay / 2, max: maxRetryDelay},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := retrier{baseDelay: tt.baseDelay, rand: rand.New(rand.NewSource(1))}
+
+			if d := r.backoff(tt.attempt); d < tt.min || d > tt.max {
+				t.Fatalf("backoff of %v, expected between %v and %v", d, tt.min, tt.max)
+			}
+		})
+	}
+}
+
+func TestRetryKeys(t *testing.T) {
+	tests := []struct {
+		keys string
+		err  string
+	}{
+		{keys: "retries = -1", err: "retries cannot be negative"},
+		{keys: "retries = 11", err: "retries cannot exceed 10"},
+		{keys: "retry_base_delay = -1s", err: "retry_base_delay cannot be negative"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.keys, func(t *testing.T) {
+			err := loadTestConfigError(t, tt.keys+`
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+			if !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected an error containing %q, got %v", tt.err, err)
+			}
+		})
+	}
+
+	cfg := loadTestConfig(t, `
+retries = 10
+retry_base_delay = 0
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+	if cfg.Retries != 10 || cfg.RetryBaseDelay != 0 {
+		t.Fatalf("got %d retries after %v, expected 10 retries without delay", cfg.Retries, cfg.RetryBaseDelay)
+	}
+}
+
+func TestServerBackoffDoubling(t *testing.T) {
+	var b serverBackoff
+
+	const base = time.Minute
+
+	// The backoff doubles up to maxServerErrorDoublings times.
+	for i, expected := range []time.Duration{base, 2 * base, 4 * base, 8 * base, 16 * base, 16 * base} {
+		if d := b.failed("ovh home.example.com", base); d != expected {
+			t.Fatalf("suspended for %v after %d 911(s), expected %v", d, i+1, expected)
+		}
+	}
+
+	if left := b.wait("ovh home.example.com"); left <= 15*base || left > 16*base {
+		t.Fatalf("suspended for %v more, expected about %v", left, 16*base)
+	}
+
+	if left := b.wait("ovh nas.example.com"); left != 0 {
+		t.Fatalf("another hostname is suspended for %v", left)
+	}
+
+	b.reset("ovh home.example.com")
+
+	if left := b.wait("ovh home.example.com"); left != 0 {
+		t.Fatalf("suspended for %v after a success", left)
+	}
+}
+
+func TestServerErrorBackoff(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    string
+		section string
+		force   bool
+		updates int
+	}{
+		{name: "daemon", keys: "interval = 1m\nserver_error_backoff = 15m", updates: 1},
+		{name: "single run", keys: "server_error_backoff = 15m", updates: 2},
+		// Forced updates do not override the suspension either.
+		{name: "always_update", keys: "interval = 1m\nserver_error_backoff = 15m", section: "always_update = true\n", updates: 1},
+		{name: "force", keys: "interval = 1m\nserver_error_backoff = 15m", force: true, updates: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, tt.keys+`
+retries = 0
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`+tt.section)
+
+			d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+			r := &fakeReader{values: map[string][]net.IP{"home.example.com/A": {net.ParseIP("198.51.100.1")}}}
+			u := &fakeUpdater{errs: []error{&dynhost.OVHError{Provider: "ovh", Code: "911"}}}
+
+			s := newTestSyncer(t, cfg, d, r, u)
+			s.force = tt.force
+
+			if err := s.syncAll(context.Background()); err == nil {
+				t.Fatal("the 911 was not returned")
+			}
+
+			// The next cycle leaves the provider alone in daemon mode.
+			if err := s.syncAll(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if n := len(u.updates()); n != tt.updates {
+				t.Fatalf("%d update(s), expected %d", n, tt.updates)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// stages tracks the stages of a synchronization in progress, such as the
+// detection of an address or the update of a record, so that the ones a
+// deadline interrupts can be reported.
+type stages struct {
+	mu          sync.Mutex
+	active      map[string]int
+	interrupted map[string]bool
+}
+
+// begin marks the stage as in progress until the returned function is
+// called. The stage is interrupted if ctx exceeded its deadline by then.
+func (st *stages) begin(ctx context.Context, name string) func() {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	if st.active == nil {
+		st.active = make(map[string]int)
+	}
+
+	st.active[name]++
+
+	return func() {
+		st.mu.Lock()
+		defer st.mu.Unlock()
+
+		if st.active[name]--; st.active[name] == 0 {
+			delete(st.active, name)
+		}
+
+		if ctx.Err() == context.DeadlineExceeded {
+			if st.interrupted == nil {
+				st.interrupted = make(map[string]bool)
+			}
+
+			st.interrupted[name] = true
+		}
+	}
+}
+
+// String lists the stages interrupted since the last call, and those still in
+// progress.
+func (st *stages) String() string {
+	st.mu.Lock()
+	defer st.mu.Unlock()
+
+	seen := st.interrupted
+	st.interrupted = nil
+
+	if seen == nil {
+		seen = make(map[string]bool)
+	}
+
+	for name := range st.active {
+		seen[name] = true
+	}
+
+	if len(seen) == 0 {
+		return "no stage in progress"
+	}
+
+	names := make([]string, 0, len(seen))
+	for name := range seen {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// hungStage detects the public addresses, reads the records and updates them
+// only once ctx is done.
+type hungStage struct{}
+
+func (hungStage) PublicIP(ctx context.Context, family dynhost.Family) (net.IP, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func (hungStage) currentValues(ctx context.Context, hostname string, family dynhost.Family) ([]net.IP, time.Duration, error) {
+	<-ctx.Done()
+	return nil, 0, ctx.Err()
+}
+
+func (hungStage) Update(ctx context.Context, hostname string, addresses ...net.IP) (dynhost.Result, error) {
+	<-ctx.Done()
+	return dynhost.Result{}, ctx.Err()
+}
+
+func (hungStage) Request(ctx context.Context, hostname string, addresses ...net.IP) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, http.MethodGet, "https://dynhost.invalid/nic/update", nil)
+}
+
+func TestDeadlineSlowStage(t *testing.T) {
+	detected := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+	stale := &fakeReader{values: map[string][]net.IP{"home.example.com/A": {net.ParseIP("198.51.100.1")}}}
+
+	tests := []struct {
+		name  string
+		d     detector
+		r     recordReader
+		u     updater
+		stage string
+	}{
+		{name: "detection", d: hungStage{}, r: stale, u: &fakeUpdater{}, stage: "public IPv4 detection"},
+		{name: "lookup", d: detected, r: hungStage{}, u: &fakeUpdater{}, stage: "DNS lookup of home.example.com/A"},
+		{name: "update", d: detected, r: stale, u: hungStage{}, stage: "update of home.example.com/A"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+
+			cfg := loadTestConfig(t, `
+retries = 0
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+			s := newTestSyncer(t, cfg, tt.d, tt.r, tt.u)
+			s.deadline = 50 * time.Millisecond
+
+			start := time.Now()
+
+			if err := s.syncAll(context.Background()); err == nil {
+				t.Fatal("the synchronization succeeded")
+			}
+
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Fatalf("the synchronization returned after %v", elapsed)
+			}
+
+			expected := "Deadline of 50ms exceeded during: " + tt.stage
+			if !strings.Contains(logs(), expected) {
+				t.Fatalf("%q was not logged:\n%s", expected, logs())
+			}
+		})
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// recordState describes the last address successfully published to a
+// DynHost record.
+type recordState struct {
+	IP        net.IP    `json:"ip"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// state is persisted between runs in the state file.
+type state struct {
+	path string
+	mu   sync.Mutex
+
+	Records map[string]*recordState `json:"records"`
+
+	// Failures counts the consecutive runs that failed.
+	Failures int `json:"consecutive_failures"`
+}
+
+// loadState reads the state file at path. A missing or corrupt file is not an
+// error: an empty state is returned instead, so that the DNS record is used
+// as the source of truth.
+func loadState(path string) *state {
+	s := state{
+		path:    path,
+		Records: make(map[string]*recordState),
+	}
+
+	if path == "" {
+		return &s
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			warnf("Could not read the state file: %v; ignoring it", err)
+		}
+
+		return &s
+	}
+
+	if err := json.Unmarshal(b, &s); err != nil {
+		warnf("Could not parse the state file %s: %v; ignoring it", path, err)
+		return &state{path: path, Records: make(map[string]*recordState)}
+	}
+
+	if s.Records == nil {
+		s.Records = make(map[string]*recordState)
+	}
+
+	return &s
+}
+
+// record returns the state of the hostname record of the given family, or nil
+// if it is unknown.
+func (s *state) record(hostname string, family dynhost.Family) *recordState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Records[recordName(hostname, family)]
+}
+
+// published records that ip was published to the hostname record of the
+// given family and saves the state file.
+func (s *state) published(hostname string, family dynhost.Family, ip net.IP) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.Records[recordName(hostname, family)] = &recordState{
+		IP:        ip,
+		UpdatedAt: time.Now(),
+	}
+
+	return s.save()
+}
+
+// runFinished counts the consecutive failed runs, resetting the count after
+// a successful one, and returns it. The state file is saved if the count
+// changed.
+func (s *state) runFinished(failed bool) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !failed && s.Failures == 0 {
+		return 0, nil
+	}
+
+	if failed {
+		s.Failures++
+	} else {
+		s.Failures = 0
+	}
+
+	return s.Failures, s.save()
+}
+
+// consecutiveFailures returns the number of consecutive runs that failed.
+func (s *state) consecutiveFailures() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.Failures
+}
+
+// save atomically replaces the state file with the current state.
+func (s *state) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	b, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(s.path), ".go-dynhost-state")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
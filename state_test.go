@@ -0,0 +1,50 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRunFinished(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+
+	s := loadState(path)
+
+	runs := []struct {
+		failed   bool
+		expected int
+	}{
+		{failed: false, expected: 0},
+		{failed: true, expected: 1},
+		{failed: true, expected: 2},
+		{failed: true, expected: 3},
+		{failed: false, expected: 0},
+		{failed: true, expected: 1},
+	}
+
+	for i, run := range runs {
+		n, err := s.runFinished(run.failed)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != run.expected || s.consecutiveFailures() != run.expected {
+			t.Fatalf("run %d: %d consecutive failure(s), expected %d", i+1, n, run.expected)
+		}
+
+		// The count survives the restarts.
+		if saved := loadState(path).consecutiveFailures(); saved != run.expected {
+			t.Fatalf("run %d: %d consecutive failure(s) in the state file, expected %d", i+1, saved, run.expected)
+		}
+	}
+}
+
+func TestRunFinishedWithoutStateFile(t *testing.T) {
+	s := loadState("")
+
+	for i := 1; i <= 2; i++ {
+		if n, err := s.runFinished(true); err != nil || n != i {
+			t.Fatalf("run %d: %d consecutive failure(s) (%v), expected %d", i, n, err, i)
+		}
+	}
+}
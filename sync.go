@@ -0,0 +1,858 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// syncer keeps the DynHost records in sync with the public addresses.
+type syncer struct {
+	cfg      *Config
+	client   *http.Client
+	detector detector
+	reader   recordReader
+	updaters map[*Account]updater
+	retrier  *retrier
+	state    *state
+	dryRun   bool
+	force    bool
+
+	// check only reports the records out of date, counting them in
+	// drifted, accessed atomically.
+	check   bool
+	drifted int32
+
+	notifiers []notifier
+
+	// deadline bounds the duration of syncAll, if not 0.
+	deadline time.Duration
+	stages   stages
+
+	// records caches the values read from the records when respect_ttl is
+	// set.
+	records recordCache
+
+	// metrics collects the statistics of the daemon, if not nil.
+	metrics *metrics
+
+	// detectionFailures counts the consecutive cycles in which the public
+	// address of each family could not be detected.
+	detectionFailures map[dynhost.Family]int
+
+	// updateFailures counts the consecutive cycles in which each record
+	// could not be updated.
+	updateFailures *failureStreaks
+
+	// ips are the addresses published instead of the detected ones, by
+	// family.
+	ips map[dynhost.Family]net.IP
+
+	// serverErrors suspends the updates of the hostnames whose provider
+	// replied 911, in daemon mode.
+	serverErrors *serverBackoff
+
+	// report lists the actions of the dry run in progress, if any.
+	report *dryRunReport
+
+	// debounce holds the public addresses waiting to be stable before they
+	// are published, in daemon mode.
+	debounce *debouncer
+}
+
+// newSyncer returns a syncer of the records configured in cfg, detecting the
+// public addresses and updating the records through client, and reading their
+// current value through reader.
+func newSyncer(cfg *Config, client *http.Client, reader recordReader) (*syncer, error) {
+	d, err := newIPDetector(cfg, client)
+	if err != nil {
+		return nil, err
+	}
+
+	s := syncer{
+		cfg:      cfg,
+		client:   client,
+		detector: d,
+		reader:   reader,
+		updaters: make(map[*Account]updater),
+		retrier:  newRetrier(cfg),
+		state:    loadState(cfg.StateFile),
+
+		notifiers:         newNotifiers(cfg, client),
+		detectionFailures: make(map[dynhost.Family]int),
+		updateFailures:    &failureStreaks{},
+		debounce:          &debouncer{},
+		serverErrors:      &serverBackoff{},
+	}
+
+	for _, account := range cfg.Accounts {
+		s.updaters[account] = newUpdater(cfg, account, client)
+	}
+
+	return &s, nil
+}
+
+// recordName identifies the record of the family of hostname in logs.
+func recordName(hostname string, family dynhost.Family) string {
+	return hostname + "/" + family.RecordType()
+}
+
+// syncJob is the synchronization of a record with the public address of its
+// family.
+type syncJob struct {
+	account  *Account
+	hostname string
+	family   dynhost.Family
+	publicIP net.IP
+}
+
+// detectionError is the failure of a record whose public address could not be
+// detected.
+type detectionError struct {
+	err error
+}
+
+func (e *detectionError) Error() string {
+	return e.err.Error()
+}
+
+func (e *detectionError) Unwrap() error {
+	return e.err
+}
+
+// syncErrors aggregates the failures of the records of a run.
+type syncErrors []error
+
+func (se syncErrors) Error() string {
+	msgs := make([]string, 0, len(se))
+
+	for _, err := range se {
+		msgs = append(msgs, err.Error())
+	}
+
+	return fmt.Sprintf("%d record(s) failed: %s", len(se), strings.Join(msgs, "; "))
+}
+
+// syncAll detects the public address of each family once, and synchronizes
+// the records of every hostname with it, concurrently. Failures are logged
+// and do not stop the synchronization of the other records; syncAll returns
+// them all once every record has been handled. In dual-stack mode, the
+// records of a family whose public address is not detected are skipped, as
+// long as the address of the other one is.
+func (s *syncer) syncAll(ctx context.Context) error {
+	var (
+		jobs      []syncJob
+		errs      syncErrors
+		succeeded int
+
+		// Results of each family, reported separately in dual-stack mode.
+		synced  = make(map[dynhost.Family]int)
+		failed  = make(map[dynhost.Family]int)
+		skipped = make(map[dynhost.Family]bool)
+	)
+
+	dual := len(s.cfg.Families) > 1
+
+	defer s.timed("cycle", "The synchronization")()
+
+	// Checks report the records out of date instead.
+	if s.dryRun && !s.check {
+		s.report = &dryRunReport{}
+
+		defer func() {
+			if err := s.report.write(os.Stdout, jsonLogs); err != nil {
+				warnf("Could not write the report of the dry run: %v", err)
+			}
+
+			s.report = nil
+		}()
+	}
+
+	if s.deadline > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, s.deadline)
+		defer cancel()
+
+		defer func() {
+			if ctx.Err() == context.DeadlineExceeded {
+				errorf("Deadline of %v exceeded during: %s", s.deadline, &s.stages)
+			}
+		}()
+	}
+
+	var (
+		publicIPs = make(map[dynhost.Family]net.IP)
+		detectErr = make(map[dynhost.Family]error)
+	)
+
+	for _, family := range s.cfg.Families {
+		publicIP, err := s.detect(ctx, family)
+		if err != nil {
+			detectErr[family] = err
+			continue
+		}
+
+		with(fields{"ip": publicIP}).infof("Public %s: %s", family, publicIP.String())
+
+		publicIPs[family] = publicIP
+		s.detectionFailures[family] = 0
+		s.metrics.detected(family, publicIP)
+	}
+
+	for _, family := range s.cfg.Families {
+		err, ok := detectErr[family]
+		if !ok {
+			for _, account := range s.cfg.Accounts {
+				for _, hostname := range account.Hostnames {
+					jobs = append(jobs, syncJob{account: account, hostname: hostname, family: family, publicIP: publicIPs[family]})
+				}
+			}
+
+			continue
+		}
+
+		// Hosts may lose the connectivity of one family at times: the
+		// records of the others are still updated without it.
+		optional := dual && len(publicIPs) > 0 && ctx.Err() == nil
+
+		if optional {
+			warnf("Could not get my public %s address: %v; skipping the %s records", family, err, family.RecordType())
+		} else {
+			errorf("Could not get my public %s address: %v", family, err)
+		}
+
+		if s.detectionFailures[family]++; s.detectionFailures[family] == s.cfg.DetectionFailureThreshold && ctx.Err() == nil {
+			s.notifyDetectionFailure(ctx, &detectionFailure{
+				Family: family,
+				Cycles: s.detectionFailures[family],
+				Err:    err,
+				Time:   time.Now().UTC(),
+			})
+		}
+
+		if optional {
+			skipped[family] = true
+			s.metrics.skipped(family)
+
+			for _, account := range s.cfg.Accounts {
+				for _, hostname := range account.Hostnames {
+					s.report.add(hostname, family, nil, nil, actionSkip, fmt.Sprintf("no public %s address", family))
+				}
+			}
+
+			continue
+		}
+
+		for _, account := range s.cfg.Accounts {
+			for _, hostname := range account.Hostnames {
+				errs = append(errs, fmt.Errorf("%s: %w", recordName(hostname, family), &detectionError{err}))
+				failed[family]++
+				s.report.add(hostname, family, nil, nil, actionFail, err.Error())
+			}
+		}
+	}
+
+	for i, err := range s.runJobs(ctx, jobs) {
+		name := recordName(jobs[i].hostname, jobs[i].family)
+
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", name, err))
+			failed[jobs[i].family]++
+			s.report.add(jobs[i].hostname, jobs[i].family, nil, jobs[i].publicIP, actionFail, err.Error())
+			continue
+		}
+
+		succeeded++
+		synced[jobs[i].family]++
+	}
+
+	if dual {
+		for _, family := range s.cfg.Families {
+			if skipped[family] {
+				infof("%s summary: skipped, no public address", family)
+				continue
+			}
+
+			infof("%s summary: %d record(s) synchronized, %d failed", family, synced[family], failed[family])
+		}
+	}
+
+	if succeeded+len(errs) > 1 {
+		summary := fmt.Sprintf("Summary: %d record(s) synchronized, %d failed", succeeded, len(errs))
+
+		for _, family := range s.cfg.Families {
+			if skipped[family] {
+				summary += fmt.Sprintf(", %s records skipped", family.RecordType())
+			}
+		}
+
+		infof("%s", summary)
+	}
+
+	// Dry runs and checks leave the state alone, and runs interrupted on
+	// exit did not really fail.
+	if !s.dryRun && ctx.Err() != context.Canceled {
+		n, err := s.state.runFinished(len(errs) > 0)
+		if err != nil {
+			warnf("Could not save the state file: %v", err)
+		}
+
+		if n > 1 {
+			warnf("%d consecutive runs failed", n)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+
+	return nil
+}
+
+// runJobs runs the jobs with a bounded number of workers, and returns their
+// errors in the same order. The A and AAAA jobs of a hostname are run
+// together if its account combines their updates. Jobs not started yet when
+// ctx is done fail with its error.
+func (s *syncer) runJobs(ctx context.Context, jobs []syncJob) []error {
+	errs := make([]error, len(jobs))
+	groups := make(chan []int)
+
+	var wg sync.WaitGroup
+
+	for w := 0; w < s.cfg.Concurrency; w++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for g := range groups {
+				if err := ctx.Err(); err != nil {
+					for _, i := range g {
+						errs[i] = err
+					}
+
+					continue
+				}
+
+				if len(g) == 2 {
+					errs[g[0]], errs[g[1]] = s.syncPair(ctx, jobs[g[0]], jobs[g[1]])
+				} else {
+					j := jobs[g[0]]
+					errs[g[0]] = s.syncRecord(ctx, j.account, j.hostname, j.family, j.publicIP)
+				}
+
+				for _, i := range g {
+					if j := jobs[i]; errs[i] != nil {
+						with(fields{"hostname": j.hostname, "type": j.family.RecordType()}).errorf("Could not synchronize %s: %v", recordName(j.hostname, j.family), errs[i])
+					}
+				}
+			}
+		}()
+	}
+
+	for _, g := range groupJobs(jobs) {
+		groups <- g
+	}
+
+	close(groups)
+	wg.Wait()
+
+	return errs
+}
+
+// groupJobs returns the indexes of the jobs to run together: the A and AAAA
+// jobs of a hostname whose account combines their updates are paired, and
+// the other jobs are alone.
+func groupJobs(jobs []syncJob) [][]int {
+	type key struct {
+		account  *Account
+		hostname string
+	}
+
+	var groups [][]int
+
+	pairs := make(map[key]int)
+
+	for i, j := range jobs {
+		if j.account.CombinedUpdate {
+			k := key{j.account, j.hostname}
+
+			if g, ok := pairs[k]; ok && len(groups[g]) == 1 && jobs[groups[g][0]].family != j.family {
+				groups[g] = append(groups[g], i)
+				continue
+			}
+
+			pairs[k] = len(groups)
+		}
+
+		groups = append(groups, []int{i})
+	}
+
+	return groups
+}
+
+// detect returns the public address of the family, or the one given on the
+// command line.
+func (s *syncer) detect(ctx context.Context, family dynhost.Family) (net.IP, error) {
+	if ip := s.ips[family]; ip != nil {
+		infof("Using the %s address given on the command line; skipping the detection", family)
+		return ip, nil
+	}
+
+	var publicIP net.IP
+
+	defer s.stages.begin(ctx, "public "+family.String()+" detection")()
+	defer s.timed("detection", "The public "+family.String()+" detection")()
+
+	err := s.retrier.do(ctx, "Public "+family.String()+" detection", func() (err error) {
+		publicIP, err = s.detector.PublicIP(ctx, family)
+		return err
+	})
+
+	if err == nil && !allowedAddress(publicIP, family, s.cfg.AllowedCIDRs) {
+		return nil, fmt.Errorf("%v is outside of allowed_cidrs (%s): refusing to publish it", publicIP, formatCIDRs(s.cfg.AllowedCIDRs, family))
+	}
+
+	if err == nil && dynhost.IsCGNAT(publicIP) {
+		if s.cfg.FailOnCGNAT {
+			return nil, fmt.Errorf("%v is a carrier-grade NAT address, which cannot be reached from the Internet", publicIP)
+		}
+
+		warnf("%v is a carrier-grade NAT address: this host is behind its carrier's NAT and cannot be reached from the Internet at this address. Publishing it anyway; set fail_on_cgnat = true to refuse", publicIP)
+	}
+
+	return publicIP, err
+}
+
+// allowedAddress reports whether ip belongs to one of the allowed ranges of
+// the family. Any address is allowed if none of the family is listed.
+func allowedAddress(ip net.IP, family dynhost.Family, allowed []*net.IPNet) bool {
+	listed := false
+
+	for _, n := range allowed {
+		if !family.Matches(n.IP) {
+			continue
+		}
+
+		if n.Contains(ip) {
+			return true
+		}
+
+		listed = true
+	}
+
+	return !listed
+}
+
+// formatCIDRs returns the comma-separated ranges of nets of the family.
+func formatCIDRs(nets []*net.IPNet, family dynhost.Family) string {
+	var s []string
+
+	for _, n := range nets {
+		if family.Matches(n.IP) {
+			s = append(s, n.String())
+		}
+	}
+
+	return strings.Join(s, ", ")
+}
+
+// syncRecord compares publicIP with the DynHost record of the family of
+// hostname, and updates the latter through account if they differ.
+func (s *syncer) syncRecord(ctx context.Context, account *Account, hostname string, family dynhost.Family, publicIP net.IP) error {
+	u, err := s.checkRecord(ctx, account, hostname, family, publicIP)
+	if u == nil {
+		return err
+	}
+
+	return s.update(ctx, account, hostname, u)
+}
+
+// syncPair synchronizes the A and AAAA records of hostname as syncRecord
+// does, updating both in a single request if they are both out of date.
+func (s *syncer) syncPair(ctx context.Context, a, b syncJob) (error, error) {
+	ua, errA := s.checkRecord(ctx, a.account, a.hostname, a.family, a.publicIP)
+	ub, errB := s.checkRecord(ctx, b.account, b.hostname, b.family, b.publicIP)
+
+	switch {
+	case ua != nil && ub != nil:
+		err := s.update(ctx, a.account, a.hostname, ua, ub)
+		return err, err
+	case ua != nil:
+		return s.update(ctx, a.account, a.hostname, ua), errB
+	case ub != nil:
+		return errA, s.update(ctx, b.account, b.hostname, ub)
+	}
+
+	return errA, errB
+}
+
+// backoffKey identifies the updates of hostname through account in
+// serverBackoff.
+func backoffKey(account *Account, hostname string) string {
+	return account.Name + " " + hostname
+}
+
+// pendingUpdate is a record to update to the public address of its family.
+type pendingUpdate struct {
+	family     dynhost.Family
+	publicIP   net.IP
+	currentIPs []net.IP
+	log        *entry
+}
+
+// oldIP returns the first value of the record before the update, or nil if
+// it could not be read.
+func (u *pendingUpdate) oldIP() net.IP {
+	if len(u.currentIPs) == 0 {
+		return nil
+	}
+
+	return u.currentIPs[0]
+}
+
+// checkRecord compares publicIP with the DynHost record of the family of
+// hostname, and returns the update it needs, or nil if it must not be
+// updated.
+func (s *syncer) checkRecord(ctx context.Context, account *Account, hostname string, family dynhost.Family, publicIP net.IP) (*pendingUpdate, error) {
+	name := recordName(hostname, family)
+	l := with(fields{"hostname": hostname, "type": family.RecordType(), "new_ip": publicIP})
+
+	// Checks compare the actual records with the public address, regardless
+	// of the state. always_update only ignores whether the records of the
+	// account look up-to-date: unlike -force, it neither tolerates lookup
+	// errors nor skips the debounce.
+	force := s.force && !s.check
+	always := (s.force || account.AlwaysUpdate) && !s.check
+
+	rs := s.state.record(hostname, family)
+	published := !always && !s.check && rs != nil && dynhost.SameIP(publicIP, rs.IP)
+
+	alreadyPublished := func() {
+		l.infof("%s was already published to %s on %s; nothing to do.", publicIP, name, rs.UpdatedAt.Format(time.RFC3339))
+		s.debounce.reset(name)
+		s.report.add(hostname, family, []net.IP{rs.IP}, publicIP, actionNoChange, "published on "+rs.UpdatedAt.Format(time.RFC3339)+" according to the state file")
+	}
+
+	// The state cannot tell whether the record was reset to a placeholder
+	// since it was published: it is only trusted without placeholders, or
+	// once the record was read.
+	if published && len(s.cfg.PlaceholderIPs) == 0 {
+		alreadyPublished()
+		return nil, nil
+	}
+
+	values, err := s.currentValues(ctx, hostname, family)
+
+	if published && s.placeholder(values) == nil {
+		alreadyPublished()
+		return nil, nil
+	}
+
+	var noRecord *dynhost.NoRecordError
+
+	switch {
+	case errors.As(err, &noRecord):
+		// A missing record is out of date rather than unreadable.
+		l.infof("%s has no %s record yet; it needs to be created.", hostname, family.RecordType())
+	case err != nil:
+		if !force {
+			return nil, fmt.Errorf("could not get the current DynHost value: %w", err)
+		}
+
+		l.warnf("Could not get the current DynHost value of %s: %v", name, err)
+	default:
+		l.fields["old_ip"] = ipsField(values)
+		l.infof("Current DynHost value of %s: %s", name, describeIPs(values))
+	}
+
+	if ip := s.placeholder(values); ip != nil {
+		l.infof("%s holds the placeholder address %s; it needs to be initialized.", name, ip)
+	}
+
+	if s.upToDate(values, publicIP) {
+		if !always {
+			l.infof("The DynHost record %s is up-to-date.", name)
+			s.debounce.reset(name)
+			s.report.add(hostname, family, values, publicIP, actionNoChange, "")
+			return nil, nil
+		}
+
+		l.infof("The DynHost record %s is up-to-date; forcing the update.", name)
+	}
+
+	if s.check {
+		atomic.AddInt32(&s.drifted, 1)
+		l.changef("%s is out of date: %s instead of %s.", name, describeIPs(values), publicIP)
+		return nil, nil
+	}
+
+	// A single run cannot tell whether the address is stable.
+	if s.cfg.Debounce > 0 && s.cfg.Interval > 0 && !force {
+		if left := s.debounce.wait(name, publicIP, s.cfg.Debounce); left > 0 {
+			l.infof("Not updating %s yet: the public address changed to %s, which must remain stable for %v more.", name, publicIP, left.Round(time.Second))
+			s.report.add(hostname, family, values, publicIP, actionSkip, fmt.Sprintf("debounce: %v left", left.Round(time.Second)))
+			return nil, nil
+		}
+	}
+
+	if left := s.serverErrors.wait(backoffKey(account, hostname)); left > 0 {
+		l.warnf("Not updating %s: the %s API replied 911 to its last update; trying again in %v.", name, account.Provider, left.Round(time.Second))
+		s.report.add(hostname, family, values, publicIP, actionSkip, fmt.Sprintf("911 backoff: %v left", left.Round(time.Second)))
+		return nil, nil
+	}
+
+	if rs := s.state.record(hostname, family); s.cfg.MinUpdateInterval > 0 && rs != nil {
+		if since := time.Since(rs.UpdatedAt); since < s.cfg.MinUpdateInterval {
+			l.warnf("Not updating %s: it was last updated %v ago, less than the min_update_interval of %v.", name, since.Round(time.Second), s.cfg.MinUpdateInterval)
+			s.report.add(hostname, family, values, publicIP, actionSkip, fmt.Sprintf("updated %v ago, less than min_update_interval", since.Round(time.Second)))
+			return nil, nil
+		}
+	}
+
+	return &pendingUpdate{
+		family:     family,
+		publicIP:   publicIP,
+		currentIPs: values,
+		log:        l,
+	}, nil
+}
+
+// upToDate reports whether the values of a record hold publicIP: as their
+// only value, or among them if the record may have other values. A record
+// holding a placeholder address is never up-to-date.
+func (s *syncer) upToDate(values []net.IP, publicIP net.IP) bool {
+	if s.placeholder(values) != nil {
+		return false
+	}
+
+	if s.cfg.RecordMatch == recordMatchMember {
+		for _, ip := range values {
+			if dynhost.SameIP(ip, publicIP) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return len(values) == 1 && dynhost.SameIP(values[0], publicIP)
+}
+
+// placeholder returns the first of values that is one of the placeholder_ips,
+// or nil.
+func (s *syncer) placeholder(values []net.IP) net.IP {
+	for _, ip := range values {
+		for _, p := range s.cfg.PlaceholderIPs {
+			if dynhost.SameIP(ip, p) {
+				return ip
+			}
+		}
+	}
+
+	return nil
+}
+
+// update applies the updates of the records of hostname through account, in
+// a single request.
+func (s *syncer) update(ctx context.Context, account *Account, hostname string, updates ...*pendingUpdate) error {
+	var (
+		names       []string
+		addresses   []net.IP
+		transitions []string
+	)
+
+	for _, u := range updates {
+		// The old value is logged even if the record could not be read.
+		u.log.fields["old_ip"] = ipsField(u.currentIPs)
+
+		names = append(names, recordName(hostname, u.family))
+		addresses = append(addresses, u.publicIP)
+		transitions = append(transitions, fmt.Sprintf("%s from %s to %s", recordName(hostname, u.family), describeIPs(u.currentIPs), u.publicIP))
+	}
+
+	name := strings.Join(names, " and ")
+
+	if s.dryRun {
+		req, err := s.updaters[account].Request(ctx, hostname, addresses...)
+		if err != nil {
+			return fmt.Errorf("could not build the update request: %w", err)
+		}
+
+		for _, u := range updates {
+			u.log.fields["dry_run"] = true
+
+			reason := ""
+			if s.upToDate(u.currentIPs, u.publicIP) {
+				reason = "forced"
+			}
+
+			s.report.add(hostname, u.family, u.currentIPs, u.publicIP, actionUpdate, reason)
+		}
+
+		updates[0].log.changef("Dry run; not updating %s. This request was not sent: %s", strings.Join(transitions, " and "), describeRequest(req))
+		return nil
+	}
+
+	var res dynhost.Result
+
+	end := s.stages.begin(ctx, "update of "+name)
+
+	timeout := account.updateTimeout(hostname, s.cfg.HTTPTimeout)
+
+	err := s.retrier.do(ctx, "DynHost update of "+name, func() (err error) {
+		ctx, cancel := context.WithTimeout(ctx, timeout)
+		defer cancel()
+
+		defer s.timed("update", "The DynHost update of "+name)()
+
+		res, err = s.updaters[account].Update(ctx, hostname, addresses...)
+		return err
+	})
+
+	end()
+
+	if err != nil {
+		// The retries did not give the server of the provider enough time
+		// to recover: the next cycles leave it alone for a while.
+		if errors.Is(err, dynhost.ErrServerError) && s.cfg.Interval > 0 {
+			d := s.serverErrors.failed(backoffKey(account, hostname), s.cfg.ServerErrorBackoff)
+			warnf("The %s API still replies 911 to the updates of %s; suspending them for %v", account.Provider, hostname, d)
+		}
+
+		// Interrupted updates did not really fail, and the notifiers are
+		// only told once per streak of failures.
+		if ctx.Err() == nil {
+			for _, u := range updates {
+				n := s.updateFailures.failed(recordName(hostname, u.family))
+				if n != s.cfg.UpdateFailureThreshold {
+					continue
+				}
+
+				s.notifyFailure(ctx, &updateFailure{
+					Hostname: hostname,
+					Type:     u.family.RecordType(),
+					IP:       u.publicIP,
+					Cycles:   n,
+					Err:      err,
+					Time:     time.Now().UTC(),
+					family:   u.family,
+				})
+			}
+		}
+
+		return fmt.Errorf("could not update the DynHost record: %w", err)
+	}
+
+	for _, u := range updates {
+		// Providers not replying with the codes of the protocol do not
+		// tell whether the record changed: a forced update to the same
+		// address is not a change.
+		changed := res.Changed
+		if res.Code == "" {
+			changed = len(u.currentIPs) != 1 || !dynhost.SameIP(u.publicIP, u.currentIPs[0])
+		}
+
+		l := u.log
+		l.fields["provider"] = account.Provider
+		l.fields["changed"] = changed
+
+		if res.Detail != "" {
+			l.fields["response"] = res.Detail
+		}
+
+		if changed {
+			l.changef("DynHost %s updated from %s to %s", recordName(hostname, u.family), describeIPs(u.currentIPs), u.publicIP)
+		} else {
+			l.infof("DynHost %s unchanged: the provider already held %s (the record read %s)", recordName(hostname, u.family), u.publicIP, describeIPs(u.currentIPs))
+		}
+
+		if s.cfg.RespectTTL {
+			s.records.updated(hostname, u.family, u.publicIP)
+		}
+
+		s.debounce.reset(recordName(hostname, u.family))
+		s.serverErrors.reset(backoffKey(account, hostname))
+		s.updateFailures.reset(recordName(hostname, u.family))
+
+		if err := s.state.published(hostname, u.family, u.publicIP); err != nil {
+			warnf("Could not save the state file: %v", err)
+		}
+
+		if changed {
+			s.metrics.changed()
+			s.notifyChange(ctx, &ipChange{
+				Hostname: hostname,
+				Type:     u.family.RecordType(),
+				OldIP:    u.oldIP(),
+				NewIP:    u.publicIP,
+				Time:     time.Now().UTC(),
+				family:   u.family,
+			})
+		}
+	}
+
+	return nil
+}
+
+// describeIPs returns the values of a record as a string, or "unknown" if
+// there are none, e.g. when the record could not be read.
+func describeIPs(ips []net.IP) string {
+	if len(ips) == 0 {
+		return "unknown"
+	}
+
+	strs := make([]string, 0, len(ips))
+	for _, ip := range ips {
+		strs = append(strs, ip.String())
+	}
+
+	return strings.Join(strs, ", ")
+}
+
+// ipsField returns the values of a record as a log field: the address itself
+// if there is a single one, the list otherwise, or nil if there are none.
+func ipsField(ips []net.IP) interface{} {
+	switch len(ips) {
+	case 0:
+		return nil
+	case 1:
+		return ips[0]
+	}
+
+	return ips
+}
+
+// currentValues returns the current values of the DynHost record of the
+// family of hostname, giving up after the DNS timeout.
+func (s *syncer) currentValues(ctx context.Context, hostname string, family dynhost.Family) ([]net.IP, error) {
+	if s.cfg.RespectTTL {
+		if ips, left := s.records.get(hostname, family); ips != nil {
+			debugf("Using the cached value of %s for another %v", recordName(hostname, family), left.Round(time.Second))
+			return ips, nil
+		}
+	}
+
+	defer s.stages.begin(ctx, "DNS lookup of "+recordName(hostname, family))()
+	defer s.timed("lookup", "The DNS lookup of "+recordName(hostname, family))()
+
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.DNSTimeout)
+	defer cancel()
+
+	ips, ttl, err := s.reader.currentValues(ctx, hostname, family)
+	if err == nil && s.cfg.RespectTTL && ttl > 0 {
+		s.records.set(hostname, family, ips, ttl)
+	}
+
+	return ips, err
+}
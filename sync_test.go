@@ -0,0 +1,1026 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// loadTestConfig loads the configuration body, written to a temporary file.
+func loadTestConfig(t *testing.T, body string) *Config {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "dynhost.cfg")
+
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg, err := loadConfig(path, "", "")
+	if err != nil {
+		t.Fatalf("could not load the configuration: %v", err)
+	}
+
+	return cfg
+}
+
+// fakeDetector returns the addresses of ips, or the errors of errs, by
+// family.
+type fakeDetector struct {
+	ips  map[dynhost.Family]net.IP
+	errs map[dynhost.Family]error
+}
+
+func (d *fakeDetector) PublicIP(ctx context.Context, family dynhost.Family) (net.IP, error) {
+	if err := d.errs[family]; err != nil {
+		return nil, err
+	}
+
+	if ip := d.ips[family]; ip != nil {
+		return ip, nil
+	}
+
+	return nil, fmt.Errorf("no %s address", family)
+}
+
+// fakeReader returns the values of the records by record name, and counts
+// the lookups.
+type fakeReader struct {
+	mu      sync.Mutex
+	values  map[string][]net.IP
+	err     error
+	lookups int
+}
+
+func (r *fakeReader) currentValues(ctx context.Context, hostname string, family dynhost.Family) ([]net.IP, time.Duration, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.lookups++
+
+	if r.err != nil {
+		return nil, 0, r.err
+	}
+
+	ips, ok := r.values[recordName(hostname, family)]
+	if !ok {
+		return nil, 0, &dynhost.NoRecordError{Family: family}
+	}
+
+	return ips, 0, nil
+}
+
+// updateCall is an update received by fakeUpdater.
+type updateCall struct {
+	hostname  string
+	addresses []net.IP
+}
+
+// fakeUpdater records the updates, and replies with the errors of errs in
+// order, then successfully. The updates are also sent to sent, if not nil,
+// unless it is full.
+type fakeUpdater struct {
+	mu    sync.Mutex
+	calls []updateCall
+	errs  []error
+	sent  chan updateCall
+}
+
+func (u *fakeUpdater) Update(ctx context.Context, hostname string, addresses ...net.IP) (dynhost.Result, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	call := updateCall{hostname: hostname, addresses: addresses}
+	u.calls = append(u.calls, call)
+
+	select {
+	case u.sent <- call:
+	default:
+	}
+
+	if len(u.errs) > 0 {
+		err := u.errs[0]
+		u.errs = u.errs[1:]
+
+		return dynhost.Result{}, err
+	}
+
+	return dynhost.Result{Changed: true, Code: "good", IPs: addresses}, nil
+}
+
+func (u *fakeUpdater) Request(ctx context.Context, hostname string, addresses ...net.IP) (*http.Request, error) {
+	return http.NewRequestWithContext(ctx, http.MethodGet, "https://dynhost.invalid/nic/update?hostname="+hostname, nil)
+}
+
+func (u *fakeUpdater) updates() []updateCall {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	return append([]updateCall{}, u.calls...)
+}
+
+// newTestSyncer returns a syncer of cfg detecting the addresses with d and
+// reading the records with r, whose accounts all update through u.
+func newTestSyncer(t *testing.T, cfg *Config, d detector, r recordReader, u updater) *syncer {
+	t.Helper()
+
+	s, err := newSyncer(cfg, http.DefaultClient, r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.detector = d
+
+	for account := range s.updaters {
+		s.updaters[account] = u
+	}
+
+	return s
+}
+
+// ovhRequests are the requests received by fakeOVH.
+type ovhRequests struct {
+	mu      sync.Mutex
+	queries []url.Values
+}
+
+func (o *ovhRequests) list() []url.Values {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+
+	return append([]url.Values{}, o.queries...)
+}
+
+// fakeOVH is an update endpoint recording the requests it receives, and
+// replying "good" to all of them.
+func fakeOVH(t *testing.T) (*httptest.Server, *ovhRequests) {
+	var reqs ovhRequests
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reqs.mu.Lock()
+		reqs.queries = append(reqs.queries, r.URL.Query())
+		reqs.mu.Unlock()
+
+		fmt.Fprintf(w, "good %s", r.URL.Query().Get("myip"))
+	}))
+
+	t.Cleanup(srv.Close)
+
+	return srv, &reqs
+}
+
+func TestSyncAllProviderResponses(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		ok     bool
+	}{
+		{name: "surrounding whitespace", status: http.StatusOK, body: " \t203.0.113.7\r\n", ok: true},
+		{name: "whitespace only", status: http.StatusOK, body: " \n\t"},
+		{name: "empty body", status: http.StatusOK, body: ""},
+		{name: "HTML page", status: http.StatusOK, body: "<html><body><h1>Welcome to the portal</h1></body></html>"},
+		{name: "HTML error page", status: http.StatusBadGateway, body: "<html><body><h1>502 Bad Gateway</h1></body></html>"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			provider := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, tt.body)
+			}))
+			defer provider.Close()
+
+			ovh, reqs := fakeOVH(t)
+
+			cfg := loadTestConfig(t, fmt.Sprintf(`
+ipv4_providers = %s
+retries = 0
+
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+`, provider.URL, ovh.URL))
+
+			reader := &fakeReader{values: map[string][]net.IP{
+				"home.example.com/A": {net.ParseIP("198.51.100.1")},
+			}}
+
+			s, err := newSyncer(cfg, newHTTPClient(cfg), reader)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			err = s.syncAll(context.Background())
+
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("the synchronization succeeded")
+				}
+
+				if n := len(reqs.list()); n != 0 {
+					t.Fatalf("%d request(s) were sent to OVH", n)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			queries := reqs.list()
+			if len(queries) != 1 {
+				t.Fatalf("%d request(s) were sent to OVH, expected 1", len(queries))
+			}
+
+			if got := queries[0].Get("myip"); got != "203.0.113.7" {
+				t.Fatalf("OVH received myip=%q, expected 203.0.113.7", got)
+			}
+		})
+	}
+}
+
+func TestSyncRecordCancelled(t *testing.T) {
+	received := make(chan struct{})
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(received)
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+retries = 3
+
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+`, srv.URL))
+
+	s, err := newSyncer(cfg, newHTTPClient(cfg), &fakeReader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	go func() {
+		<-received
+		cancel()
+	}()
+
+	start := time.Now()
+
+	err = s.syncRecord(ctx, cfg.Accounts[0], "home.example.com", dynhost.IPv4, net.ParseIP("203.0.113.7"))
+	if !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected a context error, got %v", err)
+	}
+
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("the update returned %v after the cancellation", elapsed)
+	}
+}
+
+func TestSyncAll(t *testing.T) {
+	cfg := loadTestConfig(t, `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com, nas.example.com, www.example.com
+`)
+
+	d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+	r := &fakeReader{values: map[string][]net.IP{
+		"home.example.com/A": {net.ParseIP("198.51.100.1")},
+		"nas.example.com/A":  {net.ParseIP("203.0.113.7")},
+	}}
+	u := &fakeUpdater{}
+
+	s := newTestSyncer(t, cfg, d, r, u)
+
+	if err := s.syncAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The stale record is updated and the missing one created.
+	updated := make(map[string]string)
+
+	for _, call := range u.updates() {
+		if len(call.addresses) != 1 {
+			t.Fatalf("%s was updated to %v, expected a single address", call.hostname, call.addresses)
+		}
+
+		updated[call.hostname] = call.addresses[0].String()
+	}
+
+	expected := map[string]string{
+		"home.example.com": "203.0.113.7",
+		"www.example.com":  "203.0.113.7",
+	}
+
+	if len(updated) != len(expected) {
+		t.Fatalf("updated %v, expected %v", updated, expected)
+	}
+
+	for hostname, ip := range expected {
+		if updated[hostname] != ip {
+			t.Fatalf("updated %v, expected %v", updated, expected)
+		}
+	}
+
+	if r.lookups != 3 {
+		t.Fatalf("%d lookup(s), expected 3", r.lookups)
+	}
+}
+
+func TestSyncAllDetectionFailure(t *testing.T) {
+	cfg := loadTestConfig(t, `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+	d := &fakeDetector{errs: map[dynhost.Family]error{dynhost.IPv4: errors.New("no provider answered")}}
+	r := &fakeReader{}
+	u := &fakeUpdater{}
+
+	s := newTestSyncer(t, cfg, d, r, u)
+
+	err := s.syncAll(context.Background())
+	if status := exitStatus(err); status != exitDetection {
+		t.Fatalf("exit status %d for %v, expected %d", status, err, exitDetection)
+	}
+
+	if r.lookups != 0 || len(u.updates()) != 0 {
+		t.Fatalf("%d lookup(s) and %d update(s) without a public address", r.lookups, len(u.updates()))
+	}
+}
+
+func TestSyncAllUpdateFailure(t *testing.T) {
+	cfg := loadTestConfig(t, `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com, nas.example.com
+`)
+
+	d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+	u := &fakeUpdater{errs: []error{dynhost.ErrNoHost}}
+
+	s := newTestSyncer(t, cfg, d, &fakeReader{}, u)
+
+	// The other hostname is updated regardless.
+	err := s.syncAll(context.Background())
+
+	errs, ok := err.(syncErrors)
+	if !ok || len(errs) != 1 || !errors.Is(errs[0], dynhost.ErrNoHost) {
+		t.Fatalf("expected a single nohost failure, got %v", err)
+	}
+
+	if status := exitStatus(err); status != exitUpdate {
+		t.Fatalf("exit status %d, expected %d", status, exitUpdate)
+	}
+
+	if n := len(u.updates()); n != 2 {
+		t.Fatalf("%d update(s), expected 2", n)
+	}
+}
+
+func TestSyncAllDualStack(t *testing.T) {
+	const (
+		v4    = "203.0.113.7"
+		v6    = "2001:db8::7"
+		oldV4 = "198.51.100.1"
+		oldV6 = "2001:db8::1"
+	)
+
+	tests := []struct {
+		name     string
+		a, aaaa  string
+		expected []string
+	}{
+		{name: "up-to-date", a: v4, aaaa: v6},
+		{name: "IPv4 changed", a: oldV4, aaaa: v6, expected: []string{v4}},
+		{name: "IPv6 changed", a: v4, aaaa: oldV6, expected: []string{v6}},
+		{name: "both changed", a: oldV4, aaaa: oldV6, expected: []string{v4, v6}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, `
+protocol = dual
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+			d := &fakeDetector{ips: map[dynhost.Family]net.IP{
+				dynhost.IPv4: net.ParseIP(v4),
+				dynhost.IPv6: net.ParseIP(v6),
+			}}
+			r := &fakeReader{values: map[string][]net.IP{
+				"home.example.com/A":    {net.ParseIP(tt.a)},
+				"home.example.com/AAAA": {net.ParseIP(tt.aaaa)},
+			}}
+			u := &fakeUpdater{}
+
+			s := newTestSyncer(t, cfg, d, r, u)
+
+			if err := s.syncAll(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			var sent []string
+
+			for _, call := range u.updates() {
+				for _, ip := range call.addresses {
+					sent = append(sent, ip.String())
+				}
+			}
+
+			if fmt.Sprint(sent) != fmt.Sprint(tt.expected) {
+				t.Fatalf("sent %v, expected %v", sent, tt.expected)
+			}
+
+			// Both families are updated in a single request.
+			if n := len(u.updates()); len(tt.expected) > 0 && n != 1 {
+				t.Fatalf("%d request(s), expected 1", n)
+			}
+		})
+	}
+}
+
+func TestSyncAllDualStackUnavailable(t *testing.T) {
+	unreachable := errors.New("network is unreachable")
+
+	tests := []struct {
+		name    string
+		ips     map[dynhost.Family]net.IP
+		errs    map[dynhost.Family]error
+		updated string
+		skipped []dynhost.Family
+	}{
+		{
+			name:    "without IPv6",
+			ips:     map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")},
+			errs:    map[dynhost.Family]error{dynhost.IPv6: unreachable},
+			updated: "[203.0.113.7]",
+			skipped: []dynhost.Family{dynhost.IPv6},
+		},
+		{
+			name:    "without IPv4",
+			ips:     map[dynhost.Family]net.IP{dynhost.IPv6: net.ParseIP("2001:db8::7")},
+			errs:    map[dynhost.Family]error{dynhost.IPv4: unreachable},
+			updated: "[2001:db8::7]",
+			skipped: []dynhost.Family{dynhost.IPv4},
+		},
+		{
+			name: "without either",
+			errs: map[dynhost.Family]error{dynhost.IPv4: unreachable, dynhost.IPv6: unreachable},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, `
+protocol = dual
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+			u := &fakeUpdater{}
+
+			s := newTestSyncer(t, cfg, &fakeDetector{ips: tt.ips, errs: tt.errs}, &fakeReader{}, u)
+			s.metrics = newMetrics()
+
+			err := s.syncAll(context.Background())
+
+			// The records of the missing family are skipped rather than
+			// failed, unless no address is detected at all.
+			if tt.updated == "" {
+				if status := exitStatus(err); status != exitDetection {
+					t.Fatalf("exit status %d for %v, expected %d", status, err, exitDetection)
+				}
+
+				if calls := u.updates(); len(calls) != 0 {
+					t.Fatalf("unexpected updates %v", calls)
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			calls := u.updates()
+			if len(calls) != 1 || fmt.Sprint(calls[0].addresses) != tt.updated {
+				t.Fatalf("unexpected updates %v, expected one to %s", calls, tt.updated)
+			}
+
+			for _, family := range tt.skipped {
+				if n := s.metrics.skips[family]; n != 1 {
+					t.Fatalf("the %s records were skipped %d time(s), expected 1", family, n)
+				}
+			}
+		})
+	}
+}
+
+func TestSyncAllMyIP6(t *testing.T) {
+	tests := []struct {
+		protocol string
+		myip     string
+		myip6    string
+	}{
+		{protocol: "ipv4", myip: "203.0.113.7"},
+		{protocol: "dual", myip: "203.0.113.7", myip6: "2001:db8::7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.protocol, func(t *testing.T) {
+			ovh, reqs := fakeOVH(t)
+
+			cfg := loadTestConfig(t, fmt.Sprintf(`
+protocol = %s
+
+[ovh]
+api_endpoint = %s
+username = user
+password = secret
+hostname = home.example.com
+`, tt.protocol, ovh.URL))
+
+			d := &fakeDetector{ips: map[dynhost.Family]net.IP{
+				dynhost.IPv4: net.ParseIP("203.0.113.7"),
+				dynhost.IPv6: net.ParseIP("2001:db8::7"),
+			}}
+
+			s, err := newSyncer(cfg, newHTTPClient(cfg), &fakeReader{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s.detector = d
+
+			if err := s.syncAll(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			queries := reqs.list()
+			if len(queries) != 1 {
+				t.Fatalf("%d request(s), expected 1", len(queries))
+			}
+
+			q := queries[0]
+
+			if q.Get("myip") != tt.myip {
+				t.Fatalf("myip=%q, expected %q", q.Get("myip"), tt.myip)
+			}
+
+			if _, ok := q["myip6"]; ok != (tt.myip6 != "") || q.Get("myip6") != tt.myip6 {
+				t.Fatalf("unexpected myip6 in %s", q.Encode())
+			}
+		})
+	}
+}
+
+func TestUpdateLogFields(t *testing.T) {
+	tests := []struct {
+		name    string
+		values  map[string][]net.IP
+		message string
+		oldIP   interface{}
+	}{
+		{
+			name:    "updated",
+			values:  map[string][]net.IP{"home.example.com/A": {net.ParseIP("198.51.100.1")}},
+			message: "DynHost home.example.com/A updated from 198.51.100.1 to 203.0.113.7",
+			oldIP:   "198.51.100.1",
+		},
+		{
+			name:    "created",
+			message: "DynHost home.example.com/A updated from",
+			oldIP:   nil,
+		},
+		{
+			name:    "up-to-date",
+			values:  map[string][]net.IP{"home.example.com/A": {net.ParseIP("203.0.113.7")}},
+			message: "The DynHost record home.example.com/A is up-to-date.",
+			oldIP:   "203.0.113.7",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLogs(t)
+
+			cfg := loadTestConfig(t, `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+			d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+
+			s := newTestSyncer(t, cfg, d, &fakeReader{values: tt.values}, &fakeUpdater{})
+
+			if err := s.syncAll(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			var entry map[string]interface{}
+
+			for _, line := range strings.Split(strings.TrimSpace(logs()), "\n") {
+				var e map[string]interface{}
+				if err := json.Unmarshal([]byte(line), &e); err != nil {
+					t.Fatalf("invalid log line %q: %v", line, err)
+				}
+
+				if msg, _ := e["msg"].(string); strings.HasPrefix(msg, tt.message) {
+					entry = e
+				}
+			}
+
+			if entry == nil {
+				t.Fatalf("no message starting with %q in:\n%s", tt.message, logs())
+			}
+
+			expected := map[string]interface{}{
+				"hostname": "home.example.com",
+				"type":     "A",
+				"old_ip":   tt.oldIP,
+				"new_ip":   "203.0.113.7",
+			}
+
+			for k, v := range expected {
+				if got, ok := entry[k]; !ok || got != v {
+					t.Errorf("%s is %v in %v, expected %v", k, got, entry, v)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordMatch(t *testing.T) {
+	tests := []struct {
+		name   string
+		match  string
+		values []string
+		update bool
+	}{
+		{name: "exact, single record", match: "exact", values: []string{"203.0.113.7"}},
+		{name: "exact, single stale record", match: "exact", values: []string{"198.51.100.1"}, update: true},
+		{name: "exact, multiple records", match: "exact", values: []string{"198.51.100.1", "203.0.113.7"}, update: true},
+		{name: "member, single record", match: "member", values: []string{"203.0.113.7"}},
+		{name: "member, single stale record", match: "member", values: []string{"198.51.100.1"}, update: true},
+		{name: "member, multiple records", match: "member", values: []string{"198.51.100.1", "203.0.113.7"}},
+		{name: "member, multiple stale records", match: "member", values: []string{"198.51.100.1", "198.51.100.2"}, update: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, `
+record_match = `+tt.match+`
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+			var values []net.IP
+			for _, v := range tt.values {
+				values = append(values, net.ParseIP(v))
+			}
+
+			d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+			r := &fakeReader{values: map[string][]net.IP{"home.example.com/A": values}}
+			u := &fakeUpdater{}
+
+			s := newTestSyncer(t, cfg, d, r, u)
+
+			if err := s.syncAll(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			expected := 0
+			if tt.update {
+				expected = 1
+			}
+
+			if n := len(u.updates()); n != expected {
+				t.Fatalf("%d update(s) of the records %v, expected %d", n, tt.values, expected)
+			}
+		})
+	}
+}
+
+func TestDedupHostnames(t *testing.T) {
+	ovh, reqs := fakeOVH(t)
+
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+[ovh]
+api_endpoint = %[1]s
+username = user
+password = secret
+hostname = home.example.com, home.example.com
+
+[ovh:copy]
+api_endpoint = %[1]s
+username = user
+password = secret
+hostname = Home.Example.com., nas.example.com
+
+[ovh:other]
+api_endpoint = %[1]s
+username = user2
+password = secret
+hostname = home.example.com
+`, ovh.URL))
+
+	cfg.dedupHostnames()
+
+	expected := map[string]string{
+		"ovh":       "[home.example.com]",
+		"ovh:copy":  "[nas.example.com]",
+		"ovh:other": "[home.example.com]",
+	}
+
+	for _, account := range cfg.Accounts {
+		if got := fmt.Sprint(account.Hostnames); got != expected[account.Name] {
+			t.Errorf("[%s] updates %s, expected %s", account.Name, got, expected[account.Name])
+		}
+	}
+
+	d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+
+	s, err := newSyncer(cfg, ovh.Client(), &fakeReader{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s.detector = d
+
+	if err := s.syncAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	// The overlapping sections only send one request for home.example.com
+	// with the same credentials; other credentials update it again.
+	counts := make(map[string]int)
+	for _, q := range reqs.list() {
+		counts[q.Get("hostname")]++
+	}
+
+	if counts["home.example.com"] != 2 || counts["nas.example.com"] != 1 || len(counts) != 2 {
+		t.Fatalf("unexpected requests by hostname %v", counts)
+	}
+}
+
+func TestAllowedAddress(t *testing.T) {
+	allowed, err := parseCIDRs([]string{"203.0.113.0/24", "198.51.100.128/25", "2001:db8::/32"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	onlyIPv4 := allowed[:2]
+
+	tests := []struct {
+		ip      string
+		family  dynhost.Family
+		allowed []*net.IPNet
+		ok      bool
+	}{
+		{ip: "203.0.113.7", family: dynhost.IPv4, allowed: allowed, ok: true},
+		{ip: "198.51.100.200", family: dynhost.IPv4, allowed: allowed, ok: true},
+		{ip: "198.51.100.1", family: dynhost.IPv4, allowed: allowed},
+		{ip: "192.0.2.1", family: dynhost.IPv4, allowed: allowed},
+		{ip: "2001:db8::7", family: dynhost.IPv6, allowed: allowed, ok: true},
+		{ip: "2001:db9::7", family: dynhost.IPv6, allowed: allowed},
+		// No IPv6 range is listed.
+		{ip: "2001:db9::7", family: dynhost.IPv6, allowed: onlyIPv4, ok: true},
+		{ip: "192.0.2.1", family: dynhost.IPv4, ok: true},
+	}
+
+	for _, tt := range tests {
+		if ok := allowedAddress(net.ParseIP(tt.ip), tt.family, tt.allowed); ok != tt.ok {
+			t.Errorf("allowedAddress(%s, %v) = %v, expected %v", tt.ip, tt.allowed, ok, tt.ok)
+		}
+	}
+}
+
+func TestSyncAllAllowedCIDRs(t *testing.T) {
+	tests := []struct {
+		name string
+		ip   string
+		ok   bool
+	}{
+		{name: "in range", ip: "203.0.113.7", ok: true},
+		{name: "out of range", ip: "198.51.100.7"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, `
+allowed_cidrs = 203.0.113.0/24, 2001:db8::/32
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+			d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP(tt.ip)}}
+			u := &fakeUpdater{}
+
+			s := newTestSyncer(t, cfg, d, &fakeReader{}, u)
+
+			err := s.syncAll(context.Background())
+
+			if tt.ok {
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if calls := u.updates(); len(calls) != 1 || !calls[0].addresses[0].Equal(net.ParseIP(tt.ip)) {
+					t.Fatalf("unexpected updates %v", calls)
+				}
+
+				return
+			}
+
+			if status := exitStatus(err); status != exitDetection {
+				t.Fatalf("exit status %d for %v, expected %d", status, err, exitDetection)
+			}
+
+			if !strings.Contains(err.Error(), tt.ip+" is outside of allowed_cidrs (203.0.113.0/24)") {
+				t.Fatalf("unexpected error %v", err)
+			}
+
+			if calls := u.updates(); len(calls) != 0 {
+				t.Fatalf("the address out of range was published: %v", calls)
+			}
+		})
+	}
+}
+
+func TestPlaceholderState(t *testing.T) {
+	tests := []struct {
+		name        string
+		placeholder string
+		value       string
+		lookups     int
+		updates     int
+	}{
+		{name: "placeholder", placeholder: "0.0.0.0", value: "0.0.0.0", lookups: 2, updates: 2},
+		// The state is trusted once the record was read, e.g. while the
+		// caches still hold the previous address.
+		{name: "stale record", placeholder: "0.0.0.0", value: "198.51.100.1", lookups: 2, updates: 1},
+		{name: "without placeholder_ips", value: "0.0.0.0", lookups: 1, updates: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, `
+placeholder_ips = `+tt.placeholder+`
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`)
+
+			d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+			r := &fakeReader{values: map[string][]net.IP{"home.example.com/A": {net.ParseIP("198.51.100.1")}}}
+			u := &fakeUpdater{}
+
+			s := newTestSyncer(t, cfg, d, r, u)
+
+			// The first cycle publishes the address to the state.
+			if err := s.syncAll(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			r.mu.Lock()
+			r.values["home.example.com/A"] = []net.IP{net.ParseIP(tt.value)}
+			r.mu.Unlock()
+
+			if err := s.syncAll(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+
+			if r.lookups != tt.lookups {
+				t.Fatalf("%d lookup(s), expected %d", r.lookups, tt.lookups)
+			}
+
+			if n := len(u.updates()); n != tt.updates {
+				t.Fatalf("%d update(s), expected %d", n, tt.updates)
+			}
+		})
+	}
+}
+
+func TestAlwaysUpdate(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    string
+		force   bool
+		updates int
+	}{
+		// The state and the up-to-date record are ignored.
+		{name: "up-to-date", updates: 2},
+		{name: "debounce", keys: "interval = 1m\ndebounce = 2m", updates: 0},
+		{name: "min_update_interval", keys: "min_update_interval = 10m", updates: 1},
+		// Unlike always_update, -force skips the debounce.
+		{name: "debounce with -force", keys: "interval = 1m\ndebounce = 2m", force: true, updates: 2},
+		{name: "min_update_interval with -force", keys: "min_update_interval = 10m", force: true, updates: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadTestConfig(t, tt.keys+`
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+always_update = true
+`)
+
+			d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+			r := &fakeReader{values: map[string][]net.IP{"home.example.com/A": {net.ParseIP("203.0.113.7")}}}
+			u := &fakeUpdater{}
+
+			s := newTestSyncer(t, cfg, d, r, u)
+			s.force = tt.force
+
+			for i := 0; i < 2; i++ {
+				if err := s.syncAll(context.Background()); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if n := len(u.updates()); n != tt.updates {
+				t.Fatalf("%d update(s), expected %d", n, tt.updates)
+			}
+		})
+	}
+}
+
+func TestAlwaysUpdateLookupError(t *testing.T) {
+	cfg := loadTestConfig(t, `
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+always_update = true
+`)
+
+	d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+	r := &fakeReader{err: errors.New("no nameserver")}
+	u := &fakeUpdater{}
+
+	s := newTestSyncer(t, cfg, d, r, u)
+
+	// Only -force updates the records that cannot be read.
+	if err := s.syncAll(context.Background()); err == nil {
+		t.Fatal("the lookup error was not returned")
+	}
+
+	s.force = true
+
+	if err := s.syncAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(u.updates()); n != 1 {
+		t.Fatalf("%d update(s), expected 1", n)
+	}
+}
@@ -0,0 +1,19 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package main
+
+import (
+	"errors"
+)
+
+var facilities = map[string]struct{}{
+	"kern": {}, "user": {}, "mail": {}, "daemon": {}, "auth": {}, "syslog": {},
+	"lpr": {}, "news": {}, "uucp": {}, "cron": {}, "authpriv": {}, "ftp": {},
+	"local0": {}, "local1": {}, "local2": {}, "local3": {},
+	"local4": {}, "local5": {}, "local6": {}, "local7": {},
+}
+
+func openSyslog(facility string) (syslogWriter, error) {
+	return nil, errors.New("syslog is not supported on this platform")
+}
@@ -0,0 +1,67 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package main
+
+import (
+	"log/syslog"
+)
+
+var facilities = map[string]syslog.Priority{
+	"kern":     syslog.LOG_KERN,
+	"user":     syslog.LOG_USER,
+	"mail":     syslog.LOG_MAIL,
+	"daemon":   syslog.LOG_DAEMON,
+	"auth":     syslog.LOG_AUTH,
+	"syslog":   syslog.LOG_SYSLOG,
+	"lpr":      syslog.LOG_LPR,
+	"news":     syslog.LOG_NEWS,
+	"uucp":     syslog.LOG_UUCP,
+	"cron":     syslog.LOG_CRON,
+	"authpriv": syslog.LOG_AUTHPRIV,
+	"ftp":      syslog.LOG_FTP,
+	"local0":   syslog.LOG_LOCAL0,
+	"local1":   syslog.LOG_LOCAL1,
+	"local2":   syslog.LOG_LOCAL2,
+	"local3":   syslog.LOG_LOCAL3,
+	"local4":   syslog.LOG_LOCAL4,
+	"local5":   syslog.LOG_LOCAL5,
+	"local6":   syslog.LOG_LOCAL6,
+	"local7":   syslog.LOG_LOCAL7,
+}
+
+// unixSyslog sends the messages to the local syslog daemon.
+type unixSyslog struct {
+	w *syslog.Writer
+}
+
+// openSyslog connects to the local syslog daemon, logging with the facility.
+func openSyslog(facility string) (syslogWriter, error) {
+	w, err := syslog.New(facilities[facility]|syslog.LOG_INFO, "go-dynhost")
+	if err != nil {
+		return nil, err
+	}
+
+	return &unixSyslog{w: w}, nil
+}
+
+// write sends msg with the severity of level. The changes of the records are
+// notices, as they are kept in quiet mode.
+func (s *unixSyslog) write(level logLevel, change bool, msg string) error {
+	switch {
+	case level == levelDebug:
+		return s.w.Debug(msg)
+	case level == levelWarn:
+		return s.w.Warning(msg)
+	case level == levelError:
+		return s.w.Err(msg)
+	case change:
+		return s.w.Notice(msg)
+	}
+
+	return s.w.Info(msg)
+}
+
+func (s *unixSyslog) Close() error {
+	return s.w.Close()
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// version is set when building releases, with
+// -ldflags "-X main.version=1.2.3".
+var version = "dev"
+
+// versionString describes the build: its version, the Go version it was built
+// with and, if known, the commit it was built from.
+func versionString() string {
+	s := fmt.Sprintf("go-dynhost %s (%s", version, runtime.Version())
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		var commit, modified string
+
+		for _, setting := range info.Settings {
+			switch setting.Key {
+			case "vcs.revision":
+				commit = setting.Value
+			case "vcs.modified":
+				if setting.Value == "true" {
+					modified = ", modified"
+				}
+			}
+		}
+
+		if commit != "" {
+			s += ", commit " + commit + modified
+		}
+	}
+
+	return s + ")"
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestVersionString(t *testing.T) {
+	old := version
+	version = "1.2.3"
+	t.Cleanup(func() { version = old })
+
+	s := versionString()
+
+	if !strings.HasPrefix(s, "go-dynhost 1.2.3 ("+runtime.Version()) || !strings.HasSuffix(s, ")") {
+		t.Fatalf("unexpected version %q", s)
+	}
+}
+
+func TestVersionFlag(t *testing.T) {
+	old := version
+	version = "1.2.3"
+	t.Cleanup(func() { version = old })
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	stdout := os.Stdout
+	os.Stdout = w
+
+	status := runArgs(t, "-version")
+
+	os.Stdout = stdout
+	w.Close()
+
+	out, err := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if status != exitOK {
+		t.Fatalf("exit status %d, expected %d", status, exitOK)
+	}
+
+	if got, expected := strings.TrimSpace(string(out)), versionString(); got != expected {
+		t.Fatalf("-version printed %q, expected %q", got, expected)
+	}
+
+	if !strings.Contains(string(out), "go-dynhost 1.2.3 ") {
+		t.Fatalf("-version printed %q, without the version", out)
+	}
+}
+
+func TestVersionFailures(t *testing.T) {
+	dir := t.TempDir()
+
+	stateFile := filepath.Join(dir, "state.json")
+
+	s := loadState(stateFile)
+	for i := 0; i < 2; i++ {
+		if _, err := s.runFinished(true); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	path := filepath.Join(dir, "dynhost.cfg")
+
+	body := "state_file = " + stateFile + "\n\n[ovh]\nusername = user\npassword = secret\nhostname = home.example.com\n"
+
+	if err := ioutil.WriteFile(path, []byte(body), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	opts := options{configFile: path}
+
+	if got, expected := opts.failureStatus(), "2 consecutive failed run(s), according to "+stateFile; got != expected {
+		t.Fatalf("got %q, expected %q", got, expected)
+	}
+
+	// Nothing is shown without a configuration.
+	opts.configFile = filepath.Join(dir, "missing.cfg")
+
+	if got := opts.failureStatus(); got != "" {
+		t.Fatalf("got %q without a configuration", got)
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+// webhook POSTs the changes as JSON objects to a URL.
+type webhook struct {
+	client *http.Client
+	url    string
+}
+
+func (w *webhook) String() string {
+	return w.url
+}
+
+func (w *webhook) notifyChange(ctx context.Context, c *ipChange) error {
+	body, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent(""))
+
+	res, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return &dynhost.StatusError{Server: "the webhook", Status: res.Status, Code: res.StatusCode}
+	}
+
+	return nil
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"git.quba.fr/qbarrand/go-dynhost/dynhost"
+)
+
+func TestWebhookPayload(t *testing.T) {
+	var (
+		contentType string
+		payload     map[string]interface{}
+	)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentType = r.Header.Get("Content-Type")
+
+		b, _ := ioutil.ReadAll(r.Body)
+		if err := json.Unmarshal(b, &payload); err != nil {
+			t.Errorf("the webhook received invalid JSON %s: %v", b, err)
+		}
+	}))
+	defer srv.Close()
+
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+webhook_url = %s
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`, srv.URL))
+
+	d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+	r := &fakeReader{values: map[string][]net.IP{"home.example.com/A": {net.ParseIP("198.51.100.1")}}}
+
+	s := newTestSyncer(t, cfg, d, r, &fakeUpdater{})
+
+	before := time.Now().UTC().Add(-time.Second)
+
+	if err := s.syncAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if contentType != "application/json" {
+		t.Fatalf("the webhook received the content type %q", contentType)
+	}
+
+	expected := map[string]string{
+		"hostname": "home.example.com",
+		"type":     "A",
+		"old_ip":   "198.51.100.1",
+		"new_ip":   "203.0.113.7",
+	}
+
+	for k, v := range expected {
+		if payload[k] != v {
+			t.Errorf("%s is %v in the payload, expected %s", k, payload[k], v)
+		}
+	}
+
+	ts, _ := payload["timestamp"].(string)
+
+	at, err := time.Parse(time.RFC3339, ts)
+	if err != nil || at.Before(before) || at.After(time.Now().UTC()) {
+		t.Errorf("invalid timestamp %q in the payload", ts)
+	}
+
+	if len(payload) != len(expected)+1 {
+		t.Errorf("unexpected payload %v", payload)
+	}
+}
+
+func TestWebhookFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	cfg := loadTestConfig(t, fmt.Sprintf(`
+webhook_url = %s
+
+[ovh]
+username = user
+password = secret
+hostname = home.example.com
+`, srv.URL))
+
+	d := &fakeDetector{ips: map[dynhost.Family]net.IP{dynhost.IPv4: net.ParseIP("203.0.113.7")}}
+	u := &fakeUpdater{}
+
+	s := newTestSyncer(t, cfg, d, &fakeReader{}, u)
+
+	// The record is updated regardless.
+	if err := s.syncAll(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := len(u.updates()); n != 1 {
+		t.Fatalf("%d update(s), expected 1", n)
+	}
+}